@@ -0,0 +1,289 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"pubot/internal/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// Options agent 的启动参数
+type Options struct {
+	Server   string   // 服务端地址, 例如 http://10.0.0.1:7777
+	Token    string   // 服务端配置的 agentToken
+	Name     string   // agent 名称, 默认为主机名
+	Labels   []string // 标签, 例如 linux、arm64
+	Capacity int      // 同时执行的会话数, 默认 1
+	WorkDir  string   // 工作目录, 任务的工作目录和 agent 的凭据都放在这里
+}
+
+// 保存服务端生成的凭据的文件, 在工作目录下
+const secretFile = ".pubot-agent-secret"
+
+// errRejected 服务端拒绝注册, 重新连接也不会成功
+var errRejected = errors.New("服务端拒绝注册")
+
+// errServerCancel 服务端取消了正在执行的步骤
+var errServerCancel = errors.New("服务端取消执行")
+
+type runner struct {
+	opts   Options
+	secret string
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+// session agent 上的一个 bash 会话, 对应服务端的一个 agent 会话
+type session struct {
+	shell  *utils.ShellSession
+	mu     sync.Mutex
+	cancel context.CancelCauseFunc // 正在执行的步骤
+}
+
+// Run 连接服务端并执行服务端分配的步骤, 连接断开后重新连接, ctx 结束或被服务端拒绝时返回
+func Run(ctx context.Context, opts Options) error {
+	if opts.Server == "" || opts.Token == "" {
+		return errors.New("需要设置 --server 和 --token")
+	}
+	if opts.Name == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("获取主机名失败, 请设置 --name: %w", err)
+		}
+		opts.Name = host
+	}
+	opts.Capacity = max(opts.Capacity, 1)
+	labels, err := utils.NormalizeLabels(opts.Labels)
+	if err != nil {
+		return err
+	}
+	opts.Labels = labels
+	dir, err := filepath.Abs(opts.WorkDir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	opts.WorkDir = dir
+	r := &runner{opts: opts, sessions: make(map[string]*session)}
+	if data, err := os.ReadFile(filepath.Join(dir, secretFile)); err == nil {
+		r.secret = strings.TrimSpace(string(data))
+	}
+
+	delay := time.Second
+	for {
+		start := time.Now()
+		err := r.serve(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, errRejected) {
+			return err
+		}
+		if time.Since(start) > time.Minute {
+			delay = time.Second
+		}
+		slog.Error("与服务端的连接断开, 稍后重新连接", slog.String("Err", err.Error()), slog.Duration("Delay", delay))
+		if utils.Sleep(ctx, delay) != nil {
+			return nil
+		}
+		delay = min(delay*2, 30*time.Second)
+	}
+}
+
+// serve 连接服务端并处理消息, 直到连接断开
+func (r *runner) serve(ctx context.Context) error {
+	u, err := url.Parse(strings.TrimSuffix(r.opts.Server, "/") + "/ws/agent")
+	if err != nil {
+		return fmt.Errorf("%w: 无效的服务端地址: %v", errRejected, err)
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "ws"
+	case "https":
+		u.Scheme = "wss"
+	}
+	header := http.Header{"Authorization": []string{"Bearer " + r.opts.Token}}
+	ws, resp, err := websocket.DefaultDialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("%w: token 无效", errRejected)
+		}
+		return err
+	}
+	conn := NewConn(ws)
+	defer conn.Close()
+	// ctx 结束时断开连接, 结束读取
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	// 连接断开后结束所有会话, 服务端会把没有完成的步骤重新排队
+	defer r.closeAll()
+
+	err = conn.Send(Message{
+		Type:     MsgRegister,
+		Name:     r.opts.Name,
+		Secret:   r.secret,
+		Labels:   r.opts.Labels,
+		Capacity: r.opts.Capacity,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+	})
+	if err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(HeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if conn.Send(Message{Type: MsgHeartbeat}) != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		m, err := conn.Receive()
+		if err != nil {
+			return err
+		}
+		switch m.Type {
+		case MsgRegistered:
+			r.registered(m)
+		case MsgReject:
+			return fmt.Errorf("%w: %s", errRejected, m.Error)
+		case MsgOpen:
+			conn.Send(r.open(m))
+		case MsgStep:
+			go r.step(conn, m)
+		case MsgCancel:
+			if s := r.session(m.Session); s != nil {
+				s.mu.Lock()
+				if s.cancel != nil {
+					s.cancel(errServerCancel)
+				}
+				s.mu.Unlock()
+			}
+		case MsgClose:
+			r.close(m.Session)
+		}
+	}
+}
+
+// registered 保存第一次注册时服务端生成的凭据
+func (r *runner) registered(m Message) {
+	if m.Secret != "" && m.Secret != r.secret {
+		r.secret = m.Secret
+		if err := os.WriteFile(filepath.Join(r.opts.WorkDir, secretFile), []byte(m.Secret+"\n"), 0o600); err != nil {
+			slog.Error("保存 agent 凭据失败", slog.String("Err", err.Error()))
+		}
+	}
+	if m.Approved {
+		slog.Info("已连接到服务端", slog.String("Name", r.opts.Name), slog.Any("Labels", r.opts.Labels), slog.Int("Capacity", r.opts.Capacity))
+	} else {
+		slog.Info("已连接到服务端, 等待管理员批准", slog.String("Name", r.opts.Name))
+	}
+}
+
+// open 在工作目录下打开会话, 会话继承 agent 进程的环境变量, $PUBOT_WORKSPACE 为 agent 上的工作目录
+func (r *runner) open(m Message) Message {
+	reply := Message{Type: MsgOpened, Session: m.Session}
+	if !filepath.IsLocal(m.WorkDir) {
+		reply.Error = "无效的工作目录: " + m.WorkDir
+		return reply
+	}
+	dir := filepath.Join(r.opts.WorkDir, m.WorkDir)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		reply.Error = err.Error()
+		return reply
+	}
+	env := utils.EnvMap(m.Env)
+	env["PUBOT_WORKSPACE"] = dir
+	env["PUBOT_AGENT"] = r.opts.Name
+	shell, err := utils.StartShell(dir, utils.MergeEnv(os.Environ(), env))
+	if err != nil {
+		reply.Error = err.Error()
+		return reply
+	}
+	r.mu.Lock()
+	r.sessions[m.Session] = &session{shell: shell}
+	r.mu.Unlock()
+	return reply
+}
+
+// step 在会话中执行一个步骤, 输出逐行发送给服务端
+func (r *runner) step(conn *Conn, m Message) {
+	reply := Message{Type: MsgDone, Session: m.Session, Step: m.Step, Code: -1}
+	s := r.session(m.Session)
+	if s == nil {
+		reply.Error, reply.Exited = "会话不存在", true
+		conn.Send(reply)
+		return
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+
+	code, err := s.shell.RunStep(ctx, m.Script, m.StepEnv, func(stream, text string) {
+		conn.Send(Message{Type: MsgOutput, Session: m.Session, Step: m.Step, Stream: stream, Text: text})
+	})
+	s.mu.Lock()
+	s.cancel = nil
+	s.mu.Unlock()
+	reply.Code, reply.Exited = code, s.shell.Exited()
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	conn.Send(reply)
+}
+
+func (r *runner) session(id string) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
+
+// close 关闭会话, 正在执行的步骤随 bash 一起结束
+func (r *runner) close(id string) {
+	r.mu.Lock()
+	s := r.sessions[id]
+	delete(r.sessions, id)
+	r.mu.Unlock()
+	if s != nil {
+		s.shell.Close()
+	}
+}
+
+func (r *runner) closeAll() {
+	r.mu.Lock()
+	ids := make([]string, 0, len(r.sessions))
+	for id := range r.sessions {
+		ids = append(ids, id)
+	}
+	r.mu.Unlock()
+	for _, id := range ids {
+		r.close(id)
+	}
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// 服务端和 agent 之间通过 WebSocket 收发 JSON 消息, Type 决定消息使用哪些字段
+const (
+	// agent -> 服务端
+	MsgRegister  = "register"  // 连接后的第一条消息, 上报名称、标签、并发数和凭据
+	MsgHeartbeat = "heartbeat" // 定期发送, 服务端原样回复
+	MsgOpened    = "opened"    // 会话已打开, 失败时 Error 不为空
+	MsgOutput    = "output"    // 步骤的一行输出
+	MsgDone      = "done"      // 步骤结束
+	// 服务端 -> agent
+	MsgRegistered = "registered" // 注册结果和批准状态, 第一次注册时带上服务端生成的凭据
+	MsgReject     = "reject"     // 拒绝注册, 随后断开连接
+	MsgOpen       = "open"       // 打开会话
+	MsgStep       = "step"       // 在会话中执行一个步骤
+	MsgCancel     = "cancel"     // 取消会话中正在执行的步骤
+	MsgClose      = "close"      // 关闭会话
+)
+
+// agent 每隔 HeartbeatInterval 发送一次心跳, 任何一方超过 HeartbeatTimeout 没有收到消息时认为连接已断开
+const (
+	HeartbeatInterval = 10 * time.Second
+	HeartbeatTimeout  = 3 * HeartbeatInterval
+)
+
+// Message 服务端和 agent 之间的消息
+type Message struct {
+	Type    string `json:"type"`
+	Session string `json:"session,omitempty"` // 会话 ID, 由服务端生成
+	Step    int    `json:"step,omitempty"`    // 会话中的步骤序号, 从 1 开始
+
+	// register / registered
+	Name     string   `json:"name,omitempty"`
+	Secret   string   `json:"secret,omitempty"` // agent 的凭据, 第一次注册时由服务端生成, 之后注册时带上
+	Labels   []string `json:"labels,omitempty"`
+	Capacity int      `json:"capacity,omitempty"` // 同时执行的会话数
+	OS       string   `json:"os,omitempty"`
+	Arch     string   `json:"arch,omitempty"`
+	Approved bool     `json:"approved,omitempty"`
+
+	// open
+	WorkDir string   `json:"workDir,omitempty"` // 相对 agent 工作目录的路径
+	Env     []string `json:"env,omitempty"`     // KEY=VALUE 形式的由 pubot 设置的环境变量
+
+	// step
+	Script  string            `json:"script,omitempty"`
+	StepEnv map[string]string `json:"stepEnv,omitempty"` // 只对本步骤有效的环境变量
+
+	// output
+	Stream string `json:"stream,omitempty"`
+	Text   string `json:"text,omitempty"`
+
+	// opened / done / reject
+	Code   int    `json:"code,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Exited bool   `json:"exited,omitempty"` // 会话中的 bash 已经退出, 不能继续执行步骤
+}
+
+// Conn 收发消息的 WebSocket 连接, 可以在多个协程中同时发送
+type Conn struct {
+	ws *websocket.Conn
+	mu sync.Mutex
+}
+
+func NewConn(ws *websocket.Conn) *Conn {
+	return &Conn{ws: ws}
+}
+
+func (c *Conn) Send(m Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ws.SetWriteDeadline(time.Now().Add(HeartbeatTimeout))
+	return c.ws.WriteJSON(m)
+}
+
+// Receive 读取下一条消息, 超过 HeartbeatTimeout 没有消息时返回错误
+func (c *Conn) Receive() (Message, error) {
+	var m Message
+	c.ws.SetReadDeadline(time.Now().Add(HeartbeatTimeout))
+	err := c.ws.ReadJSON(&m)
+	return m, err
+}
+
+func (c *Conn) Close() error {
+	return c.ws.Close()
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"pubot/internal/agent"
+	"pubot/internal/model"
+	"pubot/internal/service"
+	"pubot/internal/utils"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"gorm.io/gorm"
+)
+
+type AgentApi struct {
+	agentService *service.AgentService
+}
+
+func NewAgentApi(agentService *service.AgentService) *AgentApi {
+	return &AgentApi{agentService: agentService}
+}
+
+func (aa *AgentApi) Register(router *mux.Router) {
+	router.HandleFunc("/agent", aa.list).Methods("GET")
+	router.HandleFunc("/agent/{id:[0-9]+}/approve", aa.approve).Methods("POST")
+	router.HandleFunc("/agent/{id:[0-9]+}", aa.delete).Methods("DELETE")
+}
+
+// agentFailure 按错误类型返回管理 agent 失败的原因
+func agentFailure(w http.ResponseWriter, err error, message string) {
+	switch {
+	case errors.Is(err, service.ErrAgentForbidden):
+		utils.Failure(w, utils.Map{"code": 403, "message": err.Error()})
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		utils.Failure(w, utils.Map{"code": 404, "message": "agent 不存在"})
+	default:
+		utils.Failure(w, utils.Map{"code": 500, "message": message})
+	}
+}
+
+// Connect agent 连接服务端, 使用 agentToken 认证, 不经过用户认证中间件
+func (aa *AgentApi) Connect(w http.ResponseWriter, r *http.Request) {
+	if err := aa.agentService.Authorize(r.Header.Get("Authorization")); err != nil {
+		slog.Error("agent 认证失败", slog.String("RemoteAddr", r.RemoteAddr), slog.String("Err", err.Error()))
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	upgrader := websocket.Upgrader{}
+	ws, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		slog.Error("ws 升级失败", slog.Any("Err", err.Error()))
+		return
+	}
+	aa.agentService.Serve(agent.NewConn(ws), r.RemoteAddr)
+}
+
+// list 获取 agent 列表
+func (aa *AgentApi) list(w http.ResponseWriter, r *http.Request) {
+	agents, err := aa.agentService.List()
+	if err != nil {
+		slog.Error("获取 agent 列表失败", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 503, "message": "获取 agent 列表失败"})
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "获取 agent 列表成功", "data": agents})
+}
+
+// approve 批准 agent(管理员)
+func (aa *AgentApi) approve(w http.ResponseWriter, r *http.Request) {
+	agentId, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		slog.Error("无效的 agent ID", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "无效的 agent ID"})
+		return
+	}
+	user, ok := r.Context().Value(utils.ContextUserKey).(*model.PbUser)
+	if !ok || user == nil {
+		utils.Failure(w, utils.Map{"code": 401, "message": "用户未登录"})
+		return
+	}
+	if err := aa.agentService.Approve(uint(agentId), user); err != nil {
+		slog.Error("批准 agent 失败", slog.Any("Err", err.Error()))
+		agentFailure(w, err, "批准 agent 失败")
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "批准 agent 成功"})
+}
+
+// delete 删除 agent(管理员), 在线的 agent 会被断开
+func (aa *AgentApi) delete(w http.ResponseWriter, r *http.Request) {
+	agentId, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		slog.Error("无效的 agent ID", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "无效的 agent ID"})
+		return
+	}
+	user, ok := r.Context().Value(utils.ContextUserKey).(*model.PbUser)
+	if !ok || user == nil {
+		utils.Failure(w, utils.Map{"code": 401, "message": "用户未登录"})
+		return
+	}
+	if err := aa.agentService.Delete(uint(agentId), user); err != nil {
+		slog.Error("删除 agent 失败", slog.Any("Err", err.Error()))
+		agentFailure(w, err, "删除 agent 失败")
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "删除 agent 成功"})
+}
@@ -1,17 +1,21 @@
 package api
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
 	"strconv"
 	"sync"
 
 	"pubot/internal/dto"
+	"pubot/internal/model"
 	"pubot/internal/service"
 	"pubot/internal/utils"
 
 	"github.com/gorilla/mux"
+	"gorm.io/gorm"
 )
 
 type TaskApi struct {
@@ -27,11 +31,17 @@ func NewTaskApi(taskService *service.TaskService) *TaskApi {
 
 func (ta *TaskApi) Register(router *mux.Router) {
 	router.HandleFunc("/task", ta.create).Methods("POST")
+	router.HandleFunc("/task/validate", ta.validate).Methods("POST")
 	router.HandleFunc("/task/{id:[0-9]+}", ta.delete).Methods("DELETE")
 	router.HandleFunc("/task/{id:[0-9]+}", ta.update).Methods("PUT")
 	router.HandleFunc("/task", ta.list).Methods("GET")
 	router.HandleFunc("/task/{id:[0-9]+}", ta.get).Methods("GET")
 	router.HandleFunc("/task/{id:[0-9]+}", ta.execute).Methods("POST")
+	router.HandleFunc("/task/{id:[0-9]+}/cancel", ta.cancel).Methods("POST")
+	router.HandleFunc("/task/{id:[0-9]+}/workspace", ta.cleanWorkspace).Methods("DELETE")
+	router.HandleFunc("/task/{id:[0-9]+}/runs", ta.runs).Methods("GET")
+	router.HandleFunc("/task/{id:[0-9]+}/runs/{n:[0-9]+}", ta.run).Methods("GET")
+	router.HandleFunc("/task/{id:[0-9]+}/runs/{n:[0-9]+}/log", ta.runLog).Methods("GET")
 }
 
 // create 创建流水线任务模板(ok)
@@ -46,10 +56,29 @@ func (ta *TaskApi) create(w http.ResponseWriter, r *http.Request) {
 	task, err := ta.taskService.Create(req)
 	if err != nil {
 		slog.Error("添加流水线任务失败", slog.Any("Err", err.Error()))
+		var yamlErr *utils.YAMLError
+		if errors.As(err, &yamlErr) {
+			utils.Failure(w, utils.Map{"code": 400, "message": yamlErr.Error(), "data": yamlErr.Issues})
+			return
+		}
 		utils.Failure(w, utils.Map{"code": 503, "message": "添加流水线任务失败"})
 		return
 	}
-	utils.Success(w, utils.Map{"code": 200, "message": "添加流水线任务成功", "data": task})
+	utils.Success(w, utils.Map{"code": 200, "message": "添加流水线任务成功", "data": task,
+		"warnings": ta.taskService.Validate(req.YAML).Warnings})
+}
+
+// validate 校验任务 YAML, 返回错误、警告和转换后的结构, 不保存
+// 错误和警告都带有行列位置, 供编辑器实时提示
+func (ta *TaskApi) validate(w http.ResponseWriter, r *http.Request) {
+	var req dto.TaskValidateRequest
+	if err := utils.Bind(r, &req); err != nil {
+		slog.Error("绑定请求体参数失败", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "绑定请求体参数失败"})
+		return
+	}
+	result := ta.taskService.Validate(req.YAML)
+	utils.Success(w, utils.Map{"code": 200, "message": "校验完成", "data": result})
 }
 
 // delete 删除流水线任务模板
@@ -92,10 +121,19 @@ func (ta *TaskApi) update(w http.ResponseWriter, r *http.Request) {
 	task, err := ta.taskService.Update(uint(taskId), req)
 	if err != nil {
 		slog.Error("更新流水线任务失败", slog.Any("Err", err.Error()))
+		var yamlErr *utils.YAMLError
+		if errors.As(err, &yamlErr) {
+			utils.Failure(w, utils.Map{"code": 400, "message": yamlErr.Error(), "data": yamlErr.Issues})
+			return
+		}
 		utils.Failure(w, utils.Map{"code": 500, "message": "更新流水线任务失败"})
 		return
 	}
-	utils.Success(w, utils.Map{"code": 200, "message": "更新流水线任务成功", "data": task})
+	resp := utils.Map{"code": 200, "message": "更新流水线任务成功", "data": task}
+	if req.YAML != "" {
+		resp["warnings"] = ta.taskService.Validate(req.YAML).Warnings
+	}
+	utils.Success(w, resp)
 }
 
 // get 获取单个流水线任务
@@ -128,6 +166,7 @@ func (ta *TaskApi) list(w http.ResponseWriter, r *http.Request) {
 	utils.Success(w, utils.Map{"code": 200, "message": "获取任务列表成功", "data": tasks})
 }
 
+// execute 手动触发执行任务
 func (ta *TaskApi) execute(w http.ResponseWriter, r *http.Request) {
 	taskIdStr := mux.Vars(r)["id"]
 	// 如果需要数字类型，需要手动转换
@@ -137,11 +176,220 @@ func (ta *TaskApi) execute(w http.ResponseWriter, r *http.Request) {
 		utils.Failure(w, utils.Map{"code": 400, "message": "无效的 task ID"})
 		return
 	}
-	err = ta.taskService.Execute(uint(taskId))
+	// 请求体可以为空, 不传参数时使用参数的默认值
+	var req dto.TaskExecuteRequest
+	if err := utils.Bind(r, &req); err != nil && !errors.Is(err, io.EOF) {
+		slog.Error("绑定请求体参数失败", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "绑定请求体参数失败"})
+		return
+	}
+	user, _ := r.Context().Value(utils.ContextUserKey).(*model.PbUser)
+	run, err := ta.taskService.Execute(uint(taskId), model.TriggerManual, user, req.Params)
 	if err != nil {
+		slog.Error("执行任务失败", slog.Any("Err", err.Error()))
+		switch {
+		case errors.Is(err, service.ErrInvalidParams):
+			utils.Failure(w, utils.Map{"code": 400, "message": err.Error()})
+			return
+		case errors.Is(err, service.ErrTaskBusy) || errors.Is(err, service.ErrShutdown):
+			utils.Failure(w, utils.Map{"code": 409, "message": err.Error()})
+			return
+		}
+		utils.Failure(w, utils.Map{"code": 500, "message": "执行任务失败"})
+		return
+	}
 
+	utils.Success(w, utils.Map{"code": 200, "message": "执行任务操作成功", "data": run})
+}
+
+// cancel 取消任务正在进行的执行
+func (ta *TaskApi) cancel(w http.ResponseWriter, r *http.Request) {
+	taskId, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		slog.Error("无效的task ID", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "无效的 task ID"})
 		return
 	}
+	user, ok := r.Context().Value(utils.ContextUserKey).(*model.PbUser)
+	if !ok || user == nil {
+		utils.Failure(w, utils.Map{"code": 401, "message": "用户未登录"})
+		return
+	}
+	numbers, err := ta.taskService.Cancel(uint(taskId), user)
+	if err != nil {
+		slog.Error("取消任务失败", slog.Any("Err", err.Error()))
+		switch {
+		case errors.Is(err, service.ErrForbidden):
+			utils.Failure(w, utils.Map{"code": 403, "message": err.Error()})
+		case errors.Is(err, service.ErrRunNotActive):
+			utils.Failure(w, utils.Map{"code": 409, "message": err.Error()})
+		default:
+			utils.Failure(w, utils.Map{"code": 500, "message": "取消任务失败"})
+		}
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "取消任务成功", "data": utils.Map{"runs": numbers}})
+}
 
-	utils.Success(w, utils.Map{"code": 200, "message": "执行任务操作成功"})
+// cleanWorkspace 删除任务的工作目录(管理员)
+func (ta *TaskApi) cleanWorkspace(w http.ResponseWriter, r *http.Request) {
+	taskId, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		slog.Error("无效的task ID", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "无效的 task ID"})
+		return
+	}
+	user, ok := r.Context().Value(utils.ContextUserKey).(*model.PbUser)
+	if !ok || user == nil {
+		utils.Failure(w, utils.Map{"code": 401, "message": "用户未登录"})
+		return
+	}
+	if err := ta.taskService.CleanWorkspace(uint(taskId), user); err != nil {
+		slog.Error("删除工作目录失败", slog.Any("Err", err.Error()))
+		switch {
+		case errors.Is(err, service.ErrForbidden):
+			utils.Failure(w, utils.Map{"code": 403, "message": err.Error()})
+		case errors.Is(err, service.ErrTaskBusy):
+			utils.Failure(w, utils.Map{"code": 409, "message": err.Error()})
+		default:
+			utils.Failure(w, utils.Map{"code": 500, "message": "删除工作目录失败"})
+		}
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "删除工作目录成功"})
+}
+
+// runs 获取任务执行记录列表, 支持 limit/offset 分页
+func (ta *TaskApi) runs(w http.ResponseWriter, r *http.Request) {
+	taskIdStr := mux.Vars(r)["id"]
+	taskId, err := strconv.ParseUint(taskIdStr, 10, 0)
+	if err != nil {
+		slog.Error("无效的task ID", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "无效的 task ID"})
+		return
+	}
+	limit, offset := 20, 0
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			utils.Failure(w, utils.Map{"code": 400, "message": "无效的 limit 参数"})
+			return
+		}
+	}
+	if v := r.URL.Query().Get("offset"); v != "" {
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			utils.Failure(w, utils.Map{"code": 400, "message": "无效的 offset 参数"})
+			return
+		}
+	}
+	runs, err := ta.taskService.ListRuns(uint(taskId), limit, offset)
+	if err != nil {
+		slog.Error("获取执行记录失败", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 500, "message": "获取执行记录失败"})
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "获取执行记录成功", "data": runs})
+}
+
+// run 获取单次执行记录
+func (ta *TaskApi) run(w http.ResponseWriter, r *http.Request) {
+	taskId, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		slog.Error("无效的task ID", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "无效的 task ID"})
+		return
+	}
+	number, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil {
+		slog.Error("无效的执行序号", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "无效的执行序号"})
+		return
+	}
+	run, err := ta.taskService.GetRun(uint(taskId), number)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		utils.Failure(w, utils.Map{"code": 404, "message": "执行记录不存在"})
+		return
+	}
+	if err != nil {
+		slog.Error("获取执行记录失败", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 500, "message": "获取执行记录失败"})
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "获取执行记录成功", "data": run})
+}
+
+// runLog 获取执行日志
+// offset/limit 按字节偏移分页, tail 读取最后若干行, raw=1 下载原始日志文件(支持 Range)
+func (ta *TaskApi) runLog(w http.ResponseWriter, r *http.Request) {
+	taskId, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		slog.Error("无效的task ID", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "无效的 task ID"})
+		return
+	}
+	number, err := strconv.Atoi(mux.Vars(r)["n"])
+	if err != nil {
+		slog.Error("无效的执行序号", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "无效的执行序号"})
+		return
+	}
+	query := r.URL.Query()
+	if query.Get("raw") == "1" {
+		f, err := ta.taskService.OpenRunLog(uint(taskId), number)
+		if err != nil {
+			slog.Error("打开执行日志失败", slog.Any("Err", err.Error()))
+			utils.Failure(w, utils.Map{"code": 404, "message": "执行日志不存在"})
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil {
+			utils.Failure(w, utils.Map{"code": 500, "message": "读取执行日志失败"})
+			return
+		}
+		name := fmt.Sprintf("task-%d-run-%d.log", taskId, number)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+		http.ServeContent(w, r, name, info.ModTime(), f)
+		return
+	}
+
+	var offset int64
+	limit, tail := 1000, 0
+	if v := query.Get("offset"); v != "" {
+		if offset, err = strconv.ParseInt(v, 10, 64); err != nil || offset < 0 {
+			utils.Failure(w, utils.Map{"code": 400, "message": "无效的 offset 参数"})
+			return
+		}
+	}
+	if v := query.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			utils.Failure(w, utils.Map{"code": 400, "message": "无效的 limit 参数"})
+			return
+		}
+	}
+	if v := query.Get("tail"); v != "" {
+		if tail, err = strconv.Atoi(v); err != nil || tail <= 0 {
+			utils.Failure(w, utils.Map{"code": 400, "message": "无效的 tail 参数"})
+			return
+		}
+	}
+	// stage/step 参数只返回指定阶段或步骤的输出
+	filter := utils.LogFilter{Stage: query.Get("stage")}
+	if v := query.Get("step"); v != "" {
+		if filter.Step, err = strconv.Atoi(v); err != nil || filter.Step <= 0 {
+			utils.Failure(w, utils.Map{"code": 400, "message": "无效的 step 参数"})
+			return
+		}
+	}
+	page, err := ta.taskService.GetRunLog(uint(taskId), number, offset, limit, tail, filter)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		utils.Failure(w, utils.Map{"code": 404, "message": "执行记录不存在"})
+		return
+	}
+	if err != nil {
+		slog.Error("获取执行日志失败", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 500, "message": "获取执行日志失败"})
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "获取执行日志成功", "data": page})
 }
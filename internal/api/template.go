@@ -0,0 +1,142 @@
+package api
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"pubot/internal/dto"
+	"pubot/internal/service"
+	"pubot/internal/utils"
+
+	"github.com/gorilla/mux"
+)
+
+type TemplateApi struct {
+	templateService *service.TemplateService
+}
+
+func NewTemplateApi(templateService *service.TemplateService) *TemplateApi {
+	return &TemplateApi{templateService: templateService}
+}
+
+func (ta *TemplateApi) Register(router *mux.Router) {
+	router.HandleFunc("/template", ta.create).Methods("POST")
+	router.HandleFunc("/template/validate", ta.validate).Methods("POST")
+	router.HandleFunc("/template/{id:[0-9]+}", ta.delete).Methods("DELETE")
+	router.HandleFunc("/template/{id:[0-9]+}", ta.update).Methods("PUT")
+	router.HandleFunc("/template", ta.list).Methods("GET")
+	router.HandleFunc("/template/{id:[0-9]+}", ta.get).Methods("GET")
+}
+
+// templateFailure 模板校验失败和被引用时返回具体原因
+func templateFailure(w http.ResponseWriter, err error, code int, message string) {
+	var yamlErr *utils.YAMLError
+	switch {
+	case errors.As(err, &yamlErr):
+		utils.Failure(w, utils.Map{"code": 400, "message": yamlErr.Error(), "data": yamlErr.Issues})
+	case errors.Is(err, service.ErrInvalidTemplate):
+		utils.Failure(w, utils.Map{"code": 400, "message": err.Error()})
+	case errors.Is(err, service.ErrTemplateInUse), errors.Is(err, service.ErrTemplateExists):
+		utils.Failure(w, utils.Map{"code": 409, "message": err.Error()})
+	default:
+		utils.Failure(w, utils.Map{"code": code, "message": message})
+	}
+}
+
+// create 创建模板
+func (ta *TemplateApi) create(w http.ResponseWriter, r *http.Request) {
+	var req dto.TemplateRequest
+	if err := utils.Bind(r, &req); err != nil {
+		slog.Error("绑定请求体参数失败", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "绑定请求体参数失败"})
+		return
+	}
+	template, err := ta.templateService.Create(req)
+	if err != nil {
+		slog.Error("添加模板失败", slog.Any("Err", err.Error()))
+		templateFailure(w, err, 503, "添加模板失败")
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "添加模板成功", "data": template,
+		"warnings": ta.templateService.Validate(req.YAML).Warnings})
+}
+
+// validate 校验模板 YAML, 不保存
+func (ta *TemplateApi) validate(w http.ResponseWriter, r *http.Request) {
+	var req dto.TaskValidateRequest
+	if err := utils.Bind(r, &req); err != nil {
+		slog.Error("绑定请求体参数失败", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "绑定请求体参数失败"})
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "校验完成", "data": ta.templateService.Validate(req.YAML)})
+}
+
+// delete 删除模板, 被引用的模板不能删除
+func (ta *TemplateApi) delete(w http.ResponseWriter, r *http.Request) {
+	templateId, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		slog.Error("无效的模板 ID", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "无效的模板 ID"})
+		return
+	}
+	if err := ta.templateService.Delete(uint(templateId)); err != nil {
+		slog.Error("删除模板失败", slog.Any("Err", err.Error()))
+		templateFailure(w, err, 503, "删除模板失败")
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "删除模板成功"})
+}
+
+// update 更新模板, 引用它的任务下一次执行时生效
+func (ta *TemplateApi) update(w http.ResponseWriter, r *http.Request) {
+	templateId, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		slog.Error("无效的模板 ID", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "无效的模板 ID"})
+		return
+	}
+	var req dto.TemplateRequest
+	if err := utils.Bind(r, &req); err != nil {
+		slog.Error("绑定请求体参数失败", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "绑定请求体参数失败"})
+		return
+	}
+	template, err := ta.templateService.Update(uint(templateId), req)
+	if err != nil {
+		slog.Error("更新模板失败", slog.Any("Err", err.Error()))
+		templateFailure(w, err, 500, "更新模板失败")
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "更新模板成功", "data": template})
+}
+
+// list 获取模板列表
+func (ta *TemplateApi) list(w http.ResponseWriter, r *http.Request) {
+	templates, err := ta.templateService.List()
+	if err != nil {
+		slog.Error("获取模板列表失败", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 503, "message": "获取模板列表失败"})
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "获取模板列表成功", "data": templates})
+}
+
+// get 获取单个模板
+func (ta *TemplateApi) get(w http.ResponseWriter, r *http.Request) {
+	templateId, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		slog.Error("无效的模板 ID", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 400, "message": "无效的模板 ID"})
+		return
+	}
+	template, err := ta.templateService.GetById(uint(templateId))
+	if err != nil {
+		slog.Error("获取模板失败", slog.Any("Err", err.Error()))
+		utils.Failure(w, utils.Map{"code": 500, "message": "获取模板失败"})
+		return
+	}
+	utils.Success(w, utils.Map{"code": 200, "message": "获取模板成功", "data": template})
+}
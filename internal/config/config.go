@@ -15,18 +15,24 @@ var (
 )
 
 type Config struct {
-	Listen      string        `yaml:"listen" default:"127.0.0.1:7777"` // 监听地址
-	SecretKey   string        `yaml:"secretKey" default:"1adnfdjkfa"`  // token key
-	ExpiredTime time.Duration `yaml:"expiredTime" default:"12h"`       // token过期时间
-	PgHost      string        `yaml:"pgHost" default:"127.0.0.1"`      // pgdb主机
-	WorkSpace   string        `yaml:"workSpace" default:"."`           // 工作目录
-	PgPort      int           `yaml:"pgPort" default:"5432"`           // pgdb端口
-	PgUser      string        `yaml:"pgUser"`                          // pgdb认证用户
-	PgPass      string        `yaml:"pgPass"`                          // pgdb认证密码
-	PgName      string        `yaml:"pgName"`                          // pgdb数据库名
-	PgPool      int           `yaml:"pgPool" default:"20"`             // pgdb池大小
-	PgMaxIdle   int           `yaml:"pgMaxIdle" default:"50"`          // pgdb idle大小
-	PgLifeTime  time.Duration `yaml:"pgLifeTime" default:"1h30m"`      // pgdb lifetime时间
+	Listen        string        `yaml:"listen" default:"127.0.0.1:7777"` // 监听地址
+	SecretKey     string        `yaml:"secretKey" default:"1adnfdjkfa"`  // token key
+	ExpiredTime   time.Duration `yaml:"expiredTime" default:"12h"`       // token过期时间
+	PgHost        string        `yaml:"pgHost" default:"127.0.0.1"`      // pgdb主机
+	WorkSpace     string        `yaml:"workSpace" default:"."`           // 工作目录
+	PgPort        int           `yaml:"pgPort" default:"5432"`           // pgdb端口
+	PgUser        string        `yaml:"pgUser"`                          // pgdb认证用户
+	PgPass        string        `yaml:"pgPass"`                          // pgdb认证密码
+	PgName        string        `yaml:"pgName"`                          // pgdb数据库名
+	PgPool        int           `yaml:"pgPool" default:"20"`             // pgdb池大小
+	PgMaxIdle     int           `yaml:"pgMaxIdle" default:"50"`          // pgdb idle大小
+	PgLifeTime    time.Duration `yaml:"pgLifeTime" default:"1h30m"`      // pgdb lifetime时间
+	LogDir        string        `yaml:"logDir" default:"logs"`           // 执行日志目录
+	Workers       int           `yaml:"workers" default:"4"`             // 同时执行的任务数
+	ShutdownGrace time.Duration `yaml:"shutdownGrace" default:"30s"`     // 关闭时等待执行结束的时间
+	AgentToken    string        `yaml:"agentToken"`                      // agent 连接服务端的 token, 为空时不接受 agent 连接
+	Labels        []string      `yaml:"labels"`                          // 本机执行器的标签, 另外自动带上操作系统和架构, 用于匹配 runs-on
+	LocalCapacity int           `yaml:"localCapacity"`                   // 本机同时执行的 runs-on 会话数, 默认等于 workers
 }
 
 func initConfig() error {
@@ -39,6 +45,30 @@ func initConfig() error {
 	if err != nil {
 		return err
 	}
+	if config.Workers <= 0 {
+		config.Workers = 4
+	}
+	if config.LocalCapacity <= 0 {
+		config.LocalCapacity = config.Workers
+	}
+	if config.ShutdownGrace <= 0 {
+		config.ShutdownGrace = 30 * time.Second
+	}
+	if config.LogDir == "" {
+		config.LogDir = "logs"
+	}
+	// 相对路径以程序启动目录为准, 避免切换工作目录后失效
+	config.LogDir, err = filepath.Abs(config.LogDir)
+	if err != nil {
+		return err
+	}
+	if config.WorkSpace == "" {
+		config.WorkSpace = "."
+	}
+	config.WorkSpace, err = filepath.Abs(config.WorkSpace)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -0,0 +1,61 @@
+package dao
+
+import (
+	"time"
+
+	"pubot/internal/model"
+
+	"gorm.io/gorm"
+)
+
+type AgentDao struct {
+	db *gorm.DB
+}
+
+func NewAgentDao(db *gorm.DB) *AgentDao {
+	return &AgentDao{db: db}
+}
+
+func (ad *AgentDao) Create(agent *model.PbAgent) error {
+	return ad.db.Create(agent).Error
+}
+
+func (ad *AgentDao) Delete(id uint) error {
+	return ad.db.Where("id = ?", id).Delete(&model.PbAgent{}).Error
+}
+
+func (ad *AgentDao) GetByID(id uint) (*model.PbAgent, error) {
+	var agent model.PbAgent
+	err := ad.db.First(&agent, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &agent, nil
+}
+
+func (ad *AgentDao) GetByName(name string) (*model.PbAgent, error) {
+	var agent model.PbAgent
+	err := ad.db.Where("name = ?", name).First(&agent).Error
+	if err != nil {
+		return nil, err
+	}
+	return &agent, nil
+}
+
+func (ad *AgentDao) Update(agent *model.PbAgent) error {
+	return ad.db.Save(agent).Error
+}
+
+// Touch 更新最近一次收到消息的时间
+func (ad *AgentDao) Touch(id uint, at time.Time) error {
+	return ad.db.Model(&model.PbAgent{}).Where("id = ?", id).Update("last_seen", at).Error
+}
+
+func (ad *AgentDao) GetAll() ([]model.PbAgent, error) {
+	var agents []model.PbAgent
+	err := ad.db.Order("name").Find(&agents).Error
+	if err != nil {
+		return nil, err
+	}
+	return agents, nil
+}
@@ -30,6 +30,7 @@ func initPg() error {
 		NowFunc: func() time.Time {
 			return time.Now().Local() // 使用本地时间
 		},
+		TranslateError: true, // 唯一索引冲突返回 gorm.ErrDuplicatedKey
 	})
 	if err != nil {
 		slog.Error("打开数据库失败", slog.String("Err", err.Error()))
@@ -48,7 +49,7 @@ func initPg() error {
 		return err
 	}
 	// 表迁移
-	if err := pgDb.AutoMigrate(&model.PbUser{}, &model.PbTask{}); err != nil {
+	if err := pgDb.AutoMigrate(&model.PbUser{}, &model.PbTask{}, &model.PbTaskRun{}, &model.PbTemplate{}, &model.PbAgent{}); err != nil {
 		slog.Error("数据库表迁移失败", slog.String("Err", err.Error()))
 		return err
 	}
@@ -0,0 +1,68 @@
+package dao
+
+import (
+	"pubot/internal/model"
+
+	"gorm.io/gorm"
+)
+
+type TaskRunDao struct {
+	db *gorm.DB
+}
+
+func NewTaskRunDao(db *gorm.DB) *TaskRunDao {
+	return &TaskRunDao{db: db}
+}
+
+// Create 创建执行记录, 在事务中分配任务内递增的执行序号
+func (rd *TaskRunDao) Create(run *model.PbTaskRun) error {
+	return rd.db.Transaction(func(tx *gorm.DB) error {
+		var last int
+		err := tx.Model(&model.PbTaskRun{}).
+			Where("task_id = ?", run.TaskID).
+			Select("COALESCE(MAX(number), 0)").
+			Scan(&last).Error
+		if err != nil {
+			return err
+		}
+		run.Number = last + 1
+		return tx.Create(run).Error
+	})
+}
+
+func (rd *TaskRunDao) Save(run *model.PbTaskRun) error {
+	return rd.db.Save(run).Error
+}
+
+func (rd *TaskRunDao) GetByNumber(taskID uint, number int) (*model.PbTaskRun, error) {
+	var run model.PbTaskRun
+	err := rd.db.Where("task_id = ? AND number = ?", taskID, number).First(&run).Error
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+// ListByTask 按执行序号倒序分页获取任务的执行记录
+func (rd *TaskRunDao) ListByTask(taskID uint, limit, offset int) ([]model.PbTaskRun, error) {
+	var runs []model.PbTaskRun
+	err := rd.db.Where("task_id = ?", taskID).
+		Order("number DESC").
+		Limit(limit).
+		Offset(offset).
+		Find(&runs).Error
+	if err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
+
+// ListByStatus 按ID顺序获取处于指定状态的执行记录
+func (rd *TaskRunDao) ListByStatus(statuses ...string) ([]model.PbTaskRun, error) {
+	var runs []model.PbTaskRun
+	err := rd.db.Where("status IN ?", statuses).Order("id").Find(&runs).Error
+	if err != nil {
+		return nil, err
+	}
+	return runs, nil
+}
@@ -53,3 +53,12 @@ func (td *TaskDao) GetAllTask() ([]model.PbTask, error) {
 func (td *TaskDao) Save(task *model.PbTask) error {
 	return td.db.Save(&task).Error
 }
+
+func (td *TaskDao) GetByStatus(statuses ...string) ([]model.PbTask, error) {
+	var modelTasks []model.PbTask
+	err := td.db.Where("status IN ?", statuses).Find(&modelTasks).Error
+	if err != nil {
+		return nil, err
+	}
+	return modelTasks, nil
+}
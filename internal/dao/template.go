@@ -0,0 +1,55 @@
+package dao
+
+import (
+	"pubot/internal/model"
+
+	"gorm.io/gorm"
+)
+
+type TemplateDao struct {
+	db *gorm.DB
+}
+
+func NewTemplateDao(db *gorm.DB) *TemplateDao {
+	return &TemplateDao{db: db}
+}
+
+// Create 创建模板, 名称已被使用时返回 gorm.ErrDuplicatedKey
+func (td *TemplateDao) Create(template *model.PbTemplate) error {
+	return td.db.Create(template).Error
+}
+
+func (td *TemplateDao) Delete(id uint) error {
+	return td.db.Where("id = ?", id).Delete(&model.PbTemplate{}).Error
+}
+
+func (td *TemplateDao) GetByID(id uint) (*model.PbTemplate, error) {
+	var template model.PbTemplate
+	err := td.db.First(&template, id).Error
+	if err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+func (td *TemplateDao) GetByName(name string) (*model.PbTemplate, error) {
+	var template model.PbTemplate
+	err := td.db.Where("name = ?", name).First(&template).Error
+	if err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+func (td *TemplateDao) Update(template *model.PbTemplate) error {
+	return td.db.Save(template).Error
+}
+
+func (td *TemplateDao) GetAll() ([]model.PbTemplate, error) {
+	var templates []model.PbTemplate
+	err := td.db.Order("name").Find(&templates).Error
+	if err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
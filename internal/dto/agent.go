@@ -0,0 +1,19 @@
+package dto
+
+import "time"
+
+// AgentInfo agent 列表中的一项
+type AgentInfo struct {
+	ID        uint       `json:"id"`
+	Name      string     `json:"name"`
+	Labels    []string   `json:"labels"`
+	Capacity  int        `json:"capacity"`
+	OS        string     `json:"os"`
+	Arch      string     `json:"arch"`
+	Approved  bool       `json:"approved"`
+	Online    bool       `json:"online"`
+	Running   int        `json:"running"` // 正在使用的会话数
+	Address   string     `json:"address,omitempty"`
+	LastSeen  *time.Time `json:"lastSeen,omitempty"`
+	CreatedAt time.Time  `json:"createdAt"`
+}
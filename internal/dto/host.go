@@ -0,0 +1,103 @@
+package dto
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Hosts 阶段的目标主机, 可以写主机列表, 也可以写 host_groups 中的主机组名称
+// 校验通过后主机组展开到 List 中
+type Hosts struct {
+	Group string `json:"group,omitempty"`
+	List  []Host `json:"list"`
+}
+
+func (h *Hosts) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		h.Group = node.Value
+		return nil
+	}
+	return node.Decode(&h.List)
+}
+
+func (h Hosts) MarshalYAML() (any, error) {
+	if len(h.List) == 0 {
+		return h.Group, nil
+	}
+	return h.List, nil
+}
+
+// Host 目标主机, 可以直接写成 "user@address:port", 没有设置的用户、端口和凭据使用阶段 ssh 中的设置
+type Host struct {
+	Name     string `yaml:"name,omitempty" json:"name,omitempty"` // 日志和执行结果中的名称, 默认为 address:port
+	Address  string `yaml:"address" json:"address"`
+	Port     int    `yaml:"port,omitempty" json:"port,omitempty"`
+	User     string `yaml:"user,omitempty" json:"user,omitempty"`
+	Password string `yaml:"password,omitempty" json:"-"` // 只能写成 $变量名, 从 pubot 进程的环境变量读取
+	Key      string `yaml:"key,omitempty" json:"-"`      // 私钥文件路径, 可以写成 $变量名
+}
+
+func (h *Host) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		host, err := ParseHost(node.Value)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", node.Line, err)
+		}
+		*h = host
+		return nil
+	}
+	type plain Host
+	return node.Decode((*plain)(h))
+}
+
+// ParseHost 解析 "user@address:port" 形式的主机, 用户和端口可以省略, IPv6 地址写成 [::1]:22
+func ParseHost(s string) (Host, error) {
+	var h Host
+	if user, rest, ok := strings.Cut(s, "@"); ok {
+		h.User, s = user, rest
+	}
+	h.Address = s
+	if strings.HasPrefix(s, "[") || strings.Count(s, ":") == 1 {
+		addr, port, err := net.SplitHostPort(s)
+		if err != nil {
+			return Host{}, fmt.Errorf("无效的主机 %q: %w", s, err)
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return Host{}, fmt.Errorf("无效的主机端口 %q", port)
+		}
+		h.Address, h.Port = addr, p
+	}
+	return h, nil
+}
+
+// Label 主机在日志和执行结果中的名称
+func (h Host) Label() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	if h.Port != 0 {
+		return net.JoinHostPort(h.Address, strconv.Itoa(h.Port))
+	}
+	return h.Address
+}
+
+// SSHConfig 阶段通过 SSH 连接目标主机的设置, 主机上设置的用户、端口和凭据优先
+// 没有设置 password 和 key 时依次尝试 ssh-agent 和 ~/.ssh 下的默认私钥
+type SSHConfig struct {
+	User       string `yaml:"user,omitempty" json:"user,omitempty"`              // 默认为 pubot 进程的用户
+	Port       int    `yaml:"port,omitempty" json:"port,omitempty"`              // 默认 22
+	Password   string `yaml:"password,omitempty" json:"-"`                       // 只能写成 $变量名, 从 pubot 进程的环境变量读取
+	Key        string `yaml:"key,omitempty" json:"-"`                            // 私钥文件路径, 可以写成 $变量名
+	Passphrase string `yaml:"passphrase,omitempty" json:"-"`                     // 私钥的密码, 只能写成 $变量名
+	KnownHosts string `yaml:"known_hosts,omitempty" json:"knownHosts,omitempty"` // 校验主机密钥的文件, 默认 ~/.ssh/known_hosts
+	// 不校验主机密钥, 只应在测试环境中使用
+	InsecureSkipHostKey bool          `yaml:"insecure_skip_host_key,omitempty" json:"insecureSkipHostKey,omitempty"`
+	Dir                 string        `yaml:"dir,omitempty" json:"dir,omitempty"`         // 远程主机上的工作目录, 不存在时创建, 默认为用户主目录
+	Timeout             time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"` // 连接超时, 默认 10s
+}
@@ -0,0 +1,33 @@
+package dto
+
+import "time"
+
+// StepResult 步骤执行结果
+type StepResult struct {
+	Index     int        `json:"index"` // 从1开始
+	Run       string     `json:"run"`
+	Status    string     `json:"status"`
+	ExitCode  int        `json:"exitCode"`
+	Attempts  int        `json:"attempts,omitempty"` // 执行次数, 重试过时大于 1
+	Finally   bool       `json:"finally,omitempty"`  // 阶段的 finally 步骤
+	StartedAt *time.Time `json:"startedAt,omitempty"`
+	Duration  int64      `json:"duration"` // 毫秒
+}
+
+// StageResult 阶段执行结果
+type StageResult struct {
+	Name      string       `json:"name"`
+	Status    string       `json:"status"`
+	StartedAt *time.Time   `json:"startedAt,omitempty"`
+	Duration  int64        `json:"duration"`           // 毫秒
+	Attempts  int          `json:"attempts,omitempty"` // 执行次数, 重试过时大于 1
+	Steps     []StepResult `json:"steps"`
+	// 矩阵组合的变量值, 只在 Cells 中的结果上设置
+	Matrix map[string]string `json:"matrix,omitempty"`
+	// 矩阵阶段中每个组合的执行结果, 组合的 Name 为 "阶段名 (变量值, ...)"
+	Cells []StageResult `json:"cells,omitempty"`
+	// 目标主机的名称, 只在 Hosts 中的结果上设置
+	Host string `json:"host,omitempty"`
+	// 设置了 hosts 的阶段在每台主机上的执行结果, 主机的 Name 为 "阶段名@主机名"
+	Hosts []StageResult `json:"hosts,omitempty"`
+}
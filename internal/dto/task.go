@@ -1,14 +1,236 @@
 package dto
 
-type Deploy struct {
-	Platform string   `yaml:"platform" json:"platform"`
-	Run      []string `yaml:"run" json:"run"`
+import (
+	"math"
+	"slices"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Retry 失败后的重试策略
+type Retry struct {
+	Attempts    int           `yaml:"attempts" json:"attempts"`                             // 最多执行的次数(包括第一次)
+	Delay       time.Duration `yaml:"delay,omitempty" json:"delay,omitempty"`               // 第一次重试前的等待时间
+	Backoff     float64       `yaml:"backoff,omitempty" json:"backoff,omitempty"`           // 每次重试等待时间的倍数, 默认 1
+	OnExitCodes []int         `yaml:"on_exit_codes,omitempty" json:"onExitCodes,omitempty"` // 只在这些退出码时重试, 默认任何失败都重试
+}
+
+// MaxAttempts 最多执行的次数, 没有设置重试时为 1
+func (r *Retry) MaxAttempts() int {
+	if r == nil || r.Attempts < 1 {
+		return 1
+	}
+	return r.Attempts
+}
+
+// DelayBefore 第 attempt 次执行(从2开始)前的等待时间
+func (r *Retry) DelayBefore(attempt int) time.Duration {
+	if r == nil || r.Delay <= 0 || attempt < 2 {
+		return 0
+	}
+	backoff := r.Backoff
+	if backoff < 1 {
+		backoff = 1
+	}
+	return time.Duration(float64(r.Delay) * math.Pow(backoff, float64(attempt-2)))
+}
+
+// RetriesOn 退出码为 code 的失败是否需要重试, 超时等没有退出码的失败为 -1
+func (r *Retry) RetriesOn(code int) bool {
+	if r == nil {
+		return false
+	}
+	return len(r.OnExitCodes) == 0 || slices.Contains(r.OnExitCodes, code)
+}
+
+// Step 单个步骤, 可以直接写命令字符串, 也可以写成 {run, if, timeout, env, retry, continue_on_error}
+// 写成 upload 或 download 时为上传或下载文件的步骤, 不能同时设置 run
+type Step struct {
+	Run      string            `yaml:"run,omitempty" json:"run"`
+	Upload   *Transfer         `yaml:"upload,omitempty" json:"upload,omitempty"`     // 上传文件到目标主机
+	Download *Transfer         `yaml:"download,omitempty" json:"download,omitempty"` // 从目标主机下载文件
+	If       string            `yaml:"if,omitempty" json:"if,omitempty"`             // 执行条件, 默认之前的步骤都成功才执行
+	Timeout  time.Duration     `yaml:"timeout,omitempty" json:"timeout,omitempty"`   // 步骤超时
+	Env      map[string]string `yaml:"env,omitempty" json:"env,omitempty"`           // 只对本步骤有效的环境变量
+	Retry    *Retry            `yaml:"retry,omitempty" json:"retry,omitempty"`       // 失败重试
+	// 失败时记为警告, 不影响后续步骤和执行结果
+	ContinueOnError bool `yaml:"continue_on_error,omitempty" json:"continueOnError,omitempty"`
+}
+
+func (s *Step) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		s.Run = node.Value
+		return nil
+	}
+	type plain Step
+	return node.Decode((*plain)(s))
+}
+
+// Command 步骤在日志和执行结果中显示的命令, 上传和下载步骤为 "upload 源路径 -> 目标路径"
+func (s Step) Command() string {
+	switch {
+	case s.Upload != nil:
+		return "upload " + s.Upload.Src + " -> " + s.Upload.Dest
+	case s.Download != nil:
+		return "download " + s.Download.Src + " -> " + s.Download.Dest
+	}
+	return s.Run
+}
+
+// Stage 阶段, 可以直接写步骤列表, 也可以写成 {name, needs, timeout, steps}
+// needs 中的阶段都成功后才会执行, 互不依赖的阶段并发执行
+// parallel 为 true 时各步骤在独立的 bash 会话中并行执行, 步骤之间不共享工作目录和环境变量
+type Stage struct {
+	Name        string            `yaml:"name,omitempty" json:"name"`
+	Needs       []string          `yaml:"needs,omitempty" json:"needs,omitempty"`                        // 依赖的阶段
+	If          string            `yaml:"if,omitempty" json:"if,omitempty"`                              // 执行条件, 默认依赖的阶段都成功才执行
+	Platform    string            `yaml:"platform,omitempty" json:"platform,omitempty"`                  // 没有设置 executor 时按平台选择执行器
+	Executor    string            `yaml:"executor,omitempty" json:"executor,omitempty"`                  // 执行步骤的执行器, 默认 local, 设置了 hosts 时默认 ssh
+	RunsOn      []string          `yaml:"runs-on,omitempty" json:"runsOn,omitempty"`                     // 执行机器需要有的标签, 没有设置时使用任务的 runs-on
+	WorkingDir  string            `yaml:"working_directory,omitempty" json:"workingDirectory,omitempty"` // 步骤开始执行的目录和 git 信息所在的目录, 相对任务工作目录
+	Hosts       *Hosts            `yaml:"hosts,omitempty" json:"hosts,omitempty"`                        // 目标主机, 在每台主机上各执行一次阶段的步骤
+	SSH         *SSHConfig        `yaml:"ssh,omitempty" json:"ssh,omitempty"`                            // 连接目标主机的设置
+	Strategy    string            `yaml:"strategy,omitempty" json:"strategy,omitempty"`                  // 目标主机的执行策略: parallel(默认) 或 rolling
+	BatchSize   string            `yaml:"batch_size,omitempty" json:"batchSize,omitempty"`               // 滚动部署每批的主机数, 可以写数量或百分比, 默认 1
+	Pause       time.Duration     `yaml:"pause,omitempty" json:"pause,omitempty"`                        // 滚动部署批次之间的等待时间
+	MaxFailures int               `yaml:"max_failures,omitempty" json:"maxFailures,omitempty"`           // 允许失败的主机数, 超过时停止执行, 剩余的主机不再执行
+	Timeout     time.Duration     `yaml:"timeout,omitempty" json:"timeout,omitempty"`                    // 阶段超时
+	Env         map[string]string `yaml:"env,omitempty" json:"env,omitempty"`                            // 阶段环境变量
+	Retry       *Retry            `yaml:"retry,omitempty" json:"retry,omitempty"`                        // 阶段失败后重新执行整个阶段
+	Parallel    bool              `yaml:"parallel,omitempty" json:"parallel,omitempty"`
+	MaxParallel int               `yaml:"max_parallel,omitempty" json:"maxParallel,omitempty"` // 最大并行数, 0 表示不限制
+	FailFast    bool              `yaml:"fail_fast,omitempty" json:"failFast,omitempty"`       // 一个步骤失败立即取消其余步骤, 默认等待全部结束
+	Matrix      *Matrix           `yaml:"matrix,omitempty" json:"matrix,omitempty"`            // 按矩阵变量的每种组合各执行一次阶段
+	Steps       []Step            `yaml:"steps,omitempty" json:"steps"`
+	Finally     []Step            `yaml:"finally,omitempty" json:"finally,omitempty"`                // 阶段开始后无论结果如何都会执行的步骤
+	Post        []Step            `yaml:"post,omitempty" json:"post,omitempty"`                      // finally 的别名
+	Run         []Step            `yaml:"run,omitempty" json:"run,omitempty" deprecated:"请使用 steps"` // deploy 阶段的旧写法, 等同于 steps
+}
+
+func (s *Stage) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		return node.Decode(&s.Steps)
+	}
+	type plain Stage
+	return node.Decode((*plain)(s))
+}
+
+// Matrix 阶段的矩阵, 变量取值的每种组合各执行一次阶段的步骤
+// 除 include、exclude、max_parallel、fail_fast 以外的键都是矩阵变量, 按书写顺序组合
+type Matrix struct {
+	Vars        []MatrixVar         `yaml:"-" json:"vars"`
+	Include     []map[string]string `yaml:"include,omitempty" json:"include,omitempty"`          // 额外添加的组合
+	Exclude     []map[string]string `yaml:"exclude,omitempty" json:"exclude,omitempty"`          // 去掉和其中任意一项匹配的组合
+	MaxParallel int                 `yaml:"max_parallel,omitempty" json:"maxParallel,omitempty"` // 同时执行的组合数, 0 表示不限制
+	FailFast    bool                `yaml:"fail_fast,omitempty" json:"failFast,omitempty"`       // 一个组合失败立即取消其余组合, 默认等待全部结束
+}
+
+// MatrixVar 矩阵变量及其取值
+type MatrixVar struct {
+	Name   string   `json:"name"`
+	Values []string `json:"values"`
+}
+
+// matrixKeys 矩阵中不是变量的键
+var matrixKeys = map[string]bool{"include": true, "exclude": true, "max_parallel": true, "fail_fast": true}
+
+func (m *Matrix) UnmarshalYAML(node *yaml.Node) error {
+	type plain Matrix
+	if err := node.Decode((*plain)(m)); err != nil {
+		return err
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		if matrixKeys[key] {
+			continue
+		}
+		v := MatrixVar{Name: key}
+		if err := node.Content[i+1].Decode(&v.Values); err != nil {
+			return err
+		}
+		m.Vars = append(m.Vars, v)
+	}
+	return nil
+}
+
+// MarshalYAML 矩阵变量写回为普通的键, 展开模板后的 YAML 中保持原来的写法
+func (m Matrix) MarshalYAML() (any, error) {
+	type plain Matrix
+	var rest yaml.Node
+	if err := rest.Encode(plain(m)); err != nil {
+		return nil, err
+	}
+	node := &yaml.Node{Kind: yaml.MappingNode}
+	for _, v := range m.Vars {
+		var values yaml.Node
+		if err := values.Encode(v.Values); err != nil {
+			return nil, err
+		}
+		values.Style = yaml.FlowStyle
+		node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: v.Name}, &values)
+	}
+	node.Content = append(node.Content, rest.Content...)
+	return node, nil
+}
+
+// FinallyStage 任务级 finally 步骤在日志和执行结果中使用的阶段名称, 不能用作阶段名称
+const FinallyStage = "finally"
+
+// 任务已有执行时再次触发的并发策略
+const (
+	ConcurrencyQueue  = "queue"              // 排队, 等上一次执行结束(默认)
+	ConcurrencyReject = "reject"             // 拒绝本次触发
+	ConcurrencyCancel = "cancel-in-progress" // 取消正在进行和排队的执行
+)
+
+// 任务工作目录策略, 工作目录位于 workSpace/tasks/<任务ID> 下
+const (
+	WorkspaceReuse = "reuse"            // 每次执行复用同一个目录(默认)
+	WorkspaceClean = "clean-before-run" // 复用同一个目录, 执行前清空
+	WorkspaceFresh = "fresh-per-run"    // 每次执行使用新的目录, 执行结束后删除
+)
+
+// 目标主机的执行策略: parallel(默认) 或 rolling
+const (
+	StrategyParallel = "parallel" // 所有主机同时执行(默认)
+	StrategyRolling  = "rolling"  // 按 batch_size 分批执行, 一批结束后再开始下一批
+)
+
+// 参数类型
+const (
+	ParamString = "string"
+	ParamBool   = "bool"
+	ParamChoice = "choice" // 从 options 中选择一个
+	ParamNumber = "number"
+)
+
+// Param 触发执行时可以传入的参数, 在命令和环境变量中用 ${{ params.名称 }} 引用
+type Param struct {
+	Name        string   `yaml:"name" json:"name"`
+	Type        string   `yaml:"type,omitempty" json:"type"` // 默认 string
+	Default     any      `yaml:"default,omitempty" json:"default,omitempty"`
+	Description string   `yaml:"description,omitempty" json:"description,omitempty"`
+	Options     []string `yaml:"options,omitempty" json:"options,omitempty"`   // choice 的可选值
+	Required    bool     `yaml:"required,omitempty" json:"required,omitempty"` // 没有默认值时必须传入
 }
 
 type TaskYAML struct {
-	Name   string   `yaml:"name" json:"name"`
-	Build  []string `yaml:"build" json:"build"`
-	Deploy Deploy   `yaml:"deploy" json:"deploy"`
+	Name        string            `yaml:"name" json:"name"`
+	Timeout     time.Duration     `yaml:"timeout,omitempty" json:"timeout,omitempty"`         // 整个任务超时
+	Concurrency string            `yaml:"concurrency,omitempty" json:"concurrency,omitempty"` // 并发策略
+	Workspace   string            `yaml:"workspace,omitempty" json:"workspace,omitempty"`     // 工作目录策略
+	RunsOn      []string          `yaml:"runs-on,omitempty" json:"runsOn,omitempty"`          // 没有设置 hosts、platform 和 runs-on 的阶段的 runs-on
+	Env         map[string]string `yaml:"env,omitempty" json:"env,omitempty"`                 // 任务环境变量
+	Params      []Param           `yaml:"params,omitempty" json:"params,omitempty"`           // 触发参数
+	HostGroups  map[string][]Host `yaml:"host_groups,omitempty" json:"hostGroups,omitempty"`  // 主机组, 阶段的 hosts 可以写主机组名称
+	Extends     *TemplateRef      `yaml:"extends,omitempty" json:"extends,omitempty"`         // 继承的模板, 任务中的设置覆盖模板
+	Include     []TemplateRef     `yaml:"include,omitempty" json:"include,omitempty"`         // 引入其中阶段和环境变量的模板
+	Stages      []Stage           `yaml:"stages,omitempty" json:"stages"`
+	Finally     []Step            `yaml:"finally,omitempty" json:"finally,omitempty"`                       // 所有阶段结束后无论结果如何都会执行的步骤
+	Post        []Step            `yaml:"post,omitempty" json:"post,omitempty"`                             // finally 的别名
+	Build       *Stage            `yaml:"build,omitempty" json:"build,omitempty" deprecated:"请使用 stages"`   // 旧写法, 解析后转换为 stages
+	Deploy      *Stage            `yaml:"deploy,omitempty" json:"deploy,omitempty" deprecated:"请使用 stages"` // 旧写法, 解析后转换为 stages
 }
 
 // TaskCreateRequest 创建任务DTO
@@ -24,3 +246,13 @@ type TaskUpdateRequest struct {
 	Status string    `json:"status,omitempty"`
 	Parsed *TaskYAML `json:"parsed,omitempty"`
 }
+
+// TaskValidateRequest 校验任务 YAML 的请求体
+type TaskValidateRequest struct {
+	YAML string `json:"yaml"`
+}
+
+// TaskExecuteRequest 触发执行的请求体, 可以为空
+type TaskExecuteRequest struct {
+	Params map[string]any `json:"params,omitempty"`
+}
@@ -0,0 +1,26 @@
+package dto
+
+import "gopkg.in/yaml.v3"
+
+// TemplateRef 对模板的引用, 可以直接写模板名称, 也可以写成 {template, with}
+// with 为模板参数的值, 可以写成 ${{ params.名称 }} 把任务的参数传给模板
+type TemplateRef struct {
+	Template string         `yaml:"template" json:"template"`
+	With     map[string]any `yaml:"with,omitempty" json:"with,omitempty"`
+}
+
+func (r *TemplateRef) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		r.Template = node.Value
+		return nil
+	}
+	type plain TemplateRef
+	return node.Decode((*plain)(r))
+}
+
+// TemplateRequest 创建和更新模板的请求体
+type TemplateRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	YAML        string `json:"yaml"` // 模板 YAML, 格式和任务 YAML 相同
+}
@@ -0,0 +1,30 @@
+package dto
+
+import (
+	"fmt"
+	"io/fs"
+	"strconv"
+)
+
+// Transfer 上传或下载文件的步骤, 通过目标主机的 SSH 连接使用 SFTP 传输, 每个文件传输后校验 sha256
+// upload 的 src 为本地路径(相对任务工作目录), dest 为远程路径(相对远程工作目录), download 相反
+// src 为目录时传输目录下的所有文件到 dest 目录中, src 为文件且 dest 为已存在的目录或以 / 结尾时放到 dest 目录中
+type Transfer struct {
+	Src     string   `yaml:"src" json:"src"`
+	Dest    string   `yaml:"dest" json:"dest"`
+	Mode    string   `yaml:"mode,omitempty" json:"mode,omitempty"`       // 文件的权限, 八进制, 例如 "0644", 默认与源文件相同
+	Owner   string   `yaml:"owner,omitempty" json:"owner,omitempty"`     // 文件的所有者, user 或 user:group, 需要有修改所有者的权限
+	Exclude []string `yaml:"exclude,omitempty" json:"exclude,omitempty"` // 不传输的文件, glob 模式, 匹配相对 src 的路径或文件名, 匹配目录时跳过整个目录
+}
+
+// Perm 解析 mode, 没有设置时返回 0
+func (t Transfer) Perm() (fs.FileMode, error) {
+	if t.Mode == "" {
+		return 0, nil
+	}
+	mode, err := strconv.ParseUint(t.Mode, 8, 32)
+	if err != nil || mode == 0 || mode > 0o777 {
+		return 0, fmt.Errorf("无效的 mode %q, 应为 0644 这样的八进制权限", t.Mode)
+	}
+	return fs.FileMode(mode), nil
+}
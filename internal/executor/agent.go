@@ -0,0 +1,68 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"pubot/internal/config"
+	"pubot/internal/dto"
+	"pubot/internal/utils"
+)
+
+// Agent 把步骤交给通过 pubot agent 连接到服务端的机器执行, 适合 NAT 后面或其他网络中不能通过 SSH 访问的机器
+// 会话在空闲的 agent 上打开, 没有空闲的 agent 时等待; agent 断开连接时正在执行的步骤在其他 agent 上重新执行
+// 设置了 runs-on 时只使用标签满足的 agent, 没有已批准的 agent 满足时立即失败
+// 没有设置 executor 而按 runs-on 选择到时, 本机也作为执行机器参与分配, 同时执行的会话数受 localCapacity 限制
+// 会话继承 agent 进程的环境变量, $PUBOT_WORKSPACE 为 agent 上的工作目录
+// 注册的 Agent 没有 Pool, 只用于校验, 执行时由任务服务换成带有 Pool 的 Agent
+type Agent struct {
+	// Pool 为空时不能使用 agent 执行器, 按 runs-on 选择到的阶段在标签满足时直接在本机执行
+	Pool AgentPool
+}
+
+// AgentPool 在空闲的 agent 或本机上打开会话, 由管理 agent 连接的服务实现
+type AgentPool interface {
+	Open(ctx context.Context, spec Spec) (utils.Session, error)
+}
+
+func init() {
+	Register(Agent{})
+}
+
+func (Agent) Name() string {
+	return "agent"
+}
+
+func (Agent) Check(s dto.Stage) error {
+	if s.Hosts != nil {
+		return errors.New("agent 执行器不能设置 hosts, 在目标主机上执行请使用 ssh 执行器")
+	}
+	if s.Executor == "" {
+		// 按 runs-on 选择到, 本机的标签满足时可以在本机执行
+		labels, err := LocalLabels()
+		if err != nil {
+			return err
+		}
+		if !utils.MatchLabels(labels, s.RunsOn) && config.Get().AgentToken == "" {
+			return fmt.Errorf("本机的标签 %v 不满足 runs-on %v, 服务端也没有启用 agent", labels, s.RunsOn)
+		}
+		return nil
+	}
+	if config.Get().AgentToken == "" {
+		return errors.New("服务端没有启用 agent")
+	}
+	return nil
+}
+
+func (a Agent) Open(ctx context.Context, spec Spec) (utils.Session, error) {
+	if a.Pool != nil {
+		return a.Pool.Open(ctx, spec)
+	}
+	if spec.Stage.Executor == "" {
+		if labels, err := LocalLabels(); err == nil && utils.MatchLabels(labels, spec.Stage.RunsOn) {
+			return Local{}.Open(ctx, spec)
+		}
+	}
+	return nil, errors.New("服务端没有启用 agent")
+}
@@ -0,0 +1,129 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+
+	"pubot/internal/dto"
+	"pubot/internal/utils"
+)
+
+// Executor 执行步骤的后端, 负责进程的生命周期、环境变量、工作目录、输出和取消
+// 阶段通过 executor 指定执行器, 或者通过 platform 选择支持该平台的执行器
+type Executor interface {
+	// Name 执行器名称, 即阶段中 executor 的值
+	Name() string
+	// Check 检查阶段的设置是否可以由该执行器执行, 在校验任务 YAML 时调用
+	Check(s dto.Stage) error
+	// Open 打开一个会话, 同一个会话中的步骤依次执行, 共享工作目录和环境变量
+	// 需要等待执行资源时 ctx 结束后返回 ctx 结束的原因
+	Open(ctx context.Context, spec Spec) (utils.Session, error)
+}
+
+// Spec 打开会话的参数
+type Spec struct {
+	Stage   dto.Stage // 会话所属的阶段, 执行器可以从中读取自己的配置
+	Host    *dto.Host // 阶段设置了 hosts 时为本次执行的目标主机
+	WorkDir string    // 工作目录
+	Env     []string  // KEY=VALUE 形式的由 pubot 设置的环境变量, 不包括 pubot 进程的环境变量
+	// Out 输出执行器的提示信息, 例如等待空闲的执行机器
+	Out utils.OutputFunc
+	// Queued 开始和结束等待空闲的执行机器时调用
+	Queued func(queued bool)
+}
+
+// 没有设置 executor 时使用的执行器, 设置了 hosts 时为 DefaultRemote
+// 设置了 runs-on 时为 DefaultRunner, 由执行机器池在本机和 agent 中选择, 否则为 Default
+const (
+	Default       = "local"
+	DefaultRemote = "ssh"
+	DefaultRunner = "agent"
+)
+
+var (
+	mu        sync.RWMutex
+	executors = map[string]Executor{}
+	platforms = map[string]string{} // 平台 -> 执行器名称
+)
+
+// Register 注册执行器, supports 为没有指定 executor 时按 platform 选择该执行器的平台
+// 名称或平台重复时 panic, 只应在 init 中调用
+func Register(e Executor, supports ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := executors[e.Name()]; ok {
+		panic("执行器重复注册: " + e.Name())
+	}
+	executors[e.Name()] = e
+	for _, p := range supports {
+		if _, ok := platforms[p]; ok {
+			panic("平台重复注册: " + p)
+		}
+		platforms[p] = e.Name()
+	}
+}
+
+// Get 按名称获取执行器
+func Get(name string) (Executor, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	e, ok := executors[name]
+	if !ok {
+		return nil, fmt.Errorf("未知的执行器: %s, 可用的执行器: %v", name, names())
+	}
+	return e, nil
+}
+
+// Names 已注册的执行器名称
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return names()
+}
+
+func names() []string {
+	return slices.Sorted(maps.Keys(executors))
+}
+
+// SupportsPlatform 是否有执行器支持平台 p
+func SupportsPlatform(p string) bool {
+	mu.RLock()
+	defer mu.RUnlock()
+	_, ok := platforms[p]
+	return ok
+}
+
+// Check 检查阶段的 executor、platform 和 runs-on 能否选到执行器, 以及选到的执行器能否执行该阶段
+func Check(s dto.Stage) error {
+	e, err := ForStage(s)
+	if err != nil {
+		return err
+	}
+	return e.Check(s)
+}
+
+// ForStage 选择执行阶段的执行器: 优先使用 executor, 设置了 hosts 时使用 DefaultRemote
+// 设置了 runs-on 时使用 DefaultRunner, 标签满足的本机和 agent 按负载分配
+// 其次按 platform 选择, 都没有设置或没有执行器支持该平台时使用 Default
+func ForStage(s dto.Stage) (Executor, error) {
+	if s.Executor != "" {
+		return Get(s.Executor)
+	}
+	if s.Hosts != nil {
+		return Get(DefaultRemote)
+	}
+	if len(s.RunsOn) > 0 {
+		return Get(DefaultRunner)
+	}
+	mu.RLock()
+	name, ok := platforms[s.Platform]
+	mu.RUnlock()
+	if !ok {
+		// 和引入执行器之前一样在本机执行, 校验任务时给出警告
+		return Get(Default)
+	}
+	return Get(name)
+}
@@ -0,0 +1,49 @@
+package executor
+
+import (
+	"runtime"
+	"testing"
+
+	"pubot/internal/dto"
+)
+
+func TestForStage(t *testing.T) {
+	tests := []struct {
+		name  string
+		stage dto.Stage
+		want  string
+	}{
+		{"default", dto.Stage{}, Default},
+		{"executor", dto.Stage{Executor: "ssh"}, "ssh"},
+		{"hosts", dto.Stage{Hosts: &dto.Hosts{Group: "web"}}, DefaultRemote},
+		{"platform", dto.Stage{Platform: runtime.GOOS}, Default},
+		// 没有执行器支持的平台在本机执行
+		{"unknown platform", dto.Stage{Platform: "plan9-mainframe"}, Default},
+		// 本机的标签满足时也交给执行机器池, 和 agent 一起按负载分配
+		{"runs-on", dto.Stage{RunsOn: []string{runtime.GOOS}}, DefaultRunner},
+		{"runs-on local", dto.Stage{Executor: "local", RunsOn: []string{runtime.GOOS}}, Default},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := ForStage(tt.stage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Name() != tt.want {
+				t.Fatalf("执行器为 %s, 期望 %s", e.Name(), tt.want)
+			}
+		})
+	}
+	if _, err := ForStage(dto.Stage{Executor: "docker"}); err == nil {
+		t.Fatal("未知的执行器应返回错误")
+	}
+}
+
+func TestSupportsPlatform(t *testing.T) {
+	if !SupportsPlatform(runtime.GOOS) {
+		t.Fatalf("本机执行器应支持 %s", runtime.GOOS)
+	}
+	if SupportsPlatform("plan9-mainframe") {
+		t.Fatal("不应支持未注册的平台")
+	}
+}
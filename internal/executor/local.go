@@ -0,0 +1,55 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+
+	"pubot/internal/config"
+	"pubot/internal/dto"
+	"pubot/internal/utils"
+)
+
+// Local 在 pubot 所在的机器上启动 bash 会话执行步骤, 会话继承 pubot 进程的环境变量
+// 本机的标签为配置中的 labels 加上操作系统和架构
+type Local struct{}
+
+// LocalLabels 本机执行器的标签
+func LocalLabels() ([]string, error) {
+	labels, err := utils.NormalizeLabels(append(slices.Clone(config.Get().Labels), runtime.GOOS, runtime.GOARCH))
+	if err != nil {
+		return nil, fmt.Errorf("配置中的 labels 无效: %w", err)
+	}
+	return labels, nil
+}
+
+func init() {
+	Register(Local{}, runtime.GOOS)
+}
+
+func (Local) Name() string {
+	return "local"
+}
+
+func (Local) Check(s dto.Stage) error {
+	if s.Hosts != nil {
+		return errors.New("local 执行器不能设置 hosts, 在目标主机上执行请使用 ssh 执行器")
+	}
+	if len(s.RunsOn) > 0 {
+		labels, err := LocalLabels()
+		if err != nil {
+			return err
+		}
+		if !utils.MatchLabels(labels, s.RunsOn) {
+			return fmt.Errorf("本机的标签 %v 不满足 runs-on %v", labels, s.RunsOn)
+		}
+	}
+	return nil
+}
+
+func (Local) Open(_ context.Context, spec Spec) (utils.Session, error) {
+	return utils.StartShell(spec.WorkDir, utils.MergeEnv(os.Environ(), utils.EnvMap(spec.Env)))
+}
@@ -0,0 +1,326 @@
+package executor
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"pubot/internal/dto"
+	"pubot/internal/utils"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSH 通过 SSH 在阶段的目标主机上启动 bash 会话执行步骤, 每个会话使用独立的连接
+// 会话只设置 pubot 设置的环境变量, 不继承 pubot 进程的环境变量, $PUBOT_WORKSPACE 为远程主机上的工作目录
+// upload 和 download 步骤通过会话的连接使用 SFTP 传输文件
+type SSH struct{}
+
+func init() {
+	Register(SSH{})
+}
+
+func (SSH) Name() string {
+	return "ssh"
+}
+
+func (SSH) Check(s dto.Stage) error {
+	if s.Hosts == nil {
+		return errors.New("ssh 执行器需要设置 hosts")
+	}
+	return nil
+}
+
+func (SSH) Open(ctx context.Context, spec Spec) (utils.Session, error) {
+	if spec.Host == nil {
+		return nil, errors.New("ssh 执行器需要设置目标主机")
+	}
+	conf := dto.SSHConfig{}
+	if spec.Stage.SSH != nil {
+		conf = *spec.Stage.SSH
+	}
+	addr, config, agentConn, err := clientConfig(*spec.Host, conf)
+	if err != nil {
+		return nil, err
+	}
+	client, err := dialContext(ctx, addr, config)
+	if agentConn != nil {
+		// ssh-agent 只在认证时使用
+		agentConn.Close()
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+		return nil, fmt.Errorf("连接 %s 失败: %w", spec.Host.Label(), err)
+	}
+	// 启动 bash 到读到初始化输出之前 ctx 结束时断开连接, 避免远程主机没有响应时一直等待
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	fail := func(err error) (utils.Session, error) {
+		stop()
+		client.Close()
+		if ctx.Err() != nil {
+			return nil, context.Cause(ctx)
+		}
+		return nil, err
+	}
+	session, err := client.NewSession()
+	if err != nil {
+		return fail(fmt.Errorf("在 %s 上创建会话失败: %w", spec.Host.Label(), err))
+	}
+	stdin, err1 := session.StdinPipe()
+	stdout, err2 := session.StdoutPipe()
+	stderr, err3 := session.StderrPipe()
+	if err := errors.Join(err1, err2, err3); err != nil {
+		return fail(err)
+	}
+
+	start := "exec bash --noprofile --norc"
+	if conf.Dir != "" {
+		start = fmt.Sprintf("mkdir -p %s && cd %s && %s", utils.ShellQuote(conf.Dir), utils.ShellQuote(conf.Dir), start)
+	}
+	if err := session.Start(start); err != nil {
+		return fail(fmt.Errorf("在 %s 上启动 bash 失败: %w", spec.Host.Label(), err))
+	}
+	// 步骤脚本写入远程主机的临时目录后 source 执行, bash 退出时删除
+	// 最后输出 bash 的进程号和工作目录, 进程号在取消时用来结束远程 bash 所在的进程组
+	var init strings.Builder
+	init.WriteString(`__pubot_dir=$(mktemp -d) || exit 1; trap 'rm -rf "$__pubot_dir"' EXIT; `)
+	for _, kv := range spec.Env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			fmt.Fprintf(&init, "export %s=%s; ", k, utils.ShellQuote(v))
+		}
+	}
+	init.WriteString("export PUBOT_WORKSPACE=\"$PWD\"; echo \"$$ $PWD\"\n")
+	if _, err := io.WriteString(stdin, init.String()); err != nil {
+		return fail(err)
+	}
+	out := bufio.NewReader(stdout)
+	line, err := out.ReadString('\n')
+	first, dir, _ := strings.Cut(strings.TrimSuffix(line, "\n"), " ")
+	pid, perr := strconv.Atoi(first)
+	if err != nil || perr != nil {
+		return fail(fmt.Errorf("在 %s 上启动 bash 失败, 请检查 ssh.dir 和 bash 是否可用", spec.Host.Label()))
+	}
+	if !stop() {
+		// 读到输出的同时 ctx 结束, 连接已经断开
+		return fail(context.Cause(ctx))
+	}
+
+	shell, err := utils.NewShellSession(utils.ShellProcess{
+		Stdin:  stdin,
+		Stdout: out,
+		Stderr: stderr,
+		Wait: func() error {
+			err := session.Wait()
+			var exitErr *ssh.ExitError
+			if errors.As(err, &exitErr) {
+				return sshExitError{exitErr}
+			}
+			return err
+		},
+		// 不是所有的 sshd 都支持信号, 断开连接也不会结束远程的进程, 通过新的会话结束 bash 所在的进程组
+		Kill: func() {
+			if kill, err := client.NewSession(); err == nil {
+				kill.Run(fmt.Sprintf("kill -9 -- -%d", pid))
+			}
+			client.Close()
+		},
+		Source: func(n int, script string) (string, error) {
+			encoded := base64.StdEncoding.EncodeToString([]byte(script + "\n"))
+			return fmt.Sprintf(`printf '%%s' '%s' | base64 -d >"$__pubot_dir/step-%d.sh" && . "$__pubot_dir/step-%d.sh"`, encoded, n, n), nil
+		},
+		Release: client.Close,
+	})
+	if err != nil {
+		client.Close()
+		return nil, err
+	}
+	return &sshSession{ShellSession: shell, client: client, host: spec.Host.Label(), localDir: spec.WorkDir, remoteDir: dir, env: utils.EnvMap(spec.Env)}, nil
+}
+
+// dialContext 连接 addr 并完成 SSH 握手, ctx 结束时中止, 连接和握手都受 config.Timeout 限制
+func dialContext(ctx context.Context, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	dialer := net.Dialer{Timeout: config.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(config.Timeout))
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if !stop() {
+		conn.Close()
+		return nil, context.Cause(ctx)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// sshExitError 远程 bash 以非 0 退出码退出
+type sshExitError struct {
+	*ssh.ExitError
+}
+
+func (e sshExitError) ExitCode() int {
+	return e.ExitStatus()
+}
+
+// 写成 $变量名 或 ${变量名} 的凭据从环境变量读取
+// secret 读取凭据, 引用的环境变量只从 pubot 进程的环境变量中查找
+// 任务的 env 和触发参数会保存在任务和执行记录中, 不能用来传递凭据
+func secret(value string) (string, error) {
+	name, ok := utils.SecretRef(value)
+	if !ok {
+		return value, nil
+	}
+	if v, ok := os.LookupEnv(name); ok {
+		return v, nil
+	}
+	return "", fmt.Errorf("凭据引用的环境变量没有设置: %s", name)
+}
+
+// clientConfig 合并主机和阶段的 ssh 设置, 返回连接地址和客户端配置
+// 使用了 ssh-agent 时同时返回和 agent 的连接, 认证结束后关闭
+func clientConfig(h dto.Host, conf dto.SSHConfig) (string, *ssh.ClientConfig, net.Conn, error) {
+	name := cmp.Or(h.User, conf.User)
+	if name == "" {
+		u, err := user.Current()
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("没有设置 ssh 用户: %w", err)
+		}
+		name = u.Username
+	}
+	addr := net.JoinHostPort(h.Address, strconv.Itoa(cmp.Or(h.Port, conf.Port, 22)))
+
+	hostKey := ssh.InsecureIgnoreHostKey()
+	if !conf.InsecureSkipHostKey {
+		file := cmp.Or(conf.KnownHosts, "~/.ssh/known_hosts")
+		var err error
+		if hostKey, err = knownhosts.New(expandHome(file)); err != nil {
+			return "", nil, nil, fmt.Errorf("读取 known_hosts 失败: %w", err)
+		}
+	}
+
+	password, err := secret(cmp.Or(h.Password, conf.Password))
+	if err != nil {
+		return "", nil, nil, err
+	}
+	passphrase, err := secret(conf.Passphrase)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	var auth []ssh.AuthMethod
+	if key := cmp.Or(h.Key, conf.Key); key != "" {
+		signer, err := loadKey(key, passphrase)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password != "" {
+		auth = append(auth, ssh.Password(password),
+			ssh.KeyboardInteractive(func(_, _ string, questions []string, _ []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}))
+	}
+	var agentConn net.Conn
+	if len(auth) == 0 {
+		auth, agentConn = defaultAuth()
+	}
+	return addr, &ssh.ClientConfig{
+		User:            name,
+		Auth:            auth,
+		HostKeyCallback: hostKey,
+		Timeout:         cmp.Or(conf.Timeout, 10*time.Second),
+	}, agentConn, nil
+}
+
+// loadKey 读取私钥, key 为私钥文件路径, 也可以写成 $变量名
+func loadKey(key, passphrase string) (ssh.Signer, error) {
+	path, err := secret(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(expandHome(path))
+	if err != nil {
+		return nil, fmt.Errorf("读取私钥失败: %w", err)
+	}
+	if passphrase != "" {
+		signer, err := ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+		if err != nil {
+			return nil, fmt.Errorf("解析私钥失败: %w", err)
+		}
+		return signer, nil
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, errors.New("私钥有密码, 需要设置 ssh.passphrase")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("解析私钥失败: %w", err)
+	}
+	return signer, nil
+}
+
+// defaultAuth 没有设置凭据时使用 ssh-agent 和 ~/.ssh 下没有密码的默认私钥, 同时返回和 agent 的连接
+func defaultAuth() ([]ssh.AuthMethod, net.Conn) {
+	var (
+		auth []ssh.AuthMethod
+		conn net.Conn
+	)
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if c, err := net.Dial("unix", sock); err == nil {
+			conn = c
+			auth = append(auth, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	var signers []ssh.Signer
+	for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+		data, err := os.ReadFile(expandHome("~/.ssh/" + name))
+		if err != nil {
+			continue
+		}
+		if signer, err := ssh.ParsePrivateKey(data); err == nil {
+			signers = append(signers, signer)
+		}
+	}
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	return auth, conn
+}
+
+// expandHome 将开头的 ~/ 替换为 pubot 进程用户的主目录
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
@@ -0,0 +1,481 @@
+package executor
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"pubot/internal/dto"
+	"pubot/internal/utils"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const testSSHPassword = "secret"
+
+// testSSHServer 测试用的 SSH 服务, exec 请求在本机用 bash 执行, 支持 sftp 子系统
+type testSSHServer struct {
+	t         *testing.T
+	addr      string
+	port      int
+	hostKey   ssh.Signer
+	clientKey ssh.Signer // 允许登录的私钥
+	keyFile   string     // clientKey 的私钥文件
+}
+
+func newTestSSHServer(t *testing.T) *testSSHServer {
+	t.Helper()
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("没有 bash")
+	}
+	s := &testSSHServer{t: t, hostKey: newTestSigner(t)}
+	_, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.keyFile = filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(s.keyFile, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// 凭据只从 pubot 进程的环境变量读取
+	t.Setenv("SSH_PASSWORD", testSSHPassword)
+	t.Setenv("SSH_WRONG_PASSWORD", "wrong")
+	t.Setenv("SSH_KEY", s.keyFile)
+	if s.clientKey, err = ssh.NewSignerFromKey(clientPriv); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(_ ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) == testSSHPassword {
+				return nil, nil
+			}
+			return nil, errors.New("密码错误")
+		},
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(s.clientKey.PublicKey().Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("未知的公钥")
+		},
+	}
+	config.AddHostKey(s.hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	s.addr = l.Addr().String()
+	s.port = l.Addr().(*net.TCPAddr).Port
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func newTestSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	defer sconn.Close()
+	go ssh.DiscardRequests(reqs)
+	for nc := range chans {
+		if nc.ChannelType() != "session" {
+			nc.Reject(ssh.UnknownChannelType, "只支持 session")
+			continue
+		}
+		ch, requests, err := nc.Accept()
+		if err != nil {
+			continue
+		}
+		go s.session(ch, requests)
+	}
+}
+
+// session 处理一个会话的 exec 和 sftp 请求
+func (s *testSSHServer) session(ch ssh.Channel, requests <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range requests {
+		var payload struct{ Value string }
+		ssh.Unmarshal(req.Payload, &payload)
+		switch {
+		case req.Type == "exec":
+			req.Reply(true, nil)
+			code := s.exec(ch, payload.Value)
+			ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{uint32(code)}))
+			return
+		case req.Type == "subsystem" && payload.Value == "sftp":
+			req.Reply(true, nil)
+			server, err := sftp.NewServer(ch)
+			if err != nil {
+				return
+			}
+			server.Serve()
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+// exec 在独立的进程组中执行命令, 远程 bash 的进程号就是进程组号
+func (s *testSSHServer) exec(ch ssh.Channel, command string) int {
+	cmd := exec.Command("bash", "-c", command)
+	cmd.Dir = s.t.TempDir()
+	cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 255
+	}
+	if err := cmd.Start(); err != nil {
+		return 255
+	}
+	go func() {
+		io.Copy(stdin, ch)
+		stdin.Close()
+	}()
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() >= 0 {
+			return exitErr.ExitCode()
+		}
+		return 255
+	}
+	return 0
+}
+
+// knownHosts 写入包含 key 的 known_hosts 文件
+func (s *testSSHServer) knownHosts(key ssh.PublicKey) string {
+	file := filepath.Join(s.t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, key)
+	if err := os.WriteFile(file, []byte(line+"\n"), 0o600); err != nil {
+		s.t.Fatal(err)
+	}
+	return file
+}
+
+// spec 连接测试服务的会话参数, 凭据通过环境变量引用
+func (s *testSSHServer) spec(conf dto.SSHConfig, host dto.Host) Spec {
+	host.Address, host.Port = "127.0.0.1", s.port
+	host.User = "pubot"
+	return Spec{
+		Stage:   dto.Stage{Name: "deploy", SSH: &conf},
+		Host:    &host,
+		WorkDir: s.t.TempDir(),
+		Env:     []string{"PUBOT_STAGE=deploy", "TASK_PASSWORD=" + testSSHPassword},
+	}
+}
+
+// collect 收集步骤的输出
+type collect struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (c *collect) out(stream, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lines = append(c.lines, stream+": "+text)
+}
+
+func (c *collect) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return strings.Join(c.lines, "\n")
+}
+
+func openTestSession(t *testing.T, spec Spec) utils.Session {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	session, err := SSH{}.Open(ctx, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { session.Close() })
+	return session
+}
+
+func TestSSHAuth(t *testing.T) {
+	s := newTestSSHServer(t)
+	knownHosts := s.knownHosts(s.hostKey.PublicKey())
+	tests := []struct {
+		name string
+		conf dto.SSHConfig
+		host dto.Host
+		err  string
+	}{
+		{name: "password", conf: dto.SSHConfig{Password: "$SSH_PASSWORD", KnownHosts: knownHosts}},
+		{name: "host password", conf: dto.SSHConfig{KnownHosts: knownHosts}, host: dto.Host{Password: "${SSH_PASSWORD}"}},
+		{name: "key", conf: dto.SSHConfig{Key: "$SSH_KEY", KnownHosts: knownHosts}},
+		{name: "key file", conf: dto.SSHConfig{Key: s.keyFile, KnownHosts: knownHosts}},
+		{name: "wrong password", conf: dto.SSHConfig{Password: "$SSH_WRONG_PASSWORD", KnownHosts: knownHosts}, err: "unable to authenticate"},
+		{name: "missing secret", conf: dto.SSHConfig{Password: "$NO_SUCH_SECRET", KnownHosts: knownHosts}, err: "凭据引用的环境变量没有设置: NO_SUCH_SECRET"},
+		// 任务 env 会保存在任务中, 不能用来传递凭据
+		{name: "task env secret", conf: dto.SSHConfig{Password: "$TASK_PASSWORD", KnownHosts: knownHosts}, err: "凭据引用的环境变量没有设置: TASK_PASSWORD"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			session, err := SSH{}.Open(ctx, s.spec(tt.conf, tt.host))
+			if tt.err != "" {
+				if err == nil {
+					session.Close()
+					t.Fatal("期望连接失败")
+				}
+				if !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("错误为 %q, 期望包含 %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer session.Close()
+			var out collect
+			code, err := session.RunStep(ctx, "echo hello $PUBOT_STAGE", nil, out.out)
+			if err != nil || code != 0 {
+				t.Fatalf("退出码 %d, 错误 %v", code, err)
+			}
+			if !strings.Contains(out.String(), "stdout: hello deploy") {
+				t.Fatalf("输出为 %q", out.String())
+			}
+		})
+	}
+}
+
+func TestSSHHostKey(t *testing.T) {
+	s := newTestSSHServer(t)
+	other := newTestSigner(t)
+	tests := []struct {
+		name string
+		conf dto.SSHConfig
+		err  string
+	}{
+		{name: "known", conf: dto.SSHConfig{KnownHosts: s.knownHosts(s.hostKey.PublicKey())}},
+		{name: "mismatch", conf: dto.SSHConfig{KnownHosts: s.knownHosts(other.PublicKey())}, err: "key mismatch"},
+		{name: "unknown", conf: dto.SSHConfig{KnownHosts: filepath.Join(t.TempDir(), "empty")}, err: "读取 known_hosts 失败"},
+		{name: "insecure", conf: dto.SSHConfig{KnownHosts: s.knownHosts(other.PublicKey()), InsecureSkipHostKey: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.conf.Password = "$SSH_PASSWORD"
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			session, err := SSH{}.Open(ctx, s.spec(tt.conf, dto.Host{}))
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				session.Close()
+				return
+			}
+			if err == nil {
+				session.Close()
+				t.Fatal("期望主机密钥校验失败")
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("错误为 %q, 期望包含 %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSSHExitCodes(t *testing.T) {
+	s := newTestSSHServer(t)
+	session := openTestSession(t, s.spec(dto.SSHConfig{Password: "$SSH_PASSWORD", InsecureSkipHostKey: true}, dto.Host{}))
+	ctx := context.Background()
+
+	var out collect
+	// 同一个会话中的步骤共享工作目录和环境变量
+	if code, err := session.RunStep(ctx, "export GREETING=hi; cd /", nil, out.out); err != nil || code != 0 {
+		t.Fatalf("退出码 %d, 错误 %v", code, err)
+	}
+	if code, err := session.RunStep(ctx, "echo $GREETING $PWD $STEP_VAR; echo oops >&2", map[string]string{"STEP_VAR": "x"}, out.out); err != nil || code != 0 {
+		t.Fatalf("退出码 %d, 错误 %v", code, err)
+	}
+	if got := out.String(); !strings.Contains(got, "stdout: hi / x") || !strings.Contains(got, "stderr: oops") {
+		t.Fatalf("输出为 %q", got)
+	}
+	if code, _ := session.RunStep(ctx, "false", nil, out.out); code != 1 {
+		t.Fatalf("退出码 %d, 期望 1", code)
+	}
+	if code, _ := session.RunStep(ctx, "(exit 7)", nil, out.out); code != 7 {
+		t.Fatalf("退出码 %d, 期望 7", code)
+	}
+	if session.Exited() {
+		t.Fatal("步骤失败不应结束会话")
+	}
+	// 步骤中的 exit 结束远程 bash, 退出码来自 ssh 的 exit-status
+	code, err := session.RunStep(ctx, "exit 3", nil, out.out)
+	if code != 3 {
+		t.Fatalf("退出码 %d, 错误 %v, 期望退出码 3", code, err)
+	}
+	if !session.Exited() {
+		t.Fatal("执行 exit 后会话应已结束")
+	}
+}
+
+func TestSSHKillOnCancel(t *testing.T) {
+	s := newTestSSHServer(t)
+	session := openTestSession(t, s.spec(dto.SSHConfig{Password: "$SSH_PASSWORD", InsecureSkipHostKey: true}, dto.Host{}))
+
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(500*time.Millisecond, func() { cancel(errors.New("用户取消")) })
+	start := time.Now()
+	var out collect
+	_, err := session.RunStep(ctx, fmt.Sprintf("sleep 30 & echo $! > %s; wait", pidFile), nil, out.out)
+	if err == nil {
+		t.Fatal("取消后步骤应返回错误")
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("取消后 %s 才返回", elapsed)
+	}
+	if !session.Exited() {
+		t.Fatal("取消后会话应已结束")
+	}
+
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 远程 bash 所在的进程组都被杀掉, 包括后台的 sleep
+	deadline := time.Now().Add(5 * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("远程进程 %d 没有被杀掉", pid)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// processAlive 进程是否存在且不是僵尸进程
+func processAlive(pid int) bool {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return syscall.Kill(pid, 0) == nil
+	}
+	// 状态在进程名之后: pid (comm) S ...
+	_, rest, _ := strings.Cut(string(data), ") ")
+	return !strings.HasPrefix(rest, "Z") && !strings.HasPrefix(rest, "X")
+}
+
+func TestSSHOpenCanceled(t *testing.T) {
+	// 接受连接但不进行握手的服务
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var conns []net.Conn
+	var mu sync.Mutex
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+	}()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	cause := errors.New("用户取消")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(200*time.Millisecond, func() { cancel(cause) })
+	start := time.Now()
+	_, err = SSH{}.Open(ctx, Spec{
+		Stage: dto.Stage{SSH: &dto.SSHConfig{Password: "x", InsecureSkipHostKey: true, Timeout: time.Minute}},
+		Host:  &dto.Host{Address: "127.0.0.1", Port: port, User: "pubot"},
+	})
+	if !errors.Is(err, cause) {
+		t.Fatalf("错误为 %v, 期望取消的原因", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("取消后 %s 才返回", elapsed)
+	}
+}
+
+func TestSSHHandshakeTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	start := time.Now()
+	_, err = SSH{}.Open(context.Background(), Spec{
+		Stage: dto.Stage{SSH: &dto.SSHConfig{Password: "x", InsecureSkipHostKey: true, Timeout: 300 * time.Millisecond}},
+		Host:  &dto.Host{Address: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port, User: "pubot"},
+	})
+	if err == nil {
+		t.Fatal("期望握手超时")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("超时后 %s 才返回", elapsed)
+	}
+}
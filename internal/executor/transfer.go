@@ -0,0 +1,361 @@
+package executor
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"pubot/internal/dto"
+	"pubot/internal/utils"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshSession 目标主机上的 bash 会话, 同时可以通过同一个 SSH 连接用 SFTP 上传和下载文件
+type sshSession struct {
+	*utils.ShellSession
+	client    *ssh.Client
+	host      string
+	localDir  string            // 任务工作目录, 本地相对路径的起点
+	remoteDir string            // 打开会话时的远程工作目录, 远程相对路径的起点
+	env       map[string]string // pubot 设置的环境变量
+}
+
+func (s *sshSession) Upload(ctx context.Context, t dto.Transfer, env map[string]string, out utils.OutputFunc) error {
+	return s.transfer(ctx, t, env, true, out)
+}
+
+func (s *sshSession) Download(ctx context.Context, t dto.Transfer, env map[string]string, out utils.OutputFunc) error {
+	return s.transfer(ctx, t, env, false, out)
+}
+
+// transfer 上传或下载文件, src 和 dest 中的 $变量名 按步骤和 pubot 设置的环境变量展开, 未设置的变量展开为空
+func (s *sshSession) transfer(ctx context.Context, t dto.Transfer, env map[string]string, upload bool, out utils.OutputFunc) error {
+	expand := func(k string) string {
+		if v, ok := env[k]; ok {
+			return v
+		}
+		return s.env[k]
+	}
+	t.Src, t.Dest = os.Expand(t.Src, expand), os.Expand(t.Dest, expand)
+	localArg := t.Src
+	if !upload {
+		localArg = t.Dest
+	}
+	localPath, err := s.localPath(localArg)
+	if err != nil {
+		return err
+	}
+
+	client, err := sftp.NewClient(s.client)
+	if err != nil {
+		return fmt.Errorf("在 %s 上打开 SFTP 失败: %w", s.host, err)
+	}
+	defer client.Close()
+	// 取消或超时时关闭 SFTP 连接, 中断正在进行的传输
+	stop := context.AfterFunc(ctx, func() { client.Close() })
+	defer stop()
+
+	local, remote := localFS{}, remoteFS{client}
+	c := &copier{ctx: ctx, t: t, out: out, src: local, dst: remote}
+	src, dest, verb := localPath, s.remotePath(t.Dest), "上传"
+	if !upload {
+		c.src, c.dst = remote, local
+		src, dest, verb = s.remotePath(t.Src), localPath, "下载"
+	}
+	if c.perm, err = t.Perm(); err != nil {
+		return err
+	}
+
+	start := time.Now()
+	if err := c.copy(src, dest); err != nil {
+		return err
+	}
+	if t.Owner != "" {
+		if upload {
+			err = s.chown(t.Owner, c.written)
+		} else {
+			err = localChown(t.Owner, c.written)
+		}
+		if err != nil {
+			return fmt.Errorf("修改所有者为 %s 失败: %w", t.Owner, err)
+		}
+	}
+	elapsed := time.Since(start)
+	speed := utils.FormatBytes(int64(float64(c.bytes) / max(elapsed.Seconds(), 0.001)))
+	out(utils.StreamSystem, fmt.Sprintf("==> %s %d 个文件, %s, 耗时 %s, %s/s, sha256 校验通过",
+		verb, c.files, utils.FormatBytes(c.bytes), elapsed.Round(time.Millisecond), speed))
+	return nil
+}
+
+// localPath 本地路径只能是任务工作目录下的相对路径, 不能是绝对路径或通过 .. 离开工作目录
+func (s *sshSession) localPath(p string) (string, error) {
+	if p != "" && !filepath.IsLocal(p) {
+		return "", fmt.Errorf("本地路径必须是任务工作目录下的相对路径: %q", p)
+	}
+	return filepath.Join(s.localDir, p), nil
+}
+
+func (s *sshSession) remotePath(p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
+	return path.Join(s.remoteDir, p)
+}
+
+// chown 在远程主机上修改传输的文件和目录的所有者, 路径通过标准输入传给 xargs
+func (s *sshSession) chown(owner string, paths []string) error {
+	session, err := s.client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdin = strings.NewReader(strings.Join(paths, "\x00"))
+	if output, err := session.CombinedOutput("xargs -0 chown -h -- " + owner); err != nil {
+		return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// localChown 修改下载到本地的文件和目录的所有者
+func localChown(owner string, paths []string) error {
+	name, group, _ := strings.Cut(owner, ":")
+	u, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("用户 %s 的 uid 无效: %w", name, err)
+	}
+	gid := -1
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("用户组 %s 的 gid 无效: %w", group, err)
+		}
+	}
+	for _, p := range paths {
+		if err := os.Lchown(p, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileSystem 传输一端的文件系统, 本地或远程主机上的 SFTP
+type fileSystem interface {
+	Stat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	Create(name string) (io.WriteCloser, error)
+	MkdirAll(name string) error
+	Chmod(name string, mode fs.FileMode) error
+	Join(elem ...string) string
+	Dir(name string) string
+}
+
+type localFS struct{}
+
+func (localFS) Stat(name string) (fs.FileInfo, error) { return os.Stat(name) }
+
+func (localFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	entries, err := os.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (localFS) Open(name string) (io.ReadCloser, error)    { return os.Open(name) }
+func (localFS) Create(name string) (io.WriteCloser, error) { return os.Create(name) }
+func (localFS) MkdirAll(name string) error                 { return os.MkdirAll(name, 0o755) }
+func (localFS) Chmod(name string, mode fs.FileMode) error  { return os.Chmod(name, mode) }
+func (localFS) Join(elem ...string) string                 { return filepath.Join(elem...) }
+func (localFS) Dir(name string) string                     { return filepath.Dir(name) }
+
+type remoteFS struct {
+	client *sftp.Client
+}
+
+func (r remoteFS) Stat(name string) (fs.FileInfo, error) { return r.client.Stat(name) }
+
+func (r remoteFS) ReadDir(name string) ([]fs.FileInfo, error) {
+	infos, err := r.client.ReadDir(name)
+	slices.SortFunc(infos, func(a, b fs.FileInfo) int { return strings.Compare(a.Name(), b.Name()) })
+	return infos, err
+}
+
+func (r remoteFS) Open(name string) (io.ReadCloser, error)    { return r.client.Open(name) }
+func (r remoteFS) Create(name string) (io.WriteCloser, error) { return r.client.Create(name) }
+func (r remoteFS) MkdirAll(name string) error                 { return r.client.MkdirAll(name) }
+func (r remoteFS) Chmod(name string, mode fs.FileMode) error  { return r.client.Chmod(name, mode) }
+func (remoteFS) Join(elem ...string) string                   { return path.Join(elem...) }
+func (remoteFS) Dir(name string) string                       { return path.Dir(name) }
+
+// copier 从 src 复制文件到 dst, 每个文件复制后从 dst 读回校验 sha256
+type copier struct {
+	ctx      context.Context
+	t        dto.Transfer
+	out      utils.OutputFunc
+	src, dst fileSystem
+	perm     fs.FileMode // 为 0 时使用源文件的权限
+
+	files   int
+	bytes   int64
+	written []string // 写入的文件和目录, 用于修改所有者
+}
+
+// copy 复制 src 到 dest, src 为目录时复制目录下的所有文件
+func (c *copier) copy(src, dest string) error {
+	info, err := c.src.Stat(src)
+	if err != nil {
+		return fmt.Errorf("读取 %s 失败: %w", src, err)
+	}
+	if info.IsDir() {
+		return c.copyDir(src, dest, "")
+	}
+	if strings.HasSuffix(c.t.Dest, "/") {
+		dest = c.dst.Join(dest, info.Name())
+	} else if d, err := c.dst.Stat(dest); err == nil && d.IsDir() {
+		dest = c.dst.Join(dest, info.Name())
+	}
+	if err := c.dst.MkdirAll(c.dst.Dir(dest)); err != nil {
+		return fmt.Errorf("创建目录 %s 失败: %w", c.dst.Dir(dest), err)
+	}
+	return c.copyFile(src, dest, info.Name(), info)
+}
+
+// copyDir 复制目录, rel 为相对 src 的路径, 用于匹配 exclude 和输出
+func (c *copier) copyDir(src, dest, rel string) error {
+	if err := c.dst.MkdirAll(dest); err != nil {
+		return fmt.Errorf("创建目录 %s 失败: %w", dest, err)
+	}
+	c.written = append(c.written, dest)
+	infos, err := c.src.ReadDir(src)
+	if err != nil {
+		return fmt.Errorf("读取目录 %s 失败: %w", src, err)
+	}
+	for _, info := range infos {
+		name := path.Join(rel, info.Name())
+		if c.excluded(name, info.Name()) {
+			continue
+		}
+		from, to := c.src.Join(src, info.Name()), c.dst.Join(dest, info.Name())
+		switch {
+		case info.IsDir():
+			err = c.copyDir(from, to, name)
+		case info.Mode().IsRegular():
+			err = c.copyFile(from, to, name, info)
+		default:
+			c.out(utils.StreamSystem, "==> 跳过不是普通文件的 "+name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *copier) excluded(rel, name string) bool {
+	return slices.ContainsFunc(c.t.Exclude, func(pattern string) bool {
+		matchPath, _ := path.Match(pattern, rel)
+		matchName, _ := path.Match(pattern, name)
+		return matchPath || matchName
+	})
+}
+
+// copyFile 复制一个文件并校验 sha256
+func (c *copier) copyFile(src, dest, rel string, info fs.FileInfo) error {
+	sum, n, err := c.write(src, dest)
+	if err != nil {
+		return fmt.Errorf("传输 %s 失败: %w", rel, err)
+	}
+	perm := cmp.Or(c.perm, info.Mode().Perm())
+	if err := c.dst.Chmod(dest, perm); err != nil {
+		return fmt.Errorf("设置 %s 的权限失败: %w", rel, err)
+	}
+	written, err := c.checksum(c.dst, dest)
+	if err != nil {
+		return fmt.Errorf("校验 %s 失败: %w", rel, err)
+	}
+	if !bytes.Equal(sum, written) {
+		return fmt.Errorf("校验 %s 失败: sha256 不一致", rel)
+	}
+	c.files++
+	c.bytes += n
+	c.written = append(c.written, dest)
+	c.out(utils.StreamStdout, fmt.Sprintf("%s  %s  sha256:%s", rel, utils.FormatBytes(n), hex.EncodeToString(sum)[:16]))
+	return nil
+}
+
+// write 复制文件内容, 返回源文件内容的 sha256 和字节数
+func (c *copier) write(src, dest string) ([]byte, int64, error) {
+	r, err := c.src.Open(src)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+	w, err := c.dst.Create(dest)
+	if err != nil {
+		return nil, 0, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(w, io.TeeReader(ctxReader{c.ctx, r}, h))
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return h.Sum(nil), n, err
+}
+
+// checksum 读回写入的文件计算 sha256
+func (c *copier) checksum(fsys fileSystem, name string) ([]byte, error) {
+	r, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, ctxReader{c.ctx, r}); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// ctxReader ctx 结束后读取返回 ctx 结束的原因
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := context.Cause(r.ctx); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,154 @@
+package executor
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pubot/internal/dto"
+	"pubot/internal/utils"
+)
+
+// writeFiles 按相对路径写入文件
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// shortSum 日志中输出的 sha256 前 16 位
+func shortSum(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])[:16]
+}
+
+func TestSSHTransfer(t *testing.T) {
+	s := newTestSSHServer(t)
+	remoteDir := t.TempDir()
+	spec := s.spec(dto.SSHConfig{Password: "$SSH_PASSWORD", InsecureSkipHostKey: true, Dir: remoteDir}, dto.Host{})
+	files := map[string]string{
+		"dist/index.html": "<html></html>",
+		"dist/app.js":     "console.log('pubot')",
+		"dist/app.js.map": "{}",
+		"dist/css/a.css":  "body {}",
+	}
+	writeFiles(t, spec.WorkDir, files)
+	session, ok := openTestSession(t, spec).(utils.Transferer)
+	if !ok {
+		t.Fatal("ssh 会话应支持上传和下载")
+	}
+	ctx := context.Background()
+
+	var out collect
+	upload := dto.Transfer{Src: "dist", Dest: "releases/$VERSION", Mode: "0600", Exclude: []string{"*.map"}}
+	if err := session.Upload(ctx, upload, map[string]string{"VERSION": "42"}, out.out); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"index.html", "app.js", "css/a.css"} {
+		content := files["dist/"+name]
+		p := filepath.Join(remoteDir, "releases/42", name)
+		data, err := os.ReadFile(p)
+		if err != nil || string(data) != content {
+			t.Fatalf("远程文件 %s 为 %q, 错误 %v", name, data, err)
+		}
+		if info, _ := os.Stat(p); info.Mode().Perm() != 0o600 {
+			t.Fatalf("远程文件 %s 的权限为 %v, 期望 0600", name, info.Mode().Perm())
+		}
+		if !strings.Contains(out.String(), name+"  ") || !strings.Contains(out.String(), "sha256:"+shortSum(content)) {
+			t.Fatalf("输出中缺少 %s 的校验值:\n%s", name, out.String())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(remoteDir, "releases/42/app.js.map")); !os.IsNotExist(err) {
+		t.Fatal("exclude 的文件不应上传")
+	}
+	if !strings.Contains(out.String(), "==> 上传 3 个文件") || !strings.Contains(out.String(), "sha256 校验通过") {
+		t.Fatalf("输出为:\n%s", out.String())
+	}
+
+	// dest 以 / 结尾时放到目录中
+	out = collect{}
+	download := dto.Transfer{Src: "releases/42/css/a.css", Dest: "logs/"}
+	if err := session.Download(ctx, download, nil, out.out); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(spec.WorkDir, "logs/a.css"))
+	if err != nil || string(data) != files["dist/css/a.css"] {
+		t.Fatalf("下载的文件为 %q, 错误 %v", data, err)
+	}
+	if !strings.Contains(out.String(), "sha256:"+shortSum(files["dist/css/a.css"])) || !strings.Contains(out.String(), "==> 下载 1 个文件") {
+		t.Fatalf("输出为:\n%s", out.String())
+	}
+
+	if err := session.Download(ctx, dto.Transfer{Src: "missing.txt", Dest: "logs/"}, nil, out.out); err == nil {
+		t.Fatal("下载不存在的文件应失败")
+	}
+}
+
+// corruptFS 读回的内容与写入的不一致
+type corruptFS struct{ localFS }
+
+func (corruptFS) Open(string) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader("corrupted")), nil
+}
+
+func TestCopierChecksumMismatch(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{"src/app.js": "console.log('pubot')"})
+	var out collect
+	c := &copier{ctx: context.Background(), t: dto.Transfer{Dest: "dest/"}, out: out.out, src: localFS{}, dst: corruptFS{}}
+	err := c.copy(filepath.Join(dir, "src/app.js"), filepath.Join(dir, "dest"))
+	if err == nil || !strings.Contains(err.Error(), "校验 app.js 失败: sha256 不一致") {
+		t.Fatalf("错误为 %v, 期望 sha256 不一致", err)
+	}
+	if c.files != 0 || out.String() != "" {
+		t.Fatalf("校验失败的文件不应计入: %d 个文件, 输出 %q", c.files, out.String())
+	}
+}
+
+func TestSSHTransferLocalPath(t *testing.T) {
+	s := newTestSSHServer(t)
+	remoteDir := t.TempDir()
+	spec := s.spec(dto.SSHConfig{Password: "$SSH_PASSWORD", InsecureSkipHostKey: true, Dir: remoteDir}, dto.Host{})
+	writeFiles(t, remoteDir, map[string]string{"app.log": "ok"})
+	session := openTestSession(t, spec).(utils.Transferer)
+	ctx := context.Background()
+	outside := filepath.Join(filepath.Dir(spec.WorkDir), "outside")
+
+	var out collect
+	for _, tr := range []dto.Transfer{
+		{Src: "/etc/passwd", Dest: "passwd"},
+		{Src: "../outside", Dest: "outside"},
+		{Src: "dist/../../outside", Dest: "outside"},
+	} {
+		if err := session.Upload(ctx, tr, nil, out.out); err == nil || !strings.Contains(err.Error(), "本地路径必须是任务工作目录下的相对路径") {
+			t.Fatalf("上传 %s 的错误为 %v, 期望拒绝工作目录外的路径", tr.Src, err)
+		}
+	}
+	for _, tr := range []dto.Transfer{
+		{Src: "app.log", Dest: outside + "/"},
+		{Src: "app.log", Dest: "../outside/"},
+		{Src: "app.log", Dest: "$DEST/"},
+	} {
+		if err := session.Download(ctx, tr, map[string]string{"DEST": ".."}, out.out); err == nil || !strings.Contains(err.Error(), "本地路径必须是任务工作目录下的相对路径") {
+			t.Fatalf("下载到 %s 的错误为 %v, 期望拒绝工作目录外的路径", tr.Dest, err)
+		}
+	}
+	if _, err := os.Stat(outside); !os.IsNotExist(err) {
+		t.Fatal("不应在工作目录外写入文件")
+	}
+	if out.String() != "" {
+		t.Fatalf("拒绝的传输不应有输出:\n%s", out.String())
+	}
+}
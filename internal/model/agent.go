@@ -0,0 +1,24 @@
+package model
+
+import "time"
+
+// PbAgent 通过 pubot agent 连接到服务端的执行机器, 管理员批准后才会分配步骤
+// 删除后 agent 的凭据失效, 再次连接时作为新的 agent 等待批准
+type PbAgent struct {
+	ID         uint   `gorm:"primaryKey;autoIncrement"`
+	Name       string `gorm:"type:varchar(255);not null;uniqueIndex"`
+	SecretHash string `gorm:"type:varchar(64);not null"` // agent 凭据的 sha256
+	Labels     string `gorm:"type:varchar(1024)"`        // 逗号分隔
+	Capacity   int    `gorm:"not null;default:1"`        // 同时执行的会话数
+	OS         string `gorm:"type:varchar(64)"`
+	Arch       string `gorm:"type:varchar(64)"`
+	Approved   bool   `gorm:"not null;default:false"`
+	Address    string `gorm:"type:varchar(255)"` // 最近一次连接的地址
+	LastSeen   *time.Time
+	CreatedAt  time.Time
+	UpdatedAt  time.Time
+}
+
+func (PbAgent) TableName() string {
+	return "pb_agent"
+}
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// 任务触发来源
+const (
+	TriggerManual = "manual" // 页面或接口手动触发
+)
+
+// PbTaskRun 任务的每一次执行记录
+type PbTaskRun struct {
+	ID          uint            `gorm:"primaryKey;autoIncrement"`
+	TaskID      uint            `gorm:"not null;uniqueIndex:idx_task_run_number"`
+	Number      int             `gorm:"not null;uniqueIndex:idx_task_run_number"` // 任务内递增的执行序号
+	Trigger     string          `gorm:"type:varchar(32);not null"`                // 触发来源
+	UserID      uint            // 触发用户
+	Username    string          `gorm:"type:varchar(255)"`
+	Status      string          `gorm:"type:varchar(20);index"`
+	FailedStage string          `gorm:"type:varchar(255)"` // 失败的阶段
+	FailedStep  int             // 失败的步骤序号(从1开始)
+	Warnings    int             // continue_on_error 步骤失败的次数
+	Error       string          `gorm:"type:text"`  // 失败原因
+	Result      json.RawMessage `gorm:"type:jsonb"` // 各阶段和步骤的执行结果
+	Params      json.RawMessage `gorm:"type:jsonb"` // 触发时的参数值
+	YAML        string          `gorm:"type:text"`  // 执行时使用的 YAML, 模板已展开
+	StartedAt   *time.Time      // 排队期间为空
+	FinishedAt  *time.Time
+	Duration    int64 // 执行耗时(毫秒)
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+}
+
+func (PbTaskRun) TableName() string {
+	return "pb_task_run"
+}
@@ -0,0 +1,22 @@
+package model
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// PbTemplate 任务可以继承(extends)或引入(include)的共享模板
+type PbTemplate struct {
+	ID          uint   `gorm:"primaryKey;autoIncrement"`
+	Name        string `gorm:"type:varchar(255);not null;uniqueIndex:idx_pb_template_name_active,where:deleted_at IS NULL"` // 任务中按名称引用, 删除的模板不占用名称
+	Description string `gorm:"type:varchar(512)"`
+	YAML        string `gorm:"type:text"`
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	DeletedAt   gorm.DeletedAt `gorm:"index"`
+}
+
+func (PbTemplate) TableName() string {
+	return "pb_template"
+}
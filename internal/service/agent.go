@@ -0,0 +1,723 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"pubot/internal/agent"
+	"pubot/internal/config"
+	"pubot/internal/dao"
+	"pubot/internal/dto"
+	"pubot/internal/executor"
+	"pubot/internal/model"
+	"pubot/internal/utils"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrAgentDisabled  = errors.New("服务端没有启用 agent")
+	ErrAgentToken     = errors.New("agent token 无效")
+	ErrAgentForbidden = errors.New("只有管理员可以管理 agent")
+	ErrAgentClosed    = errors.New("pubot 正在关闭, 不再分配 agent")
+)
+
+const (
+	// agent 断开连接时, 正在执行的步骤最多重新排队的次数
+	maxRequeue = 3
+	// 取消步骤后等待 agent 回复的时间, 超过后认为会话已不可用
+	agentCancelWait = 10 * time.Second
+)
+
+// AgentService 管理 agent 的注册、批准和连接, 并把会话分配给空闲的 agent
+// 按 runs-on 选择执行机器的阶段, 本机也和 agent 一起按负载分配
+type AgentService struct {
+	agentDao *dao.AgentDao
+
+	mu      sync.Mutex
+	conns   map[uint]*agentConn // 在线的 agent, key 为 agent ID
+	local   *agentConn          // 本机, 同时执行的会话数为 localCapacity, 为空时不在本机执行
+	changed chan struct{}       // agent 上线、批准或释放会话时关闭并重新创建, 唤醒等待空闲 agent 的会话
+	closed  bool                // 关闭后不再接受连接和分配会话
+
+	serving sync.WaitGroup // 正在处理的 agent 连接
+}
+
+func NewAgentService(agentDao *dao.AgentDao) *AgentService {
+	as := &AgentService{
+		agentDao: agentDao,
+		conns:    make(map[uint]*agentConn),
+		changed:  make(chan struct{}),
+	}
+	labels, err := executor.LocalLabels()
+	if err != nil {
+		slog.Error("读取本机标签失败, runs-on 阶段不会在本机执行", slog.String("Err", err.Error()))
+		return as
+	}
+	as.local = &agentConn{name: "本机", labels: labels, capacity: config.Get().LocalCapacity, approved: true}
+	return as
+}
+
+// agentConn 一个在线 agent 的连接, 本机也用它参与分配, 此时没有 conn
+type agentConn struct {
+	id       uint
+	name     string
+	labels   []string // 标签, 包括操作系统和架构
+	capacity int
+	conn     *agent.Conn
+	lost     chan struct{} // 连接断开时关闭
+
+	// 以下字段由 AgentService.mu 保护
+	approved bool
+	running  int
+
+	mu       sync.Mutex
+	sessions map[string]*agentSession
+}
+
+// notify 唤醒等待空闲 agent 的会话, 调用方持有 as.mu
+func (as *AgentService) notify() {
+	close(as.changed)
+	as.changed = make(chan struct{})
+}
+
+// Authorize 校验 agent 连接时带的 token
+func (as *AgentService) Authorize(header string) error {
+	token := config.Get().AgentToken
+	if token == "" {
+		return ErrAgentDisabled
+	}
+	given := strings.TrimSpace(strings.TrimPrefix(header, "Bearer "))
+	if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+		return ErrAgentToken
+	}
+	return nil
+}
+
+// Serve 处理一个 agent 连接, 直到连接断开
+// 第一条消息必须是注册, 之后接收心跳和会话的消息
+func (as *AgentService) Serve(conn *agent.Conn, addr string) {
+	defer conn.Close()
+	as.mu.Lock()
+	if as.closed {
+		as.mu.Unlock()
+		return
+	}
+	as.serving.Add(1)
+	as.mu.Unlock()
+	defer as.serving.Done()
+	m, err := conn.Receive()
+	if err != nil || m.Type != agent.MsgRegister {
+		slog.Error("agent 没有注册", slog.String("Address", addr))
+		return
+	}
+	ac, secret, err := as.register(m, conn, addr)
+	if err != nil {
+		slog.Error("agent 注册失败", slog.String("Name", m.Name), slog.String("Address", addr), slog.String("Err", err.Error()))
+		conn.Send(agent.Message{Type: agent.MsgReject, Error: err.Error()})
+		return
+	}
+	defer as.disconnect(ac)
+	slog.Info("agent 已连接", slog.String("Name", ac.name), slog.String("Address", addr), slog.Bool("Approved", ac.approved))
+	if err := conn.Send(agent.Message{Type: agent.MsgRegistered, Secret: secret, Approved: ac.approved}); err != nil {
+		return
+	}
+
+	for {
+		m, err := conn.Receive()
+		if err != nil {
+			slog.Info("agent 已断开", slog.String("Name", ac.name), slog.String("Err", err.Error()))
+			return
+		}
+		switch m.Type {
+		case agent.MsgHeartbeat:
+			if err := as.agentDao.Touch(ac.id, time.Now()); err != nil {
+				slog.Error("更新 agent 心跳时间失败", slog.String("Name", ac.name), slog.String("Err", err.Error()))
+			}
+			conn.Send(agent.Message{Type: agent.MsgHeartbeat})
+		case agent.MsgOpened, agent.MsgOutput, agent.MsgDone:
+			ac.deliver(m)
+		}
+	}
+}
+
+// register 注册 agent, 新的 agent 生成凭据并等待管理员批准, 已有的 agent 校验凭据
+// 同一个 agent 已经在线时(例如网络中断后重连)断开旧的连接
+func (as *AgentService) register(m agent.Message, conn *agent.Conn, addr string) (*agentConn, string, error) {
+	name := strings.TrimSpace(m.Name)
+	if name == "" {
+		return nil, "", errors.New("agent 名称不能为空")
+	}
+	labels, err := utils.NormalizeLabels(m.Labels)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := utils.NormalizeLabels([]string{m.OS, m.Arch}); err != nil {
+		return nil, "", fmt.Errorf("无效的操作系统或架构: %w", err)
+	}
+	now := time.Now()
+	var secret string
+	record, err := as.agentDao.GetByName(name)
+	switch {
+	case errors.Is(err, gorm.ErrRecordNotFound):
+		secret, err = newAgentSecret()
+		if err != nil {
+			return nil, "", err
+		}
+		record = &model.PbAgent{Name: name, SecretHash: hashAgentSecret(secret)}
+	case err != nil:
+		return nil, "", err
+	case subtle.ConstantTimeCompare([]byte(hashAgentSecret(m.Secret)), []byte(record.SecretHash)) != 1:
+		return nil, "", fmt.Errorf("名称 %s 已被其他 agent 使用", name)
+	}
+	record.Labels = strings.Join(labels, ",")
+	record.Capacity = max(m.Capacity, 1)
+	record.OS, record.Arch, record.Address, record.LastSeen = m.OS, m.Arch, addr, &now
+	if record.ID == 0 {
+		err = as.agentDao.Create(record)
+	} else {
+		err = as.agentDao.Update(record)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	ac := &agentConn{
+		id:       record.ID,
+		name:     record.Name,
+		labels:   agentLabels(record),
+		capacity: record.Capacity,
+		conn:     conn,
+		lost:     make(chan struct{}),
+		approved: record.Approved,
+		sessions: make(map[string]*agentSession),
+	}
+	as.mu.Lock()
+	if as.closed {
+		as.mu.Unlock()
+		return nil, "", ErrAgentClosed
+	}
+	old := as.conns[ac.id]
+	as.conns[ac.id] = ac
+	as.notify()
+	as.mu.Unlock()
+	if old != nil {
+		slog.Info("agent 重新连接, 断开旧的连接", slog.String("Name", ac.name))
+		old.conn.Close()
+	}
+	return ac, secret, nil
+}
+
+// disconnect 连接断开后移除 agent, 正在执行的会话会重新排队
+func (as *AgentService) disconnect(ac *agentConn) {
+	as.mu.Lock()
+	if as.conns[ac.id] == ac {
+		delete(as.conns, ac.id)
+	}
+	as.mu.Unlock()
+	close(ac.lost)
+	if err := as.agentDao.Touch(ac.id, time.Now()); err != nil {
+		slog.Error("更新 agent 心跳时间失败", slog.String("Name", ac.name), slog.String("Err", err.Error()))
+	}
+}
+
+// Close 断开所有 agent 连接并等待处理连接的协程结束, 之后不再接受连接, 等待空闲 agent 的会话返回 ErrAgentClosed
+// 应在任务服务关闭之后、关闭数据库之前调用, 断开时会更新 agent 的最后在线时间
+func (as *AgentService) Close() {
+	as.mu.Lock()
+	as.closed = true
+	conns := slices.Collect(maps.Values(as.conns))
+	as.notify()
+	as.mu.Unlock()
+	for _, ac := range conns {
+		ac.conn.Close()
+	}
+	as.serving.Wait()
+}
+
+// List 所有注册过的 agent 及其在线状态
+func (as *AgentService) List() ([]dto.AgentInfo, error) {
+	records, err := as.agentDao.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	agents := make([]dto.AgentInfo, 0, len(records))
+	for _, a := range records {
+		info := dto.AgentInfo{
+			ID:        a.ID,
+			Name:      a.Name,
+			Labels:    []string{},
+			Capacity:  a.Capacity,
+			OS:        a.OS,
+			Arch:      a.Arch,
+			Approved:  a.Approved,
+			Address:   a.Address,
+			LastSeen:  a.LastSeen,
+			CreatedAt: a.CreatedAt,
+		}
+		if a.Labels != "" {
+			info.Labels = strings.Split(a.Labels, ",")
+		}
+		if ac, ok := as.conns[a.ID]; ok {
+			info.Online, info.Running = true, ac.running
+		}
+		agents = append(agents, info)
+	}
+	return agents, nil
+}
+
+// Approve 批准 agent(管理员), 在线的 agent 立即开始接收步骤
+func (as *AgentService) Approve(id uint, user *model.PbUser) error {
+	if user.Role != "admin" {
+		return ErrAgentForbidden
+	}
+	record, err := as.agentDao.GetByID(id)
+	if err != nil {
+		return err
+	}
+	if !record.Approved {
+		record.Approved = true
+		if err := as.agentDao.Update(record); err != nil {
+			return err
+		}
+	}
+	as.mu.Lock()
+	ac := as.conns[id]
+	if ac != nil && !ac.approved {
+		ac.approved = true
+		as.notify()
+	} else {
+		ac = nil
+	}
+	as.mu.Unlock()
+	if ac != nil {
+		slog.Info("agent 已批准", slog.String("Name", ac.name), slog.String("User", user.Name))
+		ac.conn.Send(agent.Message{Type: agent.MsgRegistered, Approved: true})
+	}
+	return nil
+}
+
+// Delete 删除 agent(管理员), 在线的 agent 会被断开, 正在执行的步骤重新排队
+func (as *AgentService) Delete(id uint, user *model.PbUser) error {
+	if user.Role != "admin" {
+		return ErrAgentForbidden
+	}
+	if _, err := as.agentDao.GetByID(id); err != nil {
+		return err
+	}
+	if err := as.agentDao.Delete(id); err != nil {
+		return err
+	}
+	as.mu.Lock()
+	ac := as.conns[id]
+	if ac != nil {
+		// 先移除, 避免断开前继续分配会话
+		delete(as.conns, id)
+	}
+	as.mu.Unlock()
+	if ac != nil {
+		slog.Info("agent 已删除, 断开连接", slog.String("Name", ac.name), slog.String("User", user.Name))
+		ac.conn.Send(agent.Message{Type: agent.MsgReject, Error: "agent 已被管理员删除"})
+		ac.conn.Close()
+	}
+	return nil
+}
+
+// Open 在空闲的 agent 上打开会话, 没有空闲的 agent 时等待, 实现 executor.AgentPool
+// 服务已关闭时返回 ErrAgentClosed
+func (as *AgentService) Open(ctx context.Context, spec executor.Spec) (utils.Session, error) {
+	dir, err := filepath.Rel(config.Get().WorkSpace, spec.WorkDir)
+	if err != nil || !filepath.IsLocal(dir) {
+		return nil, fmt.Errorf("工作目录不在 workSpace 下: %s", spec.WorkDir)
+	}
+	if err := as.matchable(spec.Stage); err != nil {
+		return nil, err
+	}
+	s := &agentSession{
+		pool:      as,
+		workDir:   filepath.ToSlash(dir),
+		localDir:  spec.WorkDir,
+		withLocal: spec.Stage.Executor == "",
+		env:       spec.Env,
+		runsOn:    spec.Stage.RunsOn,
+		log:       spec.Out,
+		queued:    spec.Queued,
+	}
+	if err := s.open(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// matchable 检查本机或已批准的 agent 是否满足阶段的 runs-on, 离线的 agent 也算, 都不满足时不再等待, 直接返回错误
+// 指定了 executor: agent 的阶段只检查 agent
+func (as *AgentService) matchable(s dto.Stage) error {
+	if s.Executor == "" && as.local != nil && utils.MatchLabels(as.local.labels, s.RunsOn) {
+		return nil
+	}
+	records, err := as.agentDao.GetAll()
+	if err != nil {
+		return err
+	}
+	approved, pending := 0, 0
+	for i := range records {
+		if !utils.MatchLabels(agentLabels(&records[i]), s.RunsOn) {
+			continue
+		}
+		if records[i].Approved {
+			approved++
+		} else {
+			pending++
+		}
+	}
+	if approved > 0 {
+		return nil
+	}
+	msg := "没有已批准的 agent"
+	if len(s.RunsOn) > 0 {
+		msg = fmt.Sprintf("没有已批准的 agent 的标签满足 runs-on %v", s.RunsOn)
+		if s.Executor == "" {
+			// 按 runs-on 选择到了 agent, 说明本机的标签也不满足
+			if labels, err := executor.LocalLabels(); err == nil {
+				msg = fmt.Sprintf("本机的标签 %v 和已批准的 agent 的标签都不满足 runs-on %v", labels, s.RunsOn)
+			}
+		}
+	}
+	if pending > 0 {
+		msg += fmt.Sprintf(", 有 %d 个满足的 agent 等待管理员批准", pending)
+	}
+	return errors.New(msg)
+}
+
+// agentLabels agent 的标签, 包括操作系统和架构
+func agentLabels(a *model.PbAgent) []string {
+	var labels []string
+	if a.Labels != "" {
+		labels = strings.Split(a.Labels, ",")
+	}
+	labels, _ = utils.NormalizeLabels(append(labels, a.OS, a.Arch))
+	return labels
+}
+
+// acquire 等待并占用一个已批准、有空闲容量、标签满足 runsOn 的 agent, 优先选择负载最低的
+// withLocal 时本机也是候选, 负载相同时优先本机; 需要等待时调用一次 onWait
+func (as *AgentService) acquire(ctx context.Context, runsOn []string, withLocal bool, onWait func()) (*agentConn, error) {
+	waiting := false
+	for {
+		as.mu.Lock()
+		if as.closed {
+			as.mu.Unlock()
+			return nil, ErrAgentClosed
+		}
+		candidates := slices.Collect(maps.Values(as.conns))
+		if withLocal && as.local != nil {
+			candidates = append(candidates, as.local)
+		}
+		var best *agentConn
+		for _, ac := range candidates {
+			if !ac.approved || ac.running >= ac.capacity || !utils.MatchLabels(ac.labels, runsOn) {
+				continue
+			}
+			if best == nil || ac.running*best.capacity < best.running*ac.capacity ||
+				(ac.running*best.capacity == best.running*ac.capacity && ac.id < best.id) {
+				best = ac
+			}
+		}
+		if best != nil {
+			best.running++
+			as.mu.Unlock()
+			return best, nil
+		}
+		wait := as.changed
+		as.mu.Unlock()
+		if !waiting {
+			waiting = true
+			onWait()
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+}
+
+// release 释放 agent 上的一个会话
+func (as *AgentService) release(ac *agentConn) {
+	as.mu.Lock()
+	ac.running--
+	as.notify()
+	as.mu.Unlock()
+}
+
+// deliver 把 agent 发来的会话消息交给对应的会话
+func (ac *agentConn) deliver(m agent.Message) {
+	ac.mu.Lock()
+	s := ac.sessions[m.Session]
+	ac.mu.Unlock()
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch m.Type {
+	case agent.MsgOpened:
+		if s.opened != nil {
+			s.opened <- m
+			s.opened = nil
+		}
+	case agent.MsgOutput:
+		if m.Step == s.step && s.out != nil {
+			s.out(m.Stream, m.Text)
+		}
+	case agent.MsgDone:
+		if m.Step == s.step && s.done != nil {
+			s.done <- m
+			s.done = nil
+		}
+	}
+}
+
+// agentSession 在 agent 或本机上打开的会话
+// agent 断开连接时在其他 agent 或本机上重新打开会话并重新执行当前步骤, 新的会话不保留之前步骤设置的工作目录和环境变量
+type agentSession struct {
+	pool      *AgentService
+	workDir   string // 相对 workSpace 的工作目录
+	localDir  string // 在本机执行时的工作目录
+	withLocal bool   // 是否可以分配到本机
+	env       []string
+	runsOn    []string
+	log       utils.OutputFunc // 输出等待和分配 agent 的提示
+	queued    func(queued bool)
+	ac        *agentConn
+	local     utils.Session // 分配到本机时的会话
+	id        string
+	exited    bool
+	requeue   int
+
+	// 以下字段由 mu 保护, 在连接的读取协程中使用
+	mu     sync.Mutex
+	step   int
+	out    utils.OutputFunc
+	opened chan agent.Message
+	done   chan agent.Message
+}
+
+// open 占用一个 agent 并在上面打开会话, agent 在打开前断开时换一个 agent
+func (s *agentSession) open(ctx context.Context) error {
+	for {
+		waited := false
+		ac, err := s.pool.acquire(ctx, s.runsOn, s.withLocal, func() {
+			waited = true
+			target := "agent"
+			if s.withLocal && s.pool.local != nil {
+				target = "本机或 agent"
+			}
+			if len(s.runsOn) > 0 {
+				s.output(fmt.Sprintf("==> 等待标签满足 runs-on %v 的空闲%s", s.runsOn, target))
+			} else {
+				s.output("==> 等待空闲的" + target)
+			}
+			if s.queued != nil {
+				s.queued(true)
+			}
+		})
+		// 取消时也结束等待
+		if waited && s.queued != nil {
+			s.queued(false)
+		}
+		if err != nil {
+			return err
+		}
+		if ac == s.pool.local {
+			return s.openLocal(ctx, ac)
+		}
+		id, err := newAgentSecret()
+		if err != nil {
+			s.pool.release(ac)
+			return err
+		}
+		opened := make(chan agent.Message, 1)
+		s.mu.Lock()
+		s.ac, s.id, s.step, s.opened, s.exited = ac, id, 0, opened, false
+		s.mu.Unlock()
+		ac.mu.Lock()
+		ac.sessions[id] = s
+		ac.mu.Unlock()
+
+		ac.conn.Send(agent.Message{Type: agent.MsgOpen, Session: id, WorkDir: s.workDir, Env: s.env})
+		select {
+		case m := <-opened:
+			if m.Error == "" {
+				s.output("==> 在 agent " + ac.name + " 上执行")
+				return nil
+			}
+			s.detach()
+			return fmt.Errorf("在 agent %s 上打开会话失败: %s", ac.name, m.Error)
+		case <-ac.lost:
+			s.detach()
+		case <-ctx.Done():
+			s.detach()
+			return context.Cause(ctx)
+		}
+	}
+}
+
+// openLocal 在占用的本机容量上启动 bash 会话
+func (s *agentSession) openLocal(ctx context.Context, ac *agentConn) error {
+	session, err := executor.Local{}.Open(ctx, executor.Spec{WorkDir: s.localDir, Env: s.env})
+	if err != nil {
+		s.pool.release(ac)
+		return err
+	}
+	s.mu.Lock()
+	s.ac, s.local, s.exited = ac, session, false
+	s.mu.Unlock()
+	s.output("==> 在本机执行")
+	return nil
+}
+
+func (s *agentSession) output(text string) {
+	if s.log != nil {
+		s.log(utils.StreamSystem, text)
+	}
+}
+
+// detach 关闭 agent 上的会话并释放 agent
+func (s *agentSession) detach() {
+	ac := s.ac
+	if ac == nil {
+		return
+	}
+	s.ac = nil
+	if s.local != nil {
+		s.local.Close()
+		s.local = nil
+		s.pool.release(ac)
+		return
+	}
+	ac.mu.Lock()
+	delete(ac.sessions, s.id)
+	ac.mu.Unlock()
+	ac.conn.Send(agent.Message{Type: agent.MsgClose, Session: s.id})
+	s.pool.release(ac)
+}
+
+// RunStep 在 agent 上执行一个步骤, agent 断开连接时最多重新排队 maxRequeue 次
+func (s *agentSession) RunStep(ctx context.Context, script string, env map[string]string, out utils.OutputFunc) (int, error) {
+	if s.Exited() {
+		return -1, utils.ErrShellExited
+	}
+	if s.local != nil {
+		return s.local.RunStep(ctx, script, env, out)
+	}
+	for {
+		name := s.ac.name
+		code, requeue, err := s.run(ctx, script, env, out)
+		if !requeue {
+			return code, err
+		}
+		s.detach()
+		if s.requeue >= maxRequeue {
+			s.exited = true
+			return -1, fmt.Errorf("agent %s 断开连接, 已重新排队 %d 次", name, maxRequeue)
+		}
+		s.requeue++
+		out(utils.StreamSystem, fmt.Sprintf("==> agent %s 断开连接, 步骤重新排队 (%d/%d), 新的会话不保留之前步骤的工作目录和环境变量",
+			name, s.requeue, maxRequeue))
+		if err := s.open(ctx); err != nil {
+			s.exited = true
+			return -1, err
+		}
+	}
+}
+
+// run 执行一次步骤, agent 在步骤结束前断开连接时 requeue 为 true, 需要换一个 agent 重新执行
+func (s *agentSession) run(ctx context.Context, script string, env map[string]string, out utils.OutputFunc) (code int, requeue bool, err error) {
+	ac := s.ac
+	done := make(chan agent.Message, 1)
+	s.mu.Lock()
+	s.step++
+	step := s.step
+	s.out, s.done = out, done
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.out, s.done = nil, nil
+		s.mu.Unlock()
+	}()
+
+	if err := ac.conn.Send(agent.Message{Type: agent.MsgStep, Session: s.id, Step: step, Script: script, StepEnv: env}); err != nil {
+		// 发送失败说明连接已断开, 等待读取协程确认
+		<-ac.lost
+		return -1, true, nil
+	}
+	select {
+	case m := <-done:
+		return s.result(m)
+	case <-ac.lost:
+		return -1, true, nil
+	case <-ctx.Done():
+	}
+
+	ac.conn.Send(agent.Message{Type: agent.MsgCancel, Session: s.id, Step: step})
+	timer := time.NewTimer(agentCancelWait)
+	defer timer.Stop()
+	select {
+	case m := <-done:
+		s.exited = m.Exited
+	case <-ac.lost:
+		s.exited = true
+	case <-timer.C:
+		// agent 没有回复, 会话的状态未知, 不再使用
+		s.exited = true
+	}
+	return -1, false, context.Cause(ctx)
+}
+
+func (s *agentSession) result(m agent.Message) (code int, requeue bool, err error) {
+	s.exited = m.Exited
+	if m.Error != "" {
+		return m.Code, false, errors.New(m.Error)
+	}
+	return m.Code, false, nil
+}
+
+func (s *agentSession) Exited() bool {
+	if s.local != nil {
+		return s.local.Exited()
+	}
+	return s.exited || s.ac == nil
+}
+
+func (s *agentSession) Close() error {
+	s.detach()
+	return nil
+}
+
+func newAgentSecret() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashAgentSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,309 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pubot/internal/agent"
+	"pubot/internal/config"
+	"pubot/internal/dao"
+	"pubot/internal/dto"
+	"pubot/internal/executor"
+	"pubot/internal/model"
+
+	"github.com/gorilla/websocket"
+)
+
+// testAgents 运行 AgentService 的 WebSocket 服务, 模拟的 agent 连接到这里
+type testAgents struct {
+	t   *testing.T
+	as  *AgentService
+	dao *dao.AgentDao
+	url string
+}
+
+func newTestAgents(t *testing.T) *testAgents {
+	t.Helper()
+	agentDao := dao.NewAgentDao(newTestDb(t))
+	as := NewAgentService(agentDao)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		as.Serve(agent.NewConn(ws), r.RemoteAddr)
+	}))
+	t.Cleanup(server.Close)
+	return &testAgents{t: t, as: as, dao: agentDao, url: "ws" + strings.TrimPrefix(server.URL, "http")}
+}
+
+// connect 连接一个已批准的 agent, 执行步骤时 drop 为 true 则断开连接, 否则返回退出码 0
+// 返回执行过的步骤数
+func (ta *testAgents) connect(name string, drop bool) func() int {
+	t := ta.t
+	t.Helper()
+	if err := ta.dao.Create(&model.PbAgent{Name: name, SecretHash: hashAgentSecret(name), Approved: true, Capacity: 1, OS: runtime.GOOS, Arch: runtime.GOARCH}); err != nil {
+		t.Fatal(err)
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(ta.url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := agent.NewConn(ws)
+	t.Cleanup(func() { conn.Close() })
+	conn.Send(agent.Message{Type: agent.MsgRegister, Name: name, Secret: name, Capacity: 1, OS: runtime.GOOS, Arch: runtime.GOARCH})
+	if m, err := conn.Receive(); err != nil || m.Type != agent.MsgRegistered {
+		t.Fatalf("agent %s 注册失败: %v %v", name, m, err)
+	}
+
+	var mu sync.Mutex
+	steps := 0
+	go func() {
+		for {
+			m, err := conn.Receive()
+			if err != nil {
+				return
+			}
+			switch m.Type {
+			case agent.MsgOpen:
+				conn.Send(agent.Message{Type: agent.MsgOpened, Session: m.Session})
+			case agent.MsgStep:
+				mu.Lock()
+				steps++
+				mu.Unlock()
+				if drop {
+					conn.Close()
+					return
+				}
+				conn.Send(agent.Message{Type: agent.MsgOutput, Session: m.Session, Step: m.Step, Stream: "stdout", Text: "on " + name})
+				conn.Send(agent.Message{Type: agent.MsgDone, Session: m.Session, Step: m.Step})
+			}
+		}
+	}()
+	return func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return steps
+	}
+}
+
+// open 为阶段 s 打开会话, 等待空闲的执行机器时 Queued 的参数写入 queued
+func (ta *testAgents) open(s dto.Stage, queued chan<- bool) (*agentSession, *collect) {
+	ta.t.Helper()
+	var log collect
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	dir := filepath.Join(config.Get().WorkSpace, "1")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		ta.t.Fatal(err)
+	}
+	spec := executor.Spec{Stage: s, WorkDir: dir, Out: log.out}
+	if queued != nil {
+		spec.Queued = func(q bool) { queued <- q }
+	}
+	session, err := ta.as.Open(ctx, spec)
+	if err != nil {
+		ta.t.Fatal(err)
+	}
+	ta.t.Cleanup(func() { session.Close() })
+	return session.(*agentSession), &log
+}
+
+func TestAgentRequeue(t *testing.T) {
+	ta := newTestAgents(t)
+	dropped := ta.connect("a1", true)
+	healthy := ta.connect("a2", false)
+	session, log := ta.open(dto.Stage{Name: "build", Executor: "agent"}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	code, err := session.RunStep(ctx, "make", nil, log.out)
+	if err != nil || code != 0 {
+		t.Fatalf("退出码 %d, 错误 %v\n%s", code, err, log)
+	}
+	if dropped() != 1 || healthy() != 1 {
+		t.Fatalf("a1 执行了 %d 次, a2 执行了 %d 次, 期望各一次", dropped(), healthy())
+	}
+	got := log.String()
+	for _, want := range []string{"==> 在 agent a1 上执行", "agent a1 断开连接, 步骤重新排队 (1/3)", "==> 在 agent a2 上执行", "on a2"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("输出中缺少 %q:\n%s", want, got)
+		}
+	}
+	if session.Exited() {
+		t.Fatal("重新排队成功后会话应可以继续使用")
+	}
+}
+
+func TestAgentRequeueLimit(t *testing.T) {
+	ta := newTestAgents(t)
+	var steps []func() int
+	for _, name := range []string{"a1", "a2", "a3", "a4", "a5"} {
+		steps = append(steps, ta.connect(name, true))
+	}
+	session, log := ta.open(dto.Stage{Name: "build", Executor: "agent"}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	code, err := session.RunStep(ctx, "make", nil, log.out)
+	if code != -1 || err == nil || !strings.Contains(err.Error(), "已重新排队 3 次") {
+		t.Fatalf("退出码 %d, 错误 %v, 期望重新排队 3 次后失败\n%s", code, err, log)
+	}
+	// 第一次执行加上 maxRequeue 次重新排队, 之后不再占用 agent
+	total := 0
+	for _, s := range steps {
+		total += s()
+	}
+	if total != maxRequeue+1 {
+		t.Fatalf("步骤执行了 %d 次, 期望 %d 次", total, maxRequeue+1)
+	}
+	if !strings.Contains(log.String(), "步骤重新排队 (3/3)") || strings.Contains(log.String(), "(4/3)") {
+		t.Fatalf("输出为:\n%s", log)
+	}
+	if !session.Exited() {
+		t.Fatal("超过重新排队次数后会话应已结束")
+	}
+	if _, err := session.RunStep(ctx, "make", nil, log.out); err == nil {
+		t.Fatal("已结束的会话不应继续执行步骤")
+	}
+}
+
+func TestLocalInAgentPool(t *testing.T) {
+	ta := newTestAgents(t)
+	ta.as.local.capacity = 1
+	stage := dto.Stage{Name: "build", RunsOn: []string{runtime.GOOS}}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// 负载相同时优先本机
+	first, log := ta.open(stage, nil)
+	if first.local == nil {
+		t.Fatalf("应在本机执行:\n%s", log)
+	}
+	if code, err := first.RunStep(ctx, "echo hi", nil, log.out); err != nil || code != 0 {
+		t.Fatalf("退出码 %d, 错误 %v", code, err)
+	}
+	if got := log.String(); !strings.Contains(got, "==> 在本机执行") || !strings.Contains(got, "stdout: hi") {
+		t.Fatalf("输出为:\n%s", got)
+	}
+
+	// 本机的容量已占满, 分配给 agent
+	ta.connect("a1", false)
+	second, log := ta.open(stage, nil)
+	if second.local != nil || !strings.Contains(log.String(), "==> 在 agent a1 上执行") {
+		t.Fatalf("本机已满时应在 agent 上执行:\n%s", log)
+	}
+
+	// 都没有空闲容量时等待, 本机释放后分配到本机
+	queued := make(chan bool, 2)
+	opened := make(chan *agentSession, 1)
+	go func() {
+		session, err := ta.as.Open(ctx, executor.Spec{
+			Stage:   stage,
+			WorkDir: first.localDir,
+			Queued:  func(q bool) { queued <- q },
+		})
+		if err != nil {
+			t.Error(err)
+			opened <- nil
+			return
+		}
+		opened <- session.(*agentSession)
+	}()
+	select {
+	case q := <-queued:
+		if !q {
+			t.Fatal("开始等待时应报告 queued")
+		}
+	case <-ctx.Done():
+		t.Fatal("没有空闲容量时应等待")
+	}
+	first.Close()
+	third := <-opened
+	if third == nil {
+		return
+	}
+	defer third.Close()
+	if q := <-queued; q {
+		t.Fatal("分配到执行机器后应结束 queued")
+	}
+	if third.local == nil {
+		t.Fatal("本机释放后应分配到本机")
+	}
+
+	// 指定 executor: agent 时不使用本机
+	third.Close()
+	second.Close()
+	only, log := ta.open(dto.Stage{Name: "build", Executor: "agent", RunsOn: stage.RunsOn}, nil)
+	if only.local != nil || !strings.Contains(log.String(), "在 agent a1 上执行") {
+		t.Fatalf("executor: agent 不应在本机执行:\n%s", log)
+	}
+}
+
+func TestAgentPoolNoMatch(t *testing.T) {
+	ta := newTestAgents(t)
+	_, err := ta.as.Open(context.Background(), executor.Spec{
+		Stage:   dto.Stage{Name: "build", RunsOn: []string{"gpu"}},
+		WorkDir: filepath.Join(config.Get().WorkSpace, "1"),
+	})
+	if err == nil || !strings.Contains(err.Error(), "不满足 runs-on [gpu]") {
+		t.Fatalf("错误为 %v, 期望立即失败", err)
+	}
+}
+
+func TestAgentServiceClose(t *testing.T) {
+	ta := newTestAgents(t)
+	ta.connect("a1", false)
+	ts := newTestTaskService(t)
+	ts.agents = ta.as
+	ex, err := ts.executorFor(dto.Stage{Name: "build", Executor: "agent"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, ok := ex.(executor.Agent); !ok || a.Pool != ta.as {
+		t.Fatalf("agent 执行器应使用注入的执行机器池: %#v", ex)
+	}
+
+	ta.as.Close()
+	agents, err := ta.as.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(agents) != 1 || agents[0].Online {
+		t.Fatalf("关闭后 agent 应已断开: %+v", agents)
+	}
+	_, err = ta.as.Open(context.Background(), executor.Spec{
+		Stage:   dto.Stage{Name: "build", Executor: "agent"},
+		WorkDir: filepath.Join(config.Get().WorkSpace, "1"),
+	})
+	if !errors.Is(err, ErrAgentClosed) {
+		t.Fatalf("错误为 %v, 期望 ErrAgentClosed", err)
+	}
+}
+
+// collect 收集输出
+type collect struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (c *collect) out(stream, text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lines = append(c.lines, stream+": "+text)
+}
+
+func (c *collect) String() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return strings.Join(c.lines, "\n")
+}
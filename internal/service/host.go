@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"pubot/internal/dto"
+	"pubot/internal/utils"
+)
+
+// runTargets 执行阶段的步骤, 设置了 hosts 时在每台目标主机上各执行一次
+func (r *runner) runTargets(ctx context.Context, s dto.Stage, name string, env []string, exprCtx *utils.ExprContext) (dto.StageResult, error) {
+	if s.Hosts == nil {
+		return r.runJob(ctx, s, name, nil, env, exprCtx)
+	}
+	return r.runHosts(ctx, s, name, env, exprCtx)
+}
+
+// runHosts 在目标主机上执行阶段的步骤, 主机的结果记录在阶段结果的 Hosts 中
+// 同一批的主机同时执行, 不是滚动部署时所有主机为一批; 滚动部署时一批结束并等待 pause 后再开始下一批
+// 失败的主机数超过 max_failures 时停止执行, 剩余的主机标记为跳过, 阶段的状态和错误为第一个失败的主机的状态和错误
+// 有主机失败但没有超过 max_failures 时阶段成功, 失败的主机记为警告
+func (r *runner) runHosts(ctx context.Context, s dto.Stage, name string, env []string, exprCtx *utils.ExprContext) (dto.StageResult, error) {
+	start := time.Now()
+	hosts := s.Hosts.List
+	batches, err := utils.HostBatches(s)
+	if err != nil {
+		r.output(name, 0, utils.StreamSystem, "==> "+err.Error())
+		return dto.StageResult{Name: name, Status: string(utils.TaskError), StartedAt: &start, Steps: []dto.StepResult{}}, err
+	}
+	labels := make([]string, len(hosts))
+	for i, h := range hosts {
+		labels[i] = h.Label()
+	}
+	if s.Strategy == dto.StrategyRolling {
+		r.output(name, 0, utils.StreamSystem, fmt.Sprintf("==> 滚动部署 %d 台主机, 分 %d 批, 最多允许 %d 台失败: %s",
+			len(hosts), len(batches), s.MaxFailures, strings.Join(labels, ", ")))
+	} else {
+		r.output(name, 0, utils.StreamSystem, fmt.Sprintf("==> 目标主机 %d 台: %s", len(hosts), strings.Join(labels, ", ")))
+	}
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		status   = utils.TaskSuccess
+		halted   bool
+	)
+	progress := utils.RolloutStatus{Stage: name, Batches: len(batches), Total: len(hosts), Status: utils.TaskRunning}
+	results := make([]dto.StageResult, 0, len(hosts))
+	for i, batch := range batches {
+		if !halted && i > 0 && s.Pause > 0 {
+			r.output(name, 0, utils.StreamSystem, fmt.Sprintf("==> 等待 %s 后开始第 %d/%d 批", s.Pause, i+1, len(batches)))
+			utils.Sleep(ctx, s.Pause)
+		}
+		if halted || ctx.Err() != nil {
+			// 超过 max_failures 或已取消, 剩余的主机不再执行
+			for _, h := range batch {
+				results = append(results, skippedResult(name+"@"+h.Label(), s.Steps))
+				results[len(results)-1].Host = h.Label()
+			}
+			continue
+		}
+
+		progress.Batch = i + 1
+		if s.Strategy == dto.StrategyRolling {
+			r.output(name, 0, utils.StreamSystem, fmt.Sprintf("==> 第 %d/%d 批: %s",
+				i+1, len(batches), strings.Join(labels[len(results):len(results)+len(batch)], ", ")))
+		}
+		r.broadcastRollout(progress)
+		batchResults := make([]dto.StageResult, len(batch))
+		errs := make([]error, len(batch))
+		var wg sync.WaitGroup
+		for j := range batch {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				batchResults[j], errs[j] = r.runHost(ctx, s, name, &batch[j], env, exprCtx)
+				mu.Lock()
+				defer mu.Unlock()
+				progress.Done++
+				if errs[j] != nil {
+					progress.Failed++
+				}
+				r.broadcastRollout(progress)
+			}(j)
+		}
+		wg.Wait()
+		results = append(results, batchResults...)
+
+		for j, err := range errs {
+			if err != nil && firstErr == nil {
+				firstErr, status = err, utils.TaskStatusEnum(batchResults[j].Status)
+			}
+		}
+		if progress.Failed > s.MaxFailures && i < len(batches)-1 {
+			halted = true
+			r.output(name, 0, utils.StreamSystem, fmt.Sprintf("==> %d 台主机失败, 超过 max_failures(%d), 停止执行, 剩余 %d 台主机不再执行",
+				progress.Failed, s.MaxFailures, len(hosts)-len(results)))
+		}
+	}
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr, status = context.Cause(ctx), utils.StepStatus(ctx, ctx.Err())
+	}
+
+	if progress.Failed > 0 {
+		r.output(name, 0, utils.StreamSystem, fmt.Sprintf("==> %d 台主机中 %d 台失败", len(hosts), progress.Failed))
+	}
+	if progress.Failed > 0 && progress.Failed <= s.MaxFailures && ctx.Err() == nil {
+		r.output(name, 0, utils.StreamSystem, fmt.Sprintf("==> 失败的主机没有超过 max_failures(%d), 记为警告", s.MaxFailures))
+		firstErr, status = nil, utils.TaskSuccess
+		for i := range results {
+			if results[i].Status != string(utils.TaskSuccess) && results[i].Status != string(utils.TaskSkipped) {
+				results[i].Status = string(utils.TaskWarning)
+			}
+		}
+	}
+	progress.Status = status
+	r.broadcastRollout(progress)
+	return dto.StageResult{
+		Name:      name,
+		Status:    string(status),
+		StartedAt: &start,
+		Duration:  time.Since(start).Milliseconds(),
+		Steps:     []dto.StepResult{},
+		Hosts:     results,
+	}, firstErr
+}
+
+// runHost 在一台目标主机上执行阶段的步骤, 日志和结果中的名称为 "阶段名@主机名"
+// 步骤中可以通过 $PUBOT_HOST 获取主机名
+func (r *runner) runHost(ctx context.Context, s dto.Stage, name string, host *dto.Host, env []string, exprCtx *utils.ExprContext) (dto.StageResult, error) {
+	hostName := name + "@" + host.Label()
+	env = utils.MergeEnv(env, map[string]string{"PUBOT_HOST": host.Label()})
+	r.output(hostName, 0, utils.StreamSystem, "==> 主机 "+host.Label())
+	result, err := r.runJob(ctx, s, hostName, host, env, exprCtx)
+	result.Host = host.Label()
+	return result, err
+}
@@ -0,0 +1,92 @@
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"pubot/internal/dto"
+	"pubot/internal/utils"
+)
+
+// rollingStage 在本机按主机执行的滚动部署阶段, 每台主机执行时在工作目录中留下 ran-主机名, fail 中的主机失败
+func rollingStage(names []string, batchSize string, maxFailures int, fail ...string) dto.Stage {
+	hosts := make([]dto.Host, len(names))
+	for i, name := range names {
+		hosts[i] = dto.Host{Name: name, Address: "127.0.0.1"}
+	}
+	script := `touch "ran-$PUBOT_HOST"`
+	for _, name := range fail {
+		script += `; [ "$PUBOT_HOST" != ` + name + ` ]`
+	}
+	return dto.Stage{
+		Name:        "deploy",
+		Executor:    "local",
+		Hosts:       &dto.Hosts{List: hosts},
+		Strategy:    dto.StrategyRolling,
+		BatchSize:   batchSize,
+		MaxFailures: maxFailures,
+		Steps:       []dto.Step{{Run: script}},
+	}
+}
+
+// runRolling 执行滚动部署, 返回阶段结果、每台主机的状态和执行过的主机
+func runRolling(t *testing.T, s dto.Stage) (dto.StageResult, map[string]string, []string, error) {
+	t.Helper()
+	r := newTestRunner(t)
+	result, err := r.runHosts(context.Background(), s, s.Name, r.stageEnv(s.Name, nil), r.exprContext(r.workDir, nil))
+	statuses := make(map[string]string, len(result.Hosts))
+	for _, h := range result.Hosts {
+		statuses[h.Host] = h.Status
+	}
+	var ran []string
+	for _, h := range s.Hosts.List {
+		if _, err := os.Stat(filepath.Join(r.workDir, "ran-"+h.Name)); err == nil {
+			ran = append(ran, h.Name)
+		}
+	}
+	return result, statuses, ran, err
+}
+
+func TestRollingHaltsAfterMaxFailures(t *testing.T) {
+	s := rollingStage([]string{"h1", "h2", "h3", "h4", "h5"}, "2", 0, "h1")
+	result, statuses, ran, err := runRolling(t, s)
+	if err == nil || result.Status == string(utils.TaskSuccess) {
+		t.Fatalf("状态为 %s, 错误 %v, 期望失败", result.Status, err)
+	}
+	// 第一批结束后失败数超过 max_failures, 剩余两批不再执行
+	if strings.Join(ran, ",") != "h1,h2" {
+		t.Fatalf("执行过的主机为 %v, 期望只有第一批", ran)
+	}
+	want := map[string]string{"h1": result.Status, "h2": string(utils.TaskSuccess), "h3": string(utils.TaskSkipped), "h4": string(utils.TaskSkipped), "h5": string(utils.TaskSkipped)}
+	for host, status := range want {
+		if statuses[host] != status {
+			t.Fatalf("主机的状态为 %v, 期望 %v", statuses, want)
+		}
+	}
+}
+
+func TestRollingFailureInLastBatch(t *testing.T) {
+	// 最后一批失败时没有剩余的主机需要停止, 阶段直接返回第一个失败的主机的错误
+	s := rollingStage([]string{"h1", "h2", "h3"}, "1", 0, "h3")
+	result, statuses, ran, err := runRolling(t, s)
+	if err == nil || !strings.Contains(err.Error(), "执行失败") {
+		t.Fatalf("错误为 %v, 期望 h3 的步骤失败", err)
+	}
+	if len(ran) != 3 || statuses["h3"] != result.Status || statuses["h1"] != string(utils.TaskSuccess) {
+		t.Fatalf("执行过的主机为 %v, 状态为 %v", ran, statuses)
+	}
+}
+
+func TestRollingWithinMaxFailures(t *testing.T) {
+	s := rollingStage([]string{"h1", "h2", "h3"}, "1", 1, "h1")
+	result, statuses, ran, err := runRolling(t, s)
+	if err != nil || result.Status != string(utils.TaskSuccess) {
+		t.Fatalf("状态为 %s, 错误 %v, 期望没有超过 max_failures 时成功", result.Status, err)
+	}
+	if len(ran) != 3 || statuses["h1"] != string(utils.TaskWarning) || statuses["h2"] != string(utils.TaskSuccess) {
+		t.Fatalf("执行过的主机为 %v, 状态为 %v", ran, statuses)
+	}
+}
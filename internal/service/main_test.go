@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pubot/internal/dao"
+	"pubot/internal/model"
+	"pubot/internal/utils"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// TestMain 在临时目录中生成 config.yaml 并切换过去, 工作目录和日志目录都在临时目录下
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "pubot-service-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	conf := "workSpace: work\nlogDir: logs\nworkers: 2\nagentToken: test-token\n"
+	if err := os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(conf), 0o600); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := os.Chdir(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// newTestDb 打开测试用的 sqlite 数据库并迁移所有表
+func newTestDb(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "pubot.db")), &gorm.Config{
+		Logger:         logger.Default.LogMode(logger.Silent),
+		TranslateError: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&model.PbUser{}, &model.PbTask{}, &model.PbTaskRun{}, &model.PbTemplate{}, &model.PbAgent{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if sqlDB, err := db.DB(); err == nil {
+			sqlDB.Close()
+		}
+	})
+	return db
+}
+
+// newTestTaskService 创建不启动 worker 的 TaskService, 由测试自己从队列中取出执行
+func newTestTaskService(t *testing.T) *TaskService {
+	t.Helper()
+	db := newTestDb(t)
+	ts := &TaskService{
+		hub:       utils.NewHub(),
+		logs:      utils.NewLogHub(),
+		taskDao:   dao.NewTaskDao(db),
+		runDao:    dao.NewTaskRunDao(db),
+		templates: templateLookup(dao.NewTemplateDao(db)),
+		queue:     newRunQueue(),
+	}
+	ts.halt, ts.haltRuns = context.WithCancelCause(context.Background())
+	return ts
+}
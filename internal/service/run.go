@@ -0,0 +1,337 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"pubot/internal/dto"
+	"pubot/internal/executor"
+	"pubot/internal/model"
+	"pubot/internal/utils"
+)
+
+// runner 单次执行的上下文
+type runner struct {
+	ts       *TaskService
+	ctx      context.Context
+	task     *model.PbTask
+	run      *model.PbTaskRun
+	log      *utils.RunLog
+	parsed   *dto.TaskYAML
+	workDir  string
+	builtins map[string]string // 内置环境变量
+	params   map[string]any    // 触发参数
+	nodes    []*stageNode
+	finally  *dto.StageResult // 任务 finally 步骤的执行结果
+
+	// 并发执行的阶段保存执行记录或等待执行机器时加锁
+	mu      sync.Mutex
+	waiting int // 正在等待空闲执行机器的会话数, 大于 0 时执行记录和任务的状态为 queued
+}
+
+// run 按依赖关系执行各个阶段, 并记录执行结果
+func (ts *TaskService) run(ctx context.Context, t *model.PbTask, run *model.PbTaskRun) {
+	r := &runner{ts: ts, ctx: ctx, task: t, run: run}
+	ts.logs.Begin(t.ID)
+	runLog, err := utils.CreateRunLog(t.ID, run.Number)
+	if err != nil {
+		// 日志文件创建失败不影响执行, 只保留实时输出
+		slog.Error("创建执行日志失败", slog.Uint64("TaskID", uint64(t.ID)), slog.String("Err", err.Error()))
+	} else {
+		r.log = runLog
+		defer runLog.Close()
+	}
+	r.execute()
+}
+
+func (r *runner) execute() {
+	t := r.task
+	// 1️⃣ 开始执行任务：持久化 running 状态
+	r.run.Status = string(utils.TaskRunning)
+	now := time.Now()
+	r.run.StartedAt = &now
+	if err := r.ts.runDao.Save(r.run); err != nil {
+		r.finish(utils.TaskError, "", 0, err)
+		return
+	}
+	t.Status = string(utils.TaskRunning)
+	if err := r.ts.taskDao.Save(t); err != nil {
+		r.finish(utils.TaskError, "", 0, err)
+		return
+	}
+	r.ts.hub.Broadcast(utils.TaskStatus{ID: t.ID, Status: utils.TaskRunning, Count: t.Count, Run: r.run.Number})
+
+	// 模板在执行时展开, 展开后的 YAML 记录在执行记录上
+	result := utils.ValidateTaskYAML(t.YAML, parseOptions(r.ts.templates))
+	if !result.Valid {
+		// YAML 解析失败 → error
+		r.finish(utils.TaskError, "", 0, &utils.YAMLError{Issues: result.Errors})
+		return
+	}
+	parsed := result.Parsed
+	r.run.YAML = result.Resolved
+
+	// 触发后任务可能被修改, 按执行时的参数声明重新校验
+	var values map[string]any
+	if len(r.run.Params) > 0 {
+		if err := json.Unmarshal(r.run.Params, &values); err != nil {
+			r.finish(utils.TaskError, "", 0, fmt.Errorf("%w: %w", ErrInvalidParams, err))
+			return
+		}
+	}
+	params, err := utils.ResolveParams(parsed.Params, values)
+	if err != nil {
+		r.finish(utils.TaskError, "", 0, fmt.Errorf("%w: %w", ErrInvalidParams, err))
+		return
+	}
+	r.params = params
+	utils.ApplyParams(parsed, r.params)
+
+	// 准备任务独立的工作目录
+	workDir, err := utils.PrepareWorkspace(t.ID, r.run.Number, parsed.Workspace)
+	if err != nil {
+		r.finish(utils.TaskError, "", 0, fmt.Errorf("准备工作目录失败: %w", err))
+		return
+	}
+	if parsed.Workspace == dto.WorkspaceFresh {
+		defer os.RemoveAll(workDir)
+	}
+	r.parsed, r.workDir = parsed, workDir
+	r.builtins = map[string]string{
+		"PUBOT_TASK_ID":      strconv.FormatUint(uint64(t.ID), 10),
+		"PUBOT_TASK_NAME":    t.Name,
+		"PUBOT_RUN_NUMBER":   strconv.Itoa(r.run.Number),
+		"PUBOT_TRIGGER":      r.run.Trigger,
+		"PUBOT_TRIGGERED_BY": r.run.Username,
+		"PUBOT_WORKSPACE":    workDir,
+	}
+	maps.Copy(r.builtins, utils.ParamsEnv(r.params))
+	r.output("", 0, utils.StreamSystem, "==> 工作目录 "+workDir)
+
+	taskCtx, cancel := utils.WithTimeout(r.ctx, parsed.Timeout, "任务")
+	defer cancel()
+
+	// 2️⃣ 按依赖关系执行各个阶段
+	status, stageName, step, runErr := utils.TaskSuccess, "", 0, error(nil)
+	if failed := r.runStages(taskCtx); failed != nil {
+		status, stageName, step, runErr = failureStatus(r.ctx, failed.err), failed.stage.Name, failedStep(failed.err), failed.err
+	}
+
+	// 3️⃣ 无论结果如何都执行任务的 finally 步骤, finally 失败时成功的执行也算失败
+	if len(parsed.Finally) > 0 {
+		start := time.Now()
+		env := r.stageEnv(dto.FinallyStage, nil)
+		// 任务的 finally 不属于任何阶段, 总是在 pubot 所在的机器上执行
+		steps, finallyStatus, finallyErr := r.runFinally(taskCtx, dto.FinallyStage, executor.Local{}, dto.Stage{Name: dto.FinallyStage}, nil, parsed.Finally, 0, env, status)
+		r.finally = &dto.StageResult{
+			Name:      dto.FinallyStage,
+			Status:    string(finallyStatus),
+			StartedAt: &start,
+			Duration:  time.Since(start).Milliseconds(),
+			Steps:     steps,
+		}
+		r.saveResult()
+		if finallyErr != nil && runErr == nil {
+			status, stageName, step, runErr = finallyStatus, dto.FinallyStage, failedStep(finallyErr), finallyErr
+		}
+	}
+
+	r.finish(status, stageName, step, runErr)
+}
+
+// failedStep 失败步骤的序号, 不是步骤失败时为 0
+func failedStep(err error) int {
+	var stepErr *utils.StepError
+	if errors.As(err, &stepErr) {
+		return stepErr.Index
+	}
+	return 0
+}
+
+// saveResult 按阶段定义的顺序保存已完成阶段的执行结果, 任务的 finally 步骤在最后
+// 同时统计记为警告的步骤和目标主机数
+func (r *runner) saveResult() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stages := make([]dto.StageResult, 0, len(r.nodes)+1)
+	for _, n := range r.nodes {
+		if n.finished {
+			stages = append(stages, n.result)
+		}
+	}
+	if r.finally != nil {
+		stages = append(stages, *r.finally)
+	}
+	r.run.Warnings = 0
+	var countWarnings func(stages []dto.StageResult)
+	countWarnings = func(stages []dto.StageResult) {
+		for _, stage := range stages {
+			if stage.Status == string(utils.TaskWarning) {
+				// 失败但没有超过 max_failures 的目标主机
+				r.run.Warnings++
+			}
+			for _, step := range stage.Steps {
+				if step.Status == string(utils.TaskWarning) {
+					r.run.Warnings++
+				}
+			}
+			countWarnings(stage.Cells)
+			countWarnings(stage.Hosts)
+		}
+	}
+	countWarnings(stages)
+	result, err := json.Marshal(stages)
+	if err != nil {
+		slog.Error("序列化执行结果失败", slog.String("Err", err.Error()))
+		return
+	}
+	r.run.Result = result
+	if err := r.ts.runDao.Save(r.run); err != nil {
+		slog.Error("保存执行记录失败", slog.Uint64("TaskID", uint64(r.task.ID)), slog.Int("Run", r.run.Number), slog.String("Err", err.Error()))
+	}
+}
+
+// failureStatus 根据失败原因区分超时、取消和普通失败
+func failureStatus(ctx context.Context, err error) utils.TaskStatusEnum {
+	switch {
+	case errors.Is(context.Cause(ctx), ErrShutdown):
+		return utils.TaskInterrupted
+	case errors.Is(err, utils.ErrTimeout):
+		return utils.TaskTimeout
+	case ctx.Err() != nil:
+		// 被取消, 剩余步骤和阶段都不再执行
+		return utils.TaskCanceled
+	default:
+		return utils.TaskError
+	}
+}
+
+// output 将一行输出写入执行日志, 并推送给实时日志订阅者
+func (r *runner) output(stageName string, step int, stream, text string) {
+	line := utils.LogLine{
+		Run:    r.run.Number,
+		Time:   time.Now(),
+		Stream: stream,
+		Stage:  stageName,
+		Step:   step,
+		Text:   text,
+	}
+	if r.log != nil {
+		if err := r.log.Write(line); err != nil {
+			slog.Error("写入执行日志失败", slog.Uint64("TaskID", uint64(r.task.ID)), slog.String("Err", err.Error()))
+		}
+	}
+	r.ts.logs.Publish(r.task.ID, line)
+}
+
+// status 执行中的状态, 有会话在等待空闲执行机器时为 queued, 否则为 running
+func (r *runner) status() utils.TaskStatusEnum {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return utils.TaskStatusEnum(r.run.Status)
+}
+
+// broadcastRetry 广播重试进度, step 为 0 表示重新执行整个阶段
+func (r *runner) broadcastRetry(stageName string, step, attempt, attempts int) {
+	r.ts.hub.Broadcast(utils.TaskStatus{
+		ID:     r.task.ID,
+		Status: r.status(),
+		Count:  r.task.Count,
+		Run:    r.run.Number,
+		Retry:  &utils.RetryStatus{Stage: stageName, Step: step, Attempt: attempt, Attempts: attempts},
+	})
+}
+
+// broadcastCell 广播矩阵组合的状态
+func (r *runner) broadcastCell(stageName, name string, cell utils.MatrixCell, status utils.TaskStatusEnum) {
+	r.ts.hub.Broadcast(utils.TaskStatus{
+		ID:     r.task.ID,
+		Status: r.status(),
+		Count:  r.task.Count,
+		Run:    r.run.Number,
+		Cell:   &utils.CellStatus{Stage: stageName, Name: name, Matrix: cell.Values, Status: status},
+	})
+}
+
+// broadcastRollout 广播目标主机的执行进度
+func (r *runner) broadcastRollout(progress utils.RolloutStatus) {
+	r.ts.hub.Broadcast(utils.TaskStatus{
+		ID:      r.task.ID,
+		Status:  r.status(),
+		Count:   r.task.Count,
+		Run:     r.run.Number,
+		Rollout: &progress,
+	})
+}
+
+// waitQueue 阶段的会话开始或结束等待空闲的执行机器并广播
+// 有会话在等待时执行记录和任务的状态为 queued, 都分配到执行机器后恢复为 running
+func (r *runner) waitQueue(stageName string, runsOn []string, queued bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stage := utils.TaskRunning
+	if queued {
+		stage = utils.TaskQueued
+		r.waiting++
+	} else {
+		r.waiting--
+	}
+	status := utils.TaskRunning
+	if r.waiting > 0 {
+		status = utils.TaskQueued
+	}
+	if r.run.Status != string(status) {
+		r.run.Status, r.task.Status = string(status), string(status)
+		if err := r.ts.runDao.Save(r.run); err != nil {
+			slog.Error("保存执行记录失败", slog.Uint64("TaskID", uint64(r.task.ID)), slog.Int("Run", r.run.Number), slog.String("Err", err.Error()))
+		}
+		if err := r.ts.taskDao.Save(r.task); err != nil {
+			slog.Error("保存任务状态失败", slog.Uint64("TaskID", uint64(r.task.ID)), slog.String("Err", err.Error()))
+		}
+	}
+	r.ts.hub.Broadcast(utils.TaskStatus{
+		ID:     r.task.ID,
+		Status: status,
+		Count:  r.task.Count,
+		Run:    r.run.Number,
+		Queue:  &utils.QueueStatus{Stage: stageName, RunsOn: runsOn, Status: stage},
+	})
+}
+
+// finish 持久化执行记录和任务状态, 并广播最终状态
+func (r *runner) finish(status utils.TaskStatusEnum, stageName string, step int, runErr error) {
+	t, run := r.task, r.run
+	now := time.Now()
+	run.Status = string(status)
+	run.FailedStage = stageName
+	run.FailedStep = step
+	run.FinishedAt = &now
+	if run.StartedAt != nil {
+		run.Duration = now.Sub(*run.StartedAt).Milliseconds()
+	}
+	if runErr != nil {
+		run.Error = runErr.Error()
+		r.output(stageName, step, utils.StreamSystem, "执行失败: "+run.Error)
+	}
+	r.output("", 0, utils.StreamSystem, "==> 执行结束: "+run.Status)
+	if err := r.ts.runDao.Save(run); err != nil {
+		slog.Error("保存执行记录失败", slog.Uint64("TaskID", uint64(t.ID)), slog.Int("Run", run.Number), slog.String("Err", err.Error()))
+	}
+
+	t.Count++
+	t.Status = string(status)
+	if err := r.ts.taskDao.Save(t); err != nil {
+		// 保存失败 → error
+		slog.Error("保存任务状态失败", slog.Uint64("TaskID", uint64(t.ID)), slog.String("Err", err.Error()))
+		status = utils.TaskError
+	}
+	r.ts.hub.Broadcast(utils.TaskStatus{ID: t.ID, Status: status, Count: t.Count, Run: run.Number})
+}
@@ -0,0 +1,361 @@
+package service
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"pubot/internal/dto"
+	"pubot/internal/model"
+	"pubot/internal/utils"
+)
+
+// createYAMLTask 创建使用 text 作为 YAML 的任务
+func createYAMLTask(t *testing.T, ts *TaskService, name, text string) *model.PbTask {
+	t.Helper()
+	task := &model.PbTask{Name: name, YAML: text, Status: string(utils.TaskStopped)}
+	if err := ts.taskDao.Create(task); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+// executeNow 触发任务并立即在当前协程中执行, 返回执行结束后的执行记录
+func executeNow(t *testing.T, ts *TaskService, task *model.PbTask, user *model.PbUser, params map[string]any) *model.PbTaskRun {
+	t.Helper()
+	run, err := ts.Execute(task.ID, model.TriggerManual, user, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := startNext(t, ts)
+	if j.run.ID != run.ID {
+		t.Fatalf("开始的执行为 #%d, 期望 #%d", j.run.Number, run.Number)
+	}
+	ts.runJob(j)
+	got, err := ts.GetRun(task.ID, run.Number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func TestRunHistory(t *testing.T) {
+	ts := newTestTaskService(t)
+	task := createYAMLTask(t, ts, "history", `name: history
+stages:
+  - name: build
+    steps: [echo build]
+  - name: deploy
+    needs: [build]
+    steps:
+      - echo deploy
+      - exit 2
+`)
+	alice := &model.PbUser{ID: 7, Name: "alice", Role: "user"}
+	first := executeNow(t, ts, task, alice, nil)
+	second := executeNow(t, ts, task, nil, nil)
+
+	if first.Number != 1 || second.Number != 2 {
+		t.Fatalf("执行序号为 %d、%d, 期望 1、2", first.Number, second.Number)
+	}
+	if first.Trigger != model.TriggerManual || first.UserID != alice.ID || first.Username != alice.Name {
+		t.Fatalf("触发信息为 %s %d %s", first.Trigger, first.UserID, first.Username)
+	}
+	if second.UserID != 0 || second.Username != "" {
+		t.Fatalf("没有用户的触发记录了用户 %d %s", second.UserID, second.Username)
+	}
+	if first.Status != string(utils.TaskError) || first.FailedStage != "deploy" || first.FailedStep != 2 || first.Error == "" {
+		t.Fatalf("结果为 %s, 失败于 %s 步骤 %d, 错误 %q", first.Status, first.FailedStage, first.FailedStep, first.Error)
+	}
+	if first.StartedAt == nil || first.FinishedAt == nil || first.FinishedAt.Before(*first.StartedAt) || first.Duration < 0 {
+		t.Fatalf("开始 %v, 结束 %v, 耗时 %d", first.StartedAt, first.FinishedAt, first.Duration)
+	}
+	if len(first.Result) == 0 || first.YAML != task.YAML {
+		t.Fatalf("没有记录执行结果或执行时的 YAML: %s", first.Result)
+	}
+
+	runs, err := ts.ListRuns(task.ID, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 || runs[0].Number != 2 || runs[1].Number != 1 {
+		t.Fatalf("执行记录列表应按序号倒序: %+v", runs)
+	}
+	if runs, _ := ts.ListRuns(task.ID, 1, 1); len(runs) != 1 || runs[0].Number != 1 {
+		t.Fatalf("分页的执行记录为 %+v", runs)
+	}
+	updated, err := ts.taskDao.GetByID(task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Count != 2 || updated.Status != string(utils.TaskError) {
+		t.Fatalf("任务的执行次数为 %d, 状态为 %s", updated.Count, updated.Status)
+	}
+}
+
+func TestRunLogStored(t *testing.T) {
+	ts := newTestTaskService(t)
+	task := createYAMLTask(t, ts, "logs", `name: logs
+stages:
+  - name: build
+    steps:
+      - echo out
+      - echo err >&2
+`)
+	run := executeNow(t, ts, task, nil, nil)
+
+	page, err := ts.GetRunLog(task.ID, run.Number, 0, 100, 0, utils.LogFilter{Stage: "build"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range page.Lines {
+		if line.Stream != utils.StreamSystem {
+			got = append(got, fmt.Sprintf("%s %d %s", line.Stream, line.Step, line.Text))
+		}
+		if line.Time.IsZero() || line.Run != run.Number {
+			t.Fatalf("日志行缺少时间或执行序号: %+v", line)
+		}
+	}
+	if strings.Join(got, "\n") != "stdout 1 out\nstderr 2 err" {
+		t.Fatalf("build 阶段的输出为:\n%s", strings.Join(got, "\n"))
+	}
+	tail, err := ts.GetRunLog(task.ID, run.Number, 0, 0, 1, utils.LogFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tail.Lines) != 1 || tail.Lines[0].Text != "==> 执行结束: success" {
+		t.Fatalf("最后一行为 %+v", tail.Lines)
+	}
+
+	f, err := ts.OpenRunLog(task.ID, run.Number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "\tstderr\tbuild\t2\terr\n") {
+		t.Fatalf("原始日志为:\n%s", data)
+	}
+}
+
+func TestRunTimeouts(t *testing.T) {
+	tests := []struct {
+		name  string
+		yaml  string
+		scope string
+	}{
+		{"步骤超时", `name: timeout
+stages:
+  - name: build
+    steps:
+      - run: sleep 30
+        timeout: 200ms
+`, "步骤"},
+		{"阶段超时", `name: timeout
+stages:
+  - name: build
+    timeout: 200ms
+    steps: [sleep 30]
+`, "阶段"},
+		{"任务超时", `name: timeout
+timeout: 200ms
+stages:
+  - name: build
+    steps: [sleep 30]
+`, "任务"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestTaskService(t)
+			task := createYAMLTask(t, ts, "timeout", tt.yaml)
+			start := time.Now()
+			run := executeNow(t, ts, task, nil, nil)
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Fatalf("超时后 %s 才结束", elapsed)
+			}
+			if run.Status != string(utils.TaskTimeout) || run.FailedStage != "build" || run.FailedStep != 1 {
+				t.Fatalf("结果为 %s, 失败于 %s 步骤 %d", run.Status, run.FailedStage, run.FailedStep)
+			}
+			if !strings.Contains(run.Error, tt.scope) {
+				t.Fatalf("错误 %q 中没有超时范围 %q", run.Error, tt.scope)
+			}
+		})
+	}
+}
+
+func TestRunWorkspace(t *testing.T) {
+	tests := []struct {
+		policy string
+		kept   bool // 执行结束后工作目录是否保留
+	}{
+		{dto.WorkspaceReuse, true},
+		{dto.WorkspaceClean, true},
+		{dto.WorkspaceFresh, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			ts := newTestTaskService(t)
+			task := createYAMLTask(t, ts, "workspace", `name: workspace
+workspace: `+tt.policy+`
+stages:
+  - name: build
+    steps:
+      - test "$PWD" = "$PUBOT_WORKSPACE"
+      - touch built
+`)
+			defer utils.RemoveWorkspace(task.ID)
+			run := executeNow(t, ts, task, nil, nil)
+			if run.Status != string(utils.TaskSuccess) {
+				t.Fatalf("执行结果为 %s: %s", run.Status, run.Error)
+			}
+			kept := false
+			filepath.WalkDir(utils.TaskWorkspace(task.ID), func(path string, d fs.DirEntry, err error) error {
+				kept = kept || (err == nil && d.Name() == "built")
+				return nil
+			})
+			if kept != tt.kept {
+				t.Fatalf("执行结束后工作目录保留 %v, 期望 %v", kept, tt.kept)
+			}
+		})
+	}
+}
+
+// workspaceFiles 任务复用的工作目录中的文件名
+func workspaceFiles(t *testing.T, taskID uint) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(utils.TaskWorkspace(taskID), "workspace"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestRunFinally(t *testing.T) {
+	tests := []struct {
+		name        string
+		yaml        string
+		status      utils.TaskStatusEnum
+		failedStage string
+		failedStep  int
+		warnings    int
+		files       []string // 执行结束后工作目录中的文件
+	}{
+		{"失败后执行 finally", `name: finally
+stages:
+  - name: build
+    steps: [exit 1, touch never]
+    finally:
+      - touch stage-$PUBOT_STATUS
+      - run: touch stage-failure
+        if: failure()
+      - run: touch stage-success
+        if: success()
+finally:
+  - touch task-$PUBOT_STATUS
+`, utils.TaskError, "build", 1, 0, []string{"stage-error", "stage-failure", "task-error"}},
+		{"超时后执行 finally", `name: finally
+stages:
+  - name: build
+    timeout: 200ms
+    steps: [sleep 30]
+    post: [touch stage-$PUBOT_STATUS]
+`, utils.TaskTimeout, "build", 1, 0, []string{"stage-timeout"}},
+		{"finally 失败时执行失败", `name: finally
+stages:
+  - name: build
+    steps: [touch built]
+finally:
+  - exit 2
+  - touch task-$PUBOT_STATUS
+`, utils.TaskError, dto.FinallyStage, 1, 0, []string{"built", "task-success"}},
+		{"阶段 finally 的步骤序号接在步骤之后", `name: finally
+stages:
+  - name: build
+    steps: [touch built]
+    finally: [exit 2]
+`, utils.TaskError, "build", 2, 0, []string{"built"}},
+		{"continue_on_error 记为警告", `name: finally
+stages:
+  - name: build
+    steps:
+      - run: exit 3
+        continue_on_error: true
+      - touch built
+finally:
+  - touch task-$PUBOT_STATUS
+`, utils.TaskSuccess, "", 0, 1, []string{"built", "task-success"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestTaskService(t)
+			task := createYAMLTask(t, ts, "finally", tt.yaml)
+			defer utils.RemoveWorkspace(task.ID)
+			run := executeNow(t, ts, task, nil, nil)
+			if run.Status != string(tt.status) || run.FailedStage != tt.failedStage || run.FailedStep != tt.failedStep {
+				t.Fatalf("结果为 %s, 失败于 %q 步骤 %d, 期望 %s %q 步骤 %d: %s",
+					run.Status, run.FailedStage, run.FailedStep, tt.status, tt.failedStage, tt.failedStep, run.Error)
+			}
+			if run.Warnings != tt.warnings {
+				t.Fatalf("警告数为 %d, 期望 %d", run.Warnings, tt.warnings)
+			}
+			if got := workspaceFiles(t, task.ID); !slices.Equal(got, tt.files) {
+				t.Fatalf("工作目录中的文件为 %v, 期望 %v", got, tt.files)
+			}
+		})
+	}
+}
+
+func TestRunFinallyAfterCancel(t *testing.T) {
+	ts := newTestTaskService(t)
+	task := createYAMLTask(t, ts, "finally", `name: finally
+stages:
+  - name: build
+    steps: [sleep 30]
+    finally: [touch stage-$PUBOT_STATUS]
+finally:
+  - run: touch task-canceled
+    if: canceled()
+`)
+	defer utils.RemoveWorkspace(task.ID)
+	alice := &model.PbUser{ID: 1, Name: "alice", Role: "user"}
+	run, err := ts.Execute(task.ID, model.TriggerManual, alice, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := startNext(t, ts)
+	_, lines, unsubscribe := ts.logs.Subscribe(task.ID)
+	defer unsubscribe()
+	go func() {
+		for line := range lines {
+			if line.Stage == "build" && line.Step == 1 {
+				ts.Cancel(task.ID, alice)
+				return
+			}
+		}
+	}()
+	ts.runJob(j)
+	got, err := ts.GetRun(task.ID, run.Number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != string(utils.TaskCanceled) {
+		t.Fatalf("执行结果为 %s, 期望 canceled", got.Status)
+	}
+	if files, want := workspaceFiles(t, task.ID), []string{"stage-canceled", "task-canceled"}; !slices.Equal(files, want) {
+		t.Fatalf("工作目录中的文件为 %v, 期望 %v", files, want)
+	}
+}
@@ -0,0 +1,241 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"pubot/internal/model"
+	"pubot/internal/utils"
+)
+
+var (
+	ErrRunNotActive  = errors.New("任务没有正在进行的执行")
+	ErrForbidden     = errors.New("没有权限操作该任务")
+	ErrTaskBusy      = errors.New("任务正在执行或排队中")
+	ErrShutdown      = errors.New("pubot 正在关闭")
+	ErrInvalidParams = errors.New("触发参数无效")
+)
+
+// job 排队或正在进行的一次执行
+type job struct {
+	taskID uint
+	// 执行期间 run 会被保存执行记录改写, 取消和关闭时只读取下面两个副本
+	number int  // 执行序号
+	userID uint // 触发用户
+	run    *model.PbTaskRun
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+}
+
+// runQueue 执行队列
+// 全局同时最多 workers 个执行, 同一任务同一时间只有一个执行, 其余按触发顺序排队
+type runQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []*job
+	active  map[uint]*job // key 为任务ID
+	running sync.WaitGroup
+	closed  bool // 关闭后不再接收和开始新的执行
+}
+
+func newRunQueue() *runQueue {
+	q := &runQueue{active: make(map[uint]*job)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// next 取出下一个所属任务空闲的 job, 没有则等待, 队列关闭后返回 nil
+func (q *runQueue) next() *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.closed {
+		for i, j := range q.pending {
+			if _, busy := q.active[j.taskID]; !busy {
+				q.pending = append(q.pending[:i], q.pending[i+1:]...)
+				q.active[j.taskID] = j
+				q.running.Add(1)
+				return j
+			}
+		}
+		q.cond.Wait()
+	}
+	return nil
+}
+
+// done 执行结束, 唤醒等待同一任务的 job
+func (q *runQueue) done(j *job) {
+	q.mu.Lock()
+	delete(q.active, j.taskID)
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	q.running.Done()
+}
+
+// wait 等待正在进行的执行全部结束, ctx 结束时返回 false
+func (q *runQueue) wait(ctx context.Context) bool {
+	finished := make(chan struct{})
+	go func() {
+		q.running.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// jobsOf 返回任务正在进行和排队的 job, 调用方需持有锁
+func (q *runQueue) jobsOf(taskID uint) (*job, []*job) {
+	var pending []*job
+	for _, j := range q.pending {
+		if j.taskID == taskID {
+			pending = append(pending, j)
+		}
+	}
+	return q.active[taskID], pending
+}
+
+// remove 从排队中移除 job, 调用方需持有锁
+func (q *runQueue) remove(target *job) {
+	for i, j := range q.pending {
+		if j == target {
+			q.pending = append(q.pending[:i], q.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// worker 不断从队列取出 job 执行, 队列关闭后退出
+func (ts *TaskService) worker() {
+	for {
+		j := ts.queue.next()
+		if j == nil {
+			return
+		}
+		ts.runJob(j)
+	}
+}
+
+// enqueue 将执行记录放入队列, 调用方需持有锁
+func (ts *TaskService) enqueue(run *model.PbTaskRun) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+	ts.queue.pending = append(ts.queue.pending, &job{taskID: run.TaskID, number: run.Number, userID: run.UserID, run: run, ctx: ctx, cancel: cancel})
+	ts.queue.cond.Signal()
+}
+
+// Recover 启动时处理上次退出遗留的执行
+// running 的执行已经随进程结束, 标记为 interrupted; 还没有开始的 queued 执行重新排队
+// 开始后等待执行机器的执行也是 queued, 已经执行了部分阶段, 同样标记为 interrupted
+func (ts *TaskService) Recover() error {
+	runs, err := ts.runDao.ListByStatus(string(utils.TaskRunning), string(utils.TaskQueued))
+	if err != nil {
+		return err
+	}
+	requeued := make(map[uint]bool)
+	ts.queue.mu.Lock()
+	for i := range runs {
+		run := &runs[i]
+		if run.Status == string(utils.TaskQueued) && run.StartedAt == nil {
+			ts.enqueue(run)
+			requeued[run.TaskID] = true
+			slog.Info("重新排队执行", slog.Uint64("TaskID", uint64(run.TaskID)), slog.Int("Run", run.Number))
+			continue
+		}
+		now := time.Now()
+		run.Status = string(utils.TaskInterrupted)
+		run.Error = "pubot 重启导致执行中断"
+		run.FinishedAt = &now
+		if run.StartedAt != nil {
+			run.Duration = now.Sub(*run.StartedAt).Milliseconds()
+		}
+		if err := ts.runDao.Save(run); err != nil {
+			slog.Error("保存执行记录失败", slog.Uint64("TaskID", uint64(run.TaskID)), slog.Int("Run", run.Number), slog.String("Err", err.Error()))
+		}
+		slog.Warn("执行被中断", slog.Uint64("TaskID", uint64(run.TaskID)), slog.Int("Run", run.Number))
+	}
+	ts.queue.mu.Unlock()
+
+	tasks, err := ts.taskDao.GetByStatus(string(utils.TaskRunning), string(utils.TaskQueued))
+	if err != nil {
+		return err
+	}
+	for i := range tasks {
+		t := &tasks[i]
+		if requeued[t.ID] {
+			t.Status = string(utils.TaskQueued)
+		} else {
+			t.Status = string(utils.TaskInterrupted)
+		}
+		if err := ts.taskDao.Save(t); err != nil {
+			slog.Error("保存任务状态失败", slog.Uint64("TaskID", uint64(t.ID)), slog.String("Err", err.Error()))
+		}
+	}
+	return nil
+}
+
+// Shutdown 停止接收新的执行, 等待正在进行的执行结束
+// ctx 结束时仍未完成的执行(包括 finally 步骤)会被杀掉并标记为 interrupted, 排队的执行留待下次启动
+// 返回 nil 时所有执行记录都已保存, 可以安全关闭数据库连接
+func (ts *TaskService) Shutdown(ctx context.Context) error {
+	q := ts.queue
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	if q.wait(ctx) {
+		return nil
+	}
+
+	ts.haltRuns(ErrShutdown)
+	q.mu.Lock()
+	for _, j := range q.active {
+		slog.Warn("强制结束执行", slog.Uint64("TaskID", uint64(j.taskID)), slog.Int("Run", j.number))
+		j.cancel(ErrShutdown)
+	}
+	q.mu.Unlock()
+	// 杀掉进程后等待执行记录保存完成
+	killCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if !q.wait(killCtx) {
+		return errors.New("等待执行结束超时")
+	}
+	return nil
+}
+
+func (ts *TaskService) runJob(j *job) {
+	defer ts.queue.done(j)
+	defer j.cancel(nil)
+	// 排队期间任务可能被修改, 以执行时的任务为准
+	t, err := ts.taskDao.GetByID(j.taskID)
+	if err != nil {
+		ts.drop(j, utils.TaskError, err)
+		return
+	}
+	ts.run(j.ctx, t, j.run)
+}
+
+// drop 结束一个还没开始执行的 job, 不改变任务本身的状态
+func (ts *TaskService) drop(j *job, status utils.TaskStatusEnum, cause error) {
+	now := time.Now()
+	run := j.run
+	run.Status = string(status)
+	run.FinishedAt = &now
+	if cause != nil {
+		run.Error = cause.Error()
+	}
+	if err := ts.runDao.Save(run); err != nil {
+		slog.Error("保存执行记录失败", slog.Uint64("TaskID", uint64(j.taskID)), slog.Int("Run", run.Number), slog.String("Err", err.Error()))
+	}
+	event := utils.TaskStatus{ID: j.taskID, Status: status, Run: run.Number}
+	if t, err := ts.taskDao.GetByID(j.taskID); err == nil {
+		// 广播任务当前的状态, 避免覆盖正在进行的执行
+		event.Status = utils.TaskStatusEnum(t.Status)
+		event.Count = t.Count
+	}
+	ts.hub.Broadcast(event)
+}
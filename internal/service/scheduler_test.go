@@ -0,0 +1,201 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"pubot/internal/model"
+	"pubot/internal/utils"
+)
+
+// createTestTask 创建使用并发策略 policy 的任务, policy 为空时使用默认策略
+func createTestTask(t *testing.T, ts *TaskService, name, policy string) *model.PbTask {
+	t.Helper()
+	text := "name: " + name + "\n"
+	if policy != "" {
+		text += "concurrency: " + policy + "\n"
+	}
+	text += "stages:\n  - name: build\n    steps:\n      - echo hi\n"
+	task := &model.PbTask{Name: name, YAML: text, Status: string(utils.TaskStopped)}
+	if err := ts.taskDao.Create(task); err != nil {
+		t.Fatal(err)
+	}
+	return task
+}
+
+// startNext 从队列中取出下一个 job, 相当于 worker 开始执行
+func startNext(t *testing.T, ts *TaskService) *job {
+	t.Helper()
+	got := make(chan *job, 1)
+	go func() { got <- ts.queue.next() }()
+	select {
+	case j := <-got:
+		return j
+	case <-time.After(time.Second):
+		t.Fatal("队列中没有可以开始的执行")
+		return nil
+	}
+}
+
+func runStatus(t *testing.T, ts *TaskService, run *model.PbTaskRun) string {
+	t.Helper()
+	got, err := ts.runDao.GetByNumber(run.TaskID, run.Number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got.Status
+}
+
+func TestConcurrencyQueue(t *testing.T) {
+	ts := newTestTaskService(t)
+	task := createTestTask(t, ts, "queue", "")
+
+	first, err := ts.Execute(task.ID, model.TriggerManual, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := startNext(t, ts)
+	if j.run.ID != first.ID {
+		t.Fatalf("开始的执行为 #%d, 期望 #%d", j.run.Number, first.Number)
+	}
+	second, err := ts.Execute(task.ID, model.TriggerManual, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Number != first.Number+1 {
+		t.Fatalf("执行序号为 %d, 期望 %d", second.Number, first.Number+1)
+	}
+	if j.ctx.Err() != nil {
+		t.Fatal("排队策略不应取消正在进行的执行")
+	}
+
+	// 同一任务的执行结束前, 第二次执行不能开始
+	other := createTestTask(t, ts, "other", "")
+	if _, err := ts.Execute(other.ID, model.TriggerManual, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if next := startNext(t, ts); next.taskID != other.ID {
+		t.Fatalf("开始的执行属于任务 %d, 期望任务 %d", next.taskID, other.ID)
+	}
+	ts.queue.done(j)
+	if next := startNext(t, ts); next.run.ID != second.ID {
+		t.Fatalf("开始的执行为 #%d, 期望 #%d", next.run.Number, second.Number)
+	}
+}
+
+func TestConcurrencyReject(t *testing.T) {
+	ts := newTestTaskService(t)
+	task := createTestTask(t, ts, "reject", "reject")
+
+	if _, err := ts.Execute(task.ID, model.TriggerManual, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// 排队中和执行中都拒绝新的触发
+	if _, err := ts.Execute(task.ID, model.TriggerManual, nil, nil); !errors.Is(err, ErrTaskBusy) {
+		t.Fatalf("排队中再次触发返回 %v, 期望 ErrTaskBusy", err)
+	}
+	j := startNext(t, ts)
+	if _, err := ts.Execute(task.ID, model.TriggerManual, nil, nil); !errors.Is(err, ErrTaskBusy) {
+		t.Fatalf("执行中再次触发返回 %v, 期望 ErrTaskBusy", err)
+	}
+	ts.queue.done(j)
+	if _, err := ts.Execute(task.ID, model.TriggerManual, nil, nil); err != nil {
+		t.Fatalf("上一次执行结束后触发失败: %v", err)
+	}
+}
+
+func TestConcurrencyCancelInProgress(t *testing.T) {
+	ts := newTestTaskService(t)
+	task := createTestTask(t, ts, "cancel", "cancel-in-progress")
+
+	if _, err := ts.Execute(task.ID, model.TriggerManual, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	active := startNext(t, ts)
+	pending, err := ts.Execute(task.ID, model.TriggerManual, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active.ctx.Err() == nil {
+		t.Fatal("正在进行的执行没有被取消")
+	}
+	latest, err := ts.Execute(task.ID, model.TriggerManual, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := runStatus(t, ts, pending); got != string(utils.TaskCanceled) {
+		t.Fatalf("被取代的排队执行状态为 %s, 期望 %s", got, utils.TaskCanceled)
+	}
+	if got := runStatus(t, ts, latest); got != string(utils.TaskQueued) {
+		t.Fatalf("最新的执行状态为 %s, 期望 %s", got, utils.TaskQueued)
+	}
+
+	// 被取消的执行结束后只剩最新的执行
+	ts.queue.done(active)
+	if next := startNext(t, ts); next.run.ID != latest.ID {
+		t.Fatalf("开始的执行为 #%d, 期望 #%d", next.run.Number, latest.Number)
+	}
+	ts.queue.mu.Lock()
+	left := len(ts.queue.pending)
+	ts.queue.mu.Unlock()
+	if left != 0 {
+		t.Fatalf("队列中还有 %d 个执行", left)
+	}
+}
+
+func TestShutdownRejectsNewRuns(t *testing.T) {
+	ts := newTestTaskService(t)
+	task := createTestTask(t, ts, "shutdown", "")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := ts.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Execute(task.ID, model.TriggerManual, nil, nil); !errors.Is(err, ErrShutdown) {
+		t.Fatalf("关闭后触发返回 %v, 期望 ErrShutdown", err)
+	}
+}
+
+func TestRunQueuedWhileWaiting(t *testing.T) {
+	ts := newTestTaskService(t)
+	task := createTestTask(t, ts, "demo", "")
+	now := time.Now()
+	run := &model.PbTaskRun{TaskID: task.ID, Trigger: model.TriggerManual, Status: string(utils.TaskRunning), StartedAt: &now}
+	if err := ts.runDao.Create(run); err != nil {
+		t.Fatal(err)
+	}
+	task.Status = string(utils.TaskRunning)
+	r := &runner{ts: ts, task: task, run: run}
+
+	check := func(want utils.TaskStatusEnum) {
+		t.Helper()
+		if got := runStatus(t, ts, run); got != string(want) {
+			t.Fatalf("执行记录的状态为 %s, 期望 %s", got, want)
+		}
+		got, err := ts.taskDao.GetByID(task.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Status != string(want) {
+			t.Fatalf("任务的状态为 %s, 期望 %s", got.Status, want)
+		}
+	}
+	r.waitQueue("build", []string{"gpu"}, true)
+	check(utils.TaskQueued)
+	r.waitQueue("test", []string{"gpu"}, true)
+	r.waitQueue("build", []string{"gpu"}, false)
+	// 还有阶段在等待
+	check(utils.TaskQueued)
+	r.waitQueue("test", []string{"gpu"}, false)
+	check(utils.TaskRunning)
+
+	// 开始后等待执行机器的执行在重启后标记为 interrupted, 不重新执行
+	r.waitQueue("build", []string{"gpu"}, true)
+	if err := ts.Recover(); err != nil {
+		t.Fatal(err)
+	}
+	check(utils.TaskInterrupted)
+}
@@ -0,0 +1,481 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"pubot/internal/dto"
+	"pubot/internal/executor"
+	"pubot/internal/utils"
+)
+
+// stageNode 阶段依赖图中的节点
+// started/finished 只在 runStages 所在协程中读写, result/err 由执行阶段的协程写入, 结束后才被读取
+type stageNode struct {
+	stage    dto.Stage
+	needs    []*stageNode
+	started  bool
+	finished bool
+	result   dto.StageResult
+	err      error
+}
+
+// runStages 依赖都成功的阶段立即开始, 互不依赖的阶段并发执行
+// 依赖失败或被跳过的阶段不再执行, 返回第一个失败的阶段
+func (r *runner) runStages(ctx context.Context) *stageNode {
+	byName := make(map[string]*stageNode, len(r.parsed.Stages))
+	r.nodes = make([]*stageNode, 0, len(r.parsed.Stages))
+	for _, s := range r.parsed.Stages {
+		n := &stageNode{stage: s}
+		byName[s.Name] = n
+		r.nodes = append(r.nodes, n)
+	}
+	for _, n := range r.nodes {
+		for _, need := range n.stage.Needs {
+			n.needs = append(n.needs, byName[need])
+		}
+	}
+
+	var failed *stageNode
+	done := make(chan *stageNode)
+	running := 0
+	for {
+		// 启动所有依赖已结束的阶段, 跳过的阶段可能让后续阶段也变为可跳过, 所以循环到没有变化为止
+		for changed := true; changed; {
+			changed = false
+			for _, n := range r.nodes {
+				if n.started || !n.ready() {
+					continue
+				}
+				n.started = true
+				// 设置了 if 的阶段由条件决定是否执行, 否则依赖都成功才执行
+				if ctx.Err() != nil || (n.stage.If == "" && !n.depsSucceeded()) {
+					n.finished = true
+					n.result = n.skipped()
+					r.output(n.stage.Name, 0, utils.StreamSystem, "==> 跳过阶段 "+n.stage.Name)
+					changed = true
+					continue
+				}
+				running++
+				go func(n *stageNode) {
+					r.runStage(ctx, n)
+					done <- n
+				}(n)
+			}
+		}
+		if running == 0 {
+			break
+		}
+		n := <-done
+		running--
+		n.finished = true
+		if n.err != nil && failed == nil {
+			failed = n
+		}
+		r.saveResult()
+	}
+	r.saveResult()
+	return failed
+}
+
+// ready 依赖的阶段都已结束
+func (n *stageNode) ready() bool {
+	for _, need := range n.needs {
+		if !need.finished {
+			return false
+		}
+	}
+	return true
+}
+
+// depsSucceeded 依赖的阶段都执行成功
+func (n *stageNode) depsSucceeded() bool {
+	for _, need := range n.needs {
+		if need.result.Status != string(utils.TaskSuccess) {
+			return false
+		}
+	}
+	return true
+}
+
+// depsFailed 依赖的阶段(包括间接依赖)中有失败的阶段
+func (n *stageNode) depsFailed() bool {
+	for _, need := range n.needs {
+		switch need.result.Status {
+		case string(utils.TaskSuccess), string(utils.TaskSkipped):
+		default:
+			return true
+		}
+		if need.depsFailed() {
+			return true
+		}
+	}
+	return false
+}
+
+// skipped 阶段和其中的步骤都标记为跳过的执行结果
+func (n *stageNode) skipped() dto.StageResult {
+	return skippedResult(n.stage.Name, n.stage.Steps)
+}
+
+// skippedResult 没有执行的阶段(或矩阵组合、目标主机)的执行结果, 其中的步骤都标记为跳过
+func skippedResult(name string, steps []dto.Step) dto.StageResult {
+	result := dto.StageResult{Name: name, Status: string(utils.TaskSkipped)}
+	for i, step := range steps {
+		result.Steps = append(result.Steps, dto.StepResult{Index: i + 1, Run: step.Command(), Status: string(utils.TaskSkipped)})
+	}
+	return result
+}
+
+// stageDir 阶段步骤开始执行的目录, 设置了 working_directory 时为工作目录下的子目录
+func (r *runner) stageDir(s dto.Stage) string {
+	return filepath.Join(r.workDir, s.WorkingDir)
+}
+
+// exprContext 条件表达式的运行上下文, env 中可以读取 pubot 进程的环境变量
+// git 信息在第一次使用时从 dir 中读取, 目标主机和并行步骤会同时求值, 读取结果加锁缓存
+func (r *runner) exprContext(dir string, env []string) *utils.ExprContext {
+	env = utils.MergeEnv(os.Environ(), utils.EnvMap(env))
+	var mu sync.Mutex
+	git := make(map[string]string)
+	return &utils.ExprContext{
+		Trigger: r.run.Trigger,
+		Params:  r.params,
+		Env:     utils.EnvMap(env),
+		Git: func(key string) string {
+			mu.Lock()
+			defer mu.Unlock()
+			if v, ok := git[key]; ok {
+				return v
+			}
+			git[key] = utils.GitInfo(dir, env, key)
+			return git[key]
+		},
+	}
+}
+
+// runStage 在一个 bash 会话中执行阶段的全部步骤, 并行阶段的每个步骤使用独立的会话
+// 矩阵阶段按每个组合各执行一次
+func (r *runner) runStage(ctx context.Context, n *stageNode) {
+	s := n.stage
+	start := time.Now()
+	env := r.stageEnv(s.Name, s.Env)
+
+	exprCtx := r.exprContext(r.stageDir(s), env)
+	if s.If != "" {
+		// 依赖都已结束才会执行到这里, 读取依赖的状态不需要加锁
+		exprCtx.Success, exprCtx.Failure = n.depsSucceeded(), n.depsFailed()
+		ok, err := utils.EvalCondition(s.If, exprCtx)
+		if err != nil {
+			n.err = err
+			n.result = dto.StageResult{Name: s.Name, Status: string(utils.TaskError), StartedAt: &start}
+			return
+		}
+		if !ok {
+			r.output(s.Name, 0, utils.StreamSystem, "==> 跳过阶段 "+s.Name+" (if: "+s.If+")")
+			n.result = n.skipped()
+			return
+		}
+	}
+	if s.Matrix != nil {
+		n.result, n.err = r.runMatrix(ctx, s)
+		return
+	}
+	r.output(s.Name, 0, utils.StreamSystem, "==> 阶段 "+s.Name)
+	n.result, n.err = r.runTargets(ctx, s, s.Name, env, exprCtx)
+}
+
+// errMatrixFailFast 矩阵中有组合失败, 其余组合被取消
+var errMatrixFailFast = errors.New("矩阵中的其他组合失败")
+
+// runMatrix 并发执行矩阵的每个组合, 组合的结果记录在阶段结果的 Cells 中
+// 所有组合都成功时阶段成功, 否则阶段的状态和错误为第一个失败的组合的状态和错误
+func (r *runner) runMatrix(ctx context.Context, s dto.Stage) (dto.StageResult, error) {
+	start := time.Now()
+	m := s.Matrix
+	cells := utils.ExpandMatrix(m)
+	r.output(s.Name, 0, utils.StreamSystem, fmt.Sprintf("==> 阶段 %s, 矩阵共 %d 个组合", s.Name, len(cells)))
+
+	matrixCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	limit := m.MaxParallel
+	if limit <= 0 {
+		limit = len(cells)
+	}
+	sem := make(chan struct{}, limit)
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		firstErr error
+		status   = utils.TaskSuccess
+	)
+	results := make([]dto.StageResult, len(cells))
+	for i, cell := range cells {
+		name := s.Name + " (" + cell.Label() + ")"
+		cellStage := utils.ApplyMatrix(s, cell)
+		// 按组合的顺序依次开始, 同时执行的组合数不超过 max_parallel
+		acquired := false
+		select {
+		case sem <- struct{}{}:
+			acquired = true
+		case <-matrixCtx.Done():
+		}
+		if matrixCtx.Err() != nil {
+			// 已取消或有组合失败, 剩余的组合不再执行
+			if acquired {
+				<-sem
+			}
+			r.output(name, 0, utils.StreamSystem, "==> 跳过组合 "+name)
+			results[i] = skippedResult(name, cellStage.Steps)
+			results[i].Matrix = cell.Values
+			continue
+		}
+
+		wg.Add(1)
+		go func(i int, cell utils.MatrixCell, name string, cellStage dto.Stage) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r.output(name, 0, utils.StreamSystem, "==> 组合 "+name)
+			r.broadcastCell(s.Name, name, cell, utils.TaskRunning)
+			cellEnv := maps.Clone(cellStage.Env)
+			if cellEnv == nil {
+				cellEnv = make(map[string]string)
+			}
+			maps.Copy(cellEnv, cell.Env())
+			env := r.stageEnv(s.Name, cellEnv)
+			exprCtx := r.exprContext(r.stageDir(cellStage), env)
+			exprCtx.Matrix = cell.Values
+			result, err := r.runTargets(matrixCtx, cellStage, name, env, exprCtx)
+			r.broadcastCell(s.Name, name, cell, utils.TaskStatusEnum(result.Status))
+			result.Matrix = cell.Values
+			results[i] = result
+
+			if err == nil {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			// fail_fast 取消的组合不算作失败的原因
+			if firstErr == nil && !errors.Is(context.Cause(matrixCtx), errMatrixFailFast) {
+				firstErr, status = err, utils.TaskStatusEnum(result.Status)
+				if m.FailFast {
+					cancel(errMatrixFailFast)
+				}
+			}
+		}(i, cell, name, cellStage)
+	}
+	wg.Wait()
+	if firstErr == nil && ctx.Err() != nil {
+		firstErr, status = context.Cause(ctx), utils.StepStatus(ctx, ctx.Err())
+	}
+
+	return dto.StageResult{
+		Name:      s.Name,
+		Status:    string(status),
+		StartedAt: &start,
+		Duration:  time.Since(start).Milliseconds(),
+		Steps:     []dto.StepResult{},
+		Cells:     results,
+	}, firstErr
+}
+
+// executorFor 选择执行阶段的执行器, agent 执行器使用注入的执行机器池
+func (ts *TaskService) executorFor(s dto.Stage) (executor.Executor, error) {
+	ex, err := executor.ForStage(s)
+	if _, ok := ex.(executor.Agent); ok {
+		ex = executor.Agent{Pool: ts.agents}
+	}
+	return ex, err
+}
+
+// runJob 执行一次阶段(或矩阵中的一个组合、一台目标主机)的步骤, 包括阶段的重试和 finally 步骤
+// name 为日志和广播中使用的名称, host 为目标主机, 没有设置 hosts 时为空
+func (r *runner) runJob(ctx context.Context, s dto.Stage, name string, host *dto.Host, env []string, exprCtx *utils.ExprContext) (dto.StageResult, error) {
+	start := time.Now()
+	out := func(step int, stream, text string) {
+		r.output(name, step, stream, text)
+	}
+	ex, err := r.ts.executorFor(s)
+	if err != nil {
+		out(0, utils.StreamSystem, "==> "+err.Error())
+		return dto.StageResult{Name: name, Status: string(utils.TaskError), StartedAt: &start, Steps: []dto.StepResult{}}, err
+	}
+	if len(s.RunsOn) > 0 {
+		out(0, utils.StreamSystem, fmt.Sprintf("==> runs-on %v, 执行器 %s", s.RunsOn, ex.Name()))
+	} else if ex.Name() != executor.Default {
+		out(0, utils.StreamSystem, "==> 执行器 "+ex.Name())
+	}
+
+	// 步骤的条件只看本阶段之前的步骤是否失败
+	cond := func(step dto.Step, failed bool) (bool, error) {
+		c := *exprCtx
+		c.Success, c.Failure, c.Canceled = !failed, failed, ctx.Err() != nil
+		if len(step.Env) > 0 {
+			c.Env = maps.Clone(c.Env)
+			maps.Copy(c.Env, step.Env)
+		}
+		return utils.EvalCondition(step.If, &c)
+	}
+
+	hooks := utils.StepHooks{
+		Cond: cond,
+		Out:  out,
+		Retry: func(step, attempt, attempts int) {
+			r.broadcastRetry(name, step, attempt, attempts)
+		},
+	}
+
+	// 阶段失败后按阶段的 retry 重新执行整个阶段, 阶段超时对每次执行分别计算
+	attempts := s.Retry.MaxAttempts()
+	var (
+		steps   []dto.StepResult
+		status  utils.TaskStatusEnum
+		attempt int
+	)
+	for attempt = 1; ; attempt++ {
+		if attempt > 1 {
+			delay := s.Retry.DelayBefore(attempt)
+			r.output(name, 0, utils.StreamSystem, fmt.Sprintf("==> %s 后第 %d 次重新执行阶段 %s (共 %d 次)", delay, attempt-1, name, attempts-1))
+			r.broadcastRetry(name, 0, attempt, attempts)
+			if err = utils.Sleep(ctx, delay); err != nil {
+				// 等待重试时被取消或超时, 结果为取消或超时, 而不是上一次执行的失败
+				attempt--
+				status = failureStatus(ctx, err)
+				break
+			}
+		}
+		steps, status, err = r.runSteps(ctx, s, r.sessions(name, ex, s, host, env), hooks)
+		if err == nil || attempt >= attempts || ctx.Err() != nil || !s.Retry.RetriesOn(failedExitCode(steps, err)) {
+			break
+		}
+	}
+
+	// 阶段开始后无论成功、失败、取消还是超时都执行 finally 步骤, finally 失败时成功的阶段也算失败
+	if len(s.Finally) > 0 {
+		finally, finallyStatus, finallyErr := r.runFinally(ctx, name, ex, s, host, s.Finally, len(s.Steps), env, status)
+		steps = append(steps, finally...)
+		if finallyErr != nil && err == nil {
+			status, err = finallyStatus, finallyErr
+		}
+	}
+	return dto.StageResult{
+		Name:      name,
+		Status:    string(status),
+		StartedAt: &start,
+		Duration:  time.Since(start).Milliseconds(),
+		Attempts:  attempt,
+		Steps:     steps,
+	}, err
+}
+
+// stageEnv 阶段中由 pubot 设置的环境变量, 优先级: 步骤 > 阶段 > 任务, 内置变量不能被覆盖
+// pubot 进程的环境变量由执行器决定是否继承, 本机执行器会继承, 优先级最低
+func (r *runner) stageEnv(stageName string, env map[string]string) []string {
+	builtins := make(map[string]string, len(r.builtins)+1)
+	for k, v := range r.builtins {
+		builtins[k] = v
+	}
+	builtins["PUBOT_STAGE"] = stageName
+	return utils.MergeEnv(nil, r.parsed.Env, env, builtins)
+}
+
+// sessions 返回在执行器 ex 中为阶段 s 打开会话的函数, 会话的环境变量为 env
+// name 为日志和广播中使用的名称, 等待空闲的执行机器时执行的状态为 queued
+func (r *runner) sessions(name string, ex executor.Executor, s dto.Stage, host *dto.Host, env []string) utils.SessionOpener {
+	return func(ctx context.Context) (utils.Session, error) {
+		return ex.Open(ctx, executor.Spec{
+			Stage:   s,
+			Host:    host,
+			WorkDir: r.stageDir(s),
+			Env:     env,
+			Out: func(stream, text string) {
+				r.output(name, 0, stream, text)
+			},
+			Queued: func(queued bool) {
+				r.waitQueue(name, s.RunsOn, queued)
+			},
+		})
+	}
+}
+
+// runFinally 在执行器 ex 的新会话中执行 finally 步骤, 不受取消和超时影响, 最长执行 finallyTimeout
+// pubot 关闭时强制结束执行后 finally 步骤也会被取消
+// status 为阶段或任务此时的状态, 通过 PUBOT_STATUS 和状态函数提供给步骤
+// 一个步骤失败不影响后续的 finally 步骤, 步骤序号接在 offset 之后
+func (r *runner) runFinally(ctx context.Context, stageName string, ex executor.Executor, s dto.Stage, host *dto.Host, steps []dto.Step, offset int, env []string, status utils.TaskStatusEnum) ([]dto.StepResult, utils.TaskStatusEnum, error) {
+	r.output(stageName, 0, utils.StreamSystem, "==> finally ("+string(status)+")")
+	env = utils.MergeEnv(env, map[string]string{"PUBOT_STATUS": string(status)})
+	exprCtx := r.exprContext(r.stageDir(s), env)
+	exprCtx.Success = status == utils.TaskSuccess
+	exprCtx.Canceled = status == utils.TaskCanceled || status == utils.TaskInterrupted
+	exprCtx.Failure = !exprCtx.Success && !exprCtx.Canceled
+	hooks := utils.StepHooks{
+		Cond: func(step dto.Step, _ bool) (bool, error) {
+			c := *exprCtx
+			if len(step.Env) > 0 {
+				c.Env = maps.Clone(c.Env)
+				maps.Copy(c.Env, step.Env)
+			}
+			return utils.EvalFinallyCondition(step.If, &c)
+		},
+		Out: func(step int, stream, text string) {
+			r.output(stageName, offset+step, stream, text)
+		},
+		Retry: func(step, attempt, attempts int) {
+			r.broadcastRetry(stageName, offset+step, attempt, attempts)
+		},
+	}
+
+	haltCtx, halt := context.WithCancelCause(context.WithoutCancel(ctx))
+	defer halt(nil)
+	stop := context.AfterFunc(r.ts.halt, func() { halt(context.Cause(r.ts.halt)) })
+	defer stop()
+	finallyCtx, cancel := context.WithTimeoutCause(haltCtx, finallyTimeout,
+		fmt.Errorf("finally %w(%s)", utils.ErrTimeout, finallyTimeout))
+	defer cancel()
+	results, err := utils.RunCommands(finallyCtx, steps, r.sessions(stageName, ex, s, host, env), hooks)
+	for i := range results {
+		results[i].Index += offset
+		results[i].Finally = true
+	}
+	var stepErr *utils.StepError
+	if errors.As(err, &stepErr) {
+		stepErr.Index += offset
+	}
+	return results, utils.StepStatus(finallyCtx, err), err
+}
+
+// finallyTimeout finally 步骤的最长执行时间, 避免被取消的执行一直无法结束
+const finallyTimeout = 10 * time.Minute
+
+// runSteps 执行一次阶段的全部步骤, 步骤在 open 打开的会话中执行
+func (r *runner) runSteps(ctx context.Context, s dto.Stage, open utils.SessionOpener, hooks utils.StepHooks) ([]dto.StepResult, utils.TaskStatusEnum, error) {
+	stageCtx, cancel := utils.WithTimeout(ctx, s.Timeout, "阶段")
+	defer cancel()
+	var (
+		steps []dto.StepResult
+		err   error
+	)
+	if s.Parallel {
+		steps, err = utils.RunParallel(stageCtx, s.Steps, open, s.MaxParallel, s.FailFast, hooks)
+	} else {
+		steps, err = utils.RunCommands(stageCtx, s.Steps, open, hooks)
+	}
+	return steps, utils.StepStatus(stageCtx, err), err
+}
+
+// failedExitCode 失败步骤的退出码, 不是步骤失败时为 -1
+func failedExitCode(steps []dto.StepResult, err error) int {
+	var stepErr *utils.StepError
+	if errors.As(err, &stepErr) && stepErr.Index >= 1 && stepErr.Index <= len(steps) {
+		return steps[stepErr.Index-1].ExitCode
+	}
+	return -1
+}
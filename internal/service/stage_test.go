@@ -0,0 +1,198 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pubot/internal/dto"
+	"pubot/internal/model"
+	"pubot/internal/utils"
+)
+
+// newTestRunner 创建在临时工作目录中执行的 runner, 不写执行日志
+func newTestRunner(t *testing.T) *runner {
+	t.Helper()
+	ts := newTestTaskService(t)
+	return &runner{
+		ts:       ts,
+		ctx:      context.Background(),
+		task:     &model.PbTask{ID: 1, Name: "demo"},
+		run:      &model.PbTaskRun{TaskID: 1, Number: 1, Trigger: model.TriggerManual, Status: string(utils.TaskRunning)},
+		parsed:   &dto.TaskYAML{},
+		workDir:  t.TempDir(),
+		builtins: map[string]string{},
+	}
+}
+
+// job 执行一次阶段, 返回阶段结果
+func (r *runner) job(ctx context.Context, s dto.Stage) (dto.StageResult, error) {
+	return r.runJob(ctx, s, s.Name, nil, r.stageEnv(s.Name, s.Env), r.exprContext(r.workDir, nil))
+}
+
+// waitOutput 等待输出中出现 text 后调用 f
+func waitOutput(r *runner, text string, f func()) {
+	_, lines, unsubscribe := r.ts.logs.Subscribe(r.task.ID)
+	go func() {
+		defer unsubscribe()
+		for line := range lines {
+			if strings.Contains(line.Text, text) {
+				f()
+				return
+			}
+		}
+	}()
+}
+
+// 目标主机和并行步骤同时读取 git 信息, 需要配合 -race 运行
+func TestExprContextConcurrentGit(t *testing.T) {
+	r := &runner{run: &model.PbTaskRun{Trigger: model.TriggerManual}, workDir: t.TempDir()}
+	exprCtx := r.exprContext(r.workDir, nil)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := *exprCtx
+			c.Git("branch")
+			c.Git("commit")
+		}()
+	}
+	wg.Wait()
+}
+
+func TestStageRetryCanceledDuringDelay(t *testing.T) {
+	r := newTestRunner(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	waitOutput(r, "后第 1 次重新执行阶段", cancel)
+
+	s := dto.Stage{Name: "build", Steps: []dto.Step{{Run: "exit 3"}}, Retry: &dto.Retry{Attempts: 3, Delay: time.Minute}}
+	result, err := r.job(ctx, s)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("错误为 %v, 期望取消", err)
+	}
+	if result.Status != string(utils.TaskCanceled) || result.Attempts != 1 {
+		t.Fatalf("状态为 %s, 执行了 %d 次, 期望 canceled 且只执行了 1 次", result.Status, result.Attempts)
+	}
+}
+
+func TestStageEnv(t *testing.T) {
+	ts := newTestTaskService(t)
+	task := createYAMLTask(t, ts, "env", `name: env
+env: {LEVEL: task, TASK_ONLY: t, SHARED: task}
+stages:
+  - name: build
+    env: {LEVEL: stage, SHARED: stage}
+    steps:
+      - test "$LEVEL $TASK_ONLY $SHARED" = "stage t stage"
+      - run: test "$LEVEL $SHARED" = "step stage"
+        env: {LEVEL: step}
+      - test "$LEVEL" = stage
+      - test "$PUBOT_STAGE" = build
+      - test "$PUBOT_TASK_NAME" = env
+      - test "$PUBOT_TRIGGERED_BY" = alice
+      - test "$PUBOT_TRIGGER" = manual
+  - name: deploy
+    needs: [build]
+    steps:
+      - test "$LEVEL $SHARED" = "task task"
+      - test "$PUBOT_STAGE" = deploy
+`)
+	alice := &model.PbUser{ID: 1, Name: "alice", Role: "user"}
+	run := executeNow(t, ts, task, alice, nil)
+	if run.Status != string(utils.TaskSuccess) {
+		t.Fatalf("执行结果为 %s, 失败于 %s 步骤 %d", run.Status, run.FailedStage, run.FailedStep)
+	}
+}
+
+func TestStageEnvBuiltins(t *testing.T) {
+	r := newTestRunner(t)
+	r.parsed = &dto.TaskYAML{Env: map[string]string{"APP": "web", "PUBOT_STAGE": "task"}}
+	r.builtins = map[string]string{"PUBOT_TASK_ID": "7", "PUBOT_RUN_NUMBER": "3"}
+	env := r.stageEnv("build", map[string]string{"APP": "api", "PUBOT_TASK_ID": "stage"})
+	want := []string{"APP=api", "PUBOT_RUN_NUMBER=3", "PUBOT_STAGE=build", "PUBOT_TASK_ID=7"}
+	if !slices.Equal(env, want) {
+		t.Fatalf("阶段环境变量为 %v, 期望 %v", env, want)
+	}
+	if _, ok := r.builtins["PUBOT_STAGE"]; ok {
+		t.Fatal("stageEnv 不应修改任务的内置变量")
+	}
+}
+
+func TestRunMatrix(t *testing.T) {
+	tests := []struct {
+		name   string
+		matrix string
+		status utils.TaskStatusEnum
+		cells  map[string]string // 组合名称 -> 结果
+		peak   int               // 最多同时执行的组合数
+	}{
+		{"max_parallel", `{node: [18, 20], target: [a, b], exclude: [{node: "20", target: b}], max_parallel: 2}`,
+			utils.TaskSuccess, map[string]string{"build (18, a)": "success", "build (18, b)": "success", "build (20, a)": "success"}, 2},
+		{"等待全部组合结束", `{node: [18, 20, 22], target: [fail], max_parallel: 1}`,
+			utils.TaskError, map[string]string{"build (18, fail)": "success", "build (20, fail)": "error", "build (22, fail)": "success"}, 1},
+		{"fail_fast", `{node: [18, 20, 22], target: [fail], max_parallel: 1, fail_fast: true}`,
+			utils.TaskError, map[string]string{"build (18, fail)": "success", "build (20, fail)": "error", "build (22, fail)": "skipped"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts := newTestTaskService(t)
+			// 每个组合开始时记录正在执行的组合数
+			task := createYAMLTask(t, ts, "matrix", `name: matrix
+stages:
+  - name: build
+    matrix: `+tt.matrix+`
+    steps:
+      - mkdir -p running && touch running/${{ matrix.node }}-$MATRIX_TARGET
+      - ls running | wc -l >> peaks
+      - sleep 0.3; rm running/${{ matrix.node }}-$MATRIX_TARGET
+      - test "${{ matrix.target }}-$MATRIX_NODE" != fail-20
+`)
+			defer utils.RemoveWorkspace(task.ID)
+			run := executeNow(t, ts, task, nil, nil)
+			failedStage := "build"
+			if tt.status == utils.TaskSuccess {
+				failedStage = ""
+			}
+			if run.Status != string(tt.status) || run.FailedStage != failedStage {
+				t.Fatalf("执行结果为 %s, 失败于 %s: %s", run.Status, run.FailedStage, run.Error)
+			}
+			var stages []dto.StageResult
+			if err := json.Unmarshal(run.Result, &stages); err != nil {
+				t.Fatal(err)
+			}
+			if len(stages) != 1 || stages[0].Status != string(tt.status) {
+				t.Fatalf("阶段结果为 %+v", stages)
+			}
+			cells := map[string]string{}
+			for _, c := range stages[0].Cells {
+				cells[c.Name] = c.Status
+				if c.Matrix["node"] == "" || !strings.Contains(c.Name, c.Matrix["node"]) {
+					t.Fatalf("组合 %s 的变量值为 %v", c.Name, c.Matrix)
+				}
+			}
+			if !maps.Equal(cells, tt.cells) {
+				t.Fatalf("各组合的结果为 %v, 期望 %v", cells, tt.cells)
+			}
+			peaks, err := os.ReadFile(filepath.Join(utils.TaskWorkspace(task.ID), "workspace", "peaks"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, n := range strings.Fields(string(peaks)) {
+				if peak, _ := strconv.Atoi(n); peak > tt.peak {
+					t.Fatalf("同时执行了 %d 个组合, 最多 %d 个", peak, tt.peak)
+				}
+			}
+		})
+	}
+}
@@ -1,27 +1,53 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"os"
+	"pubot/internal/config"
 	"pubot/internal/dao"
 	"pubot/internal/dto"
+	"pubot/internal/executor"
 	"pubot/internal/model"
 	"pubot/internal/utils"
-
-	"gopkg.in/yaml.v3"
 )
 
 type TaskService struct {
-	hub     *utils.Hub
-	taskDao *dao.TaskDao
+	hub       *utils.Hub
+	logs      *utils.LogHub
+	taskDao   *dao.TaskDao
+	runDao    *dao.TaskRunDao
+	templates utils.TemplateLookup
+	agents    executor.AgentPool // agent 执行器使用的执行机器池, 为空时不能使用 agent
+
+	queue *runQueue
+	// 关闭时强制结束执行的同时取消, finally 步骤也随之结束, 避免关闭数据库后还在写入执行记录
+	halt     context.Context
+	haltRuns context.CancelCauseFunc
 }
 
-func NewTaskService(taskDao *dao.TaskDao, hub *utils.Hub) *TaskService {
-	return &TaskService{taskDao: taskDao, hub: hub}
+func NewTaskService(taskDao *dao.TaskDao, runDao *dao.TaskRunDao, templateDao *dao.TemplateDao, agents executor.AgentPool, hub *utils.Hub, logs *utils.LogHub) *TaskService {
+	ts := &TaskService{
+		taskDao:   taskDao,
+		runDao:    runDao,
+		templates: templateLookup(templateDao),
+		agents:    agents,
+		hub:       hub,
+		logs:      logs,
+		queue:     newRunQueue(),
+	}
+	ts.halt, ts.haltRuns = context.WithCancelCause(context.Background())
+	for i := 0; i < config.Get().Workers; i++ {
+		go ts.worker()
+	}
+	return ts
 }
 
 func (ts *TaskService) Create(taskDto dto.TaskCreateRequest) (*model.PbTask, error) {
-	parsed, err := utils.ParseTaskYAML(taskDto.YAML)
+	parsed, err := utils.ParseTaskYAML(taskDto.YAML, parseOptions(ts.templates))
 	if err != nil {
 		return nil, err
 	}
@@ -73,7 +99,7 @@ func (ts *TaskService) Update(id uint, dtoTask dto.TaskUpdateRequest) (*model.Pb
 
 	// 2. 如果有 YAML 更新，需要重新解析
 	if dtoTask.YAML != "" {
-		parsed, err := utils.ParseTaskYAML(dtoTask.YAML)
+		parsed, err := utils.ParseTaskYAML(dtoTask.YAML, parseOptions(ts.templates))
 		if err != nil {
 			return nil, fmt.Errorf("invalid YAML: %w", err)
 		}
@@ -104,101 +130,209 @@ func (ts *TaskService) Update(id uint, dtoTask dto.TaskUpdateRequest) (*model.Pb
 	return existingTask, nil
 }
 
+// GetById 获取任务, 按当前的解析规则刷新 YAMLParsed, 其中的 params 用于页面渲染触发参数表单
 func (ts *TaskService) GetById(id uint) (*model.PbTask, error) {
-	return ts.taskDao.GetByID(id)
+	task, err := ts.taskDao.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if parsed, err := utils.ParseTaskYAML(task.YAML, parseOptions(ts.templates)); err == nil {
+		if parsedJSON, err := json.Marshal(parsed); err == nil {
+			task.YAMLParsed = parsedJSON
+		}
+	}
+	redactTask(task)
+	return task, nil
+}
+
+// redactTask 隐藏之前保存的任务中直接写出的凭据, 只用于接口输出
+// YAMLParsed 按当前的结构重新序列化, 凭据字段不会输出
+func redactTask(t *model.PbTask) {
+	t.YAML = utils.RedactSecrets(t.YAML)
+	var parsed dto.TaskYAML
+	if err := json.Unmarshal(t.YAMLParsed, &parsed); err == nil {
+		if parsedJSON, err := json.Marshal(parsed); err == nil {
+			t.YAMLParsed = parsedJSON
+		}
+	}
+}
+
+// Validate 校验任务 YAML 并返回展开模板、转换后的结构, 不保存
+func (ts *TaskService) Validate(yamlText string) *utils.ValidationResult {
+	return utils.ValidateTaskYAML(yamlText, parseOptions(ts.templates))
 }
 
 func (ts *TaskService) List() ([]model.PbTask, error) {
-	return ts.taskDao.GetAllTask()
+	tasks, err := ts.taskDao.GetAllTask()
+	if err != nil {
+		return nil, err
+	}
+	for i := range tasks {
+		redactTask(&tasks[i])
+	}
+	return tasks, nil
 }
 
-func (ts *TaskService) Execute(id uint) error {
+// Execute 创建执行记录并放入执行队列, 按任务的并发策略处理已有的执行
+// params 为触发参数, 按任务声明的参数校验并补全默认值后记录在执行记录上
+func (ts *TaskService) Execute(id uint, trigger string, user *model.PbUser, params map[string]any) (*model.PbTaskRun, error) {
 	task, err := ts.taskDao.GetByID(id)
 	if err != nil {
-		return err
+		return nil, err
 	}
-
-	go func(t *model.PbTask) {
-		// 1️⃣ 开始执行任务：持久化 running 状态
-		t.Status = string(utils.TaskRunning)
-		if err := ts.taskDao.Save(t); err != nil {
-			t.Count++
-			ts.hub.Broadcast(utils.TaskStatus{ID: t.ID, Status: utils.TaskError, Count: t.Count})
-			return
+	// YAML 有误时按默认策略排队, 由执行过程记录失败原因
+	policy := dto.ConcurrencyQueue
+	if parsed, err := utils.ParseTaskYAML(task.YAML, parseOptions(ts.templates)); err == nil {
+		if parsed.Concurrency != "" {
+			policy = parsed.Concurrency
 		}
-		ts.hub.Broadcast(utils.TaskStatus{ID: t.ID, Status: utils.TaskRunning, Count: t.Count})
-
-		var parsed map[string]interface{}
-		if err := yaml.Unmarshal([]byte(t.YAML), &parsed); err != nil {
-			// YAML 解析失败 → error
-			t.Status = string(utils.TaskError)
-			t.Count++
-			_ = ts.taskDao.Save(t)
-			ts.hub.Broadcast(utils.TaskStatus{ID: t.ID, Status: utils.TaskError, Count: t.Count})
-			return
+		if params, err = utils.ResolveParams(parsed.Params, params); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidParams, err)
 		}
+	}
+	paramsJSON, err := json.Marshal(params)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidParams, err)
+	}
 
-		// 2️⃣ 执行 build 阶段
-		if buildSteps, ok := parsed["build"].([]interface{}); ok {
-			var cmds []string
-			for _, step := range buildSteps {
-				if s, ok := step.(string); ok {
-					cmds = append(cmds, s)
-				}
-			}
-
-			if err := utils.RunCommands(cmds); err != nil {
-				// 执行失败，更新任务状态
-				t.Status = string(utils.TaskError)
-				t.Count++
-				_ = ts.taskDao.Save(t)
-				ts.hub.Broadcast(utils.TaskStatus{
-					ID:     t.ID,
-					Status: utils.TaskError,
-					Count:  t.Count,
-				})
-				return
-			}
+	ts.queue.mu.Lock()
+	defer ts.queue.mu.Unlock()
+	if ts.queue.closed {
+		return nil, ErrShutdown
+	}
+	active, pending := ts.queue.jobsOf(task.ID)
+	switch policy {
+	case dto.ConcurrencyReject:
+		if active != nil || len(pending) > 0 {
+			return nil, ErrTaskBusy
+		}
+	case dto.ConcurrencyCancel:
+		cause := errors.New("被新的执行取代")
+		if active != nil {
+			active.cancel(cause)
 		}
+		for _, j := range pending {
+			j.cancel(cause)
+			ts.queue.remove(j)
+			ts.drop(j, utils.TaskCanceled, cause)
+		}
+	}
 
-		// 3️⃣ 执行 deploy 阶段
-		if deploy, ok := parsed["deploy"].(map[string]interface{}); ok {
-			if runSteps, ok := deploy["run"].([]interface{}); ok {
-				var cmds []string
-				for _, step := range runSteps {
-					if s, ok := step.(string); ok {
-						cmds = append(cmds, s)
-					}
-				}
-				if err := utils.RunCommands(cmds); err != nil {
-					// 执行失败，更新任务状态
-					t.Status = string(utils.TaskError)
-					t.Count++
-					_ = ts.taskDao.Save(t)
-					ts.hub.Broadcast(utils.TaskStatus{
-						ID:     t.ID,
-						Status: utils.TaskError,
-						Count:  t.Count,
-					})
-					return
-				}
-			}
+	run := &model.PbTaskRun{
+		TaskID:  task.ID,
+		Trigger: trigger,
+		Status:  string(utils.TaskQueued),
+		Params:  paramsJSON,
+	}
+	if user != nil {
+		run.UserID = user.ID
+		run.Username = user.Name
+	}
+	if err := ts.runDao.Create(run); err != nil {
+		return nil, fmt.Errorf("failed to create task run: %w", err)
+	}
+	ts.enqueue(run)
 
+	// 任务没有正在进行的执行时, 任务状态也变为排队中
+	if active == nil {
+		task.Status = string(utils.TaskQueued)
+		if err := ts.taskDao.Save(task); err != nil {
+			slog.Error("保存任务状态失败", slog.Uint64("TaskID", uint64(task.ID)), slog.String("Err", err.Error()))
 		}
+	}
+	ts.hub.Broadcast(utils.TaskStatus{ID: task.ID, Status: utils.TaskStatusEnum(task.Status), Count: task.Count, Run: run.Number})
+
+	return run, nil
+}
 
-		// 4️⃣ 成功完成：Count +1 并保存状态 success
-		t.Count++
-		t.Status = string(utils.TaskSuccess)
-		if err := ts.taskDao.Save(t); err != nil {
-			// 保存失败 → error
-			ts.hub.Broadcast(utils.TaskStatus{ID: t.ID, Status: utils.TaskError, Count: t.Count})
-			return
+// Cancel 取消任务正在进行和排队的执行, 只有触发用户或管理员可以取消
+// 返回被取消的执行序号
+func (ts *TaskService) Cancel(id uint, user *model.PbUser) ([]int, error) {
+	ts.queue.mu.Lock()
+	defer ts.queue.mu.Unlock()
+	active, pending := ts.queue.jobsOf(id)
+	jobs := pending
+	if active != nil {
+		jobs = append([]*job{active}, pending...)
+	}
+	if len(jobs) == 0 {
+		return nil, ErrRunNotActive
+	}
+	for _, j := range jobs {
+		if user.Role != "admin" && user.ID != j.userID {
+			return nil, ErrForbidden
+		}
+	}
+	cause := fmt.Errorf("用户 %s 取消执行", user.Name)
+	var canceled []int
+	for _, j := range jobs {
+		j.cancel(cause)
+		if j != active {
+			ts.queue.remove(j)
+			ts.drop(j, utils.TaskCanceled, cause)
 		}
+		canceled = append(canceled, j.number)
+	}
+	return canceled, nil
+}
+
+// CleanWorkspace 删除任务的工作目录, 只有管理员可以操作, 任务执行或排队期间不能删除
+func (ts *TaskService) CleanWorkspace(id uint, user *model.PbUser) error {
+	if user.Role != "admin" {
+		return ErrForbidden
+	}
+	if _, err := ts.taskDao.GetByID(id); err != nil {
+		return fmt.Errorf("task not found: %w", err)
+	}
+	// 持有队列锁, 删除期间不会有新的执行开始
+	ts.queue.mu.Lock()
+	defer ts.queue.mu.Unlock()
+	if active, pending := ts.queue.jobsOf(id); active != nil || len(pending) > 0 {
+		return ErrTaskBusy
+	}
+	return utils.RemoveWorkspace(id)
+}
 
-		// 广播成功状态
-		ts.hub.Broadcast(utils.TaskStatus{ID: t.ID, Status: utils.TaskSuccess, Count: t.Count})
+// ListRuns 获取任务的执行记录
+func (ts *TaskService) ListRuns(id uint, limit, offset int) ([]model.PbTaskRun, error) {
+	if _, err := ts.taskDao.GetByID(id); err != nil {
+		return nil, fmt.Errorf("task not found: %w", err)
+	}
+	runs, err := ts.runDao.ListByTask(id, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	for i := range runs {
+		runs[i].YAML = utils.RedactSecrets(runs[i].YAML)
+	}
+	return runs, nil
+}
 
-	}(task)
+// GetRun 获取任务的某一次执行记录
+func (ts *TaskService) GetRun(id uint, number int) (*model.PbTaskRun, error) {
+	run, err := ts.runDao.GetByNumber(id, number)
+	if err != nil {
+		return nil, fmt.Errorf("task run not found: %w", err)
+	}
+	run.YAML = utils.RedactSecrets(run.YAML)
+	return run, nil
+}
 
-	return nil
+// GetRunLog 从字节偏移 offset 开始分页读取执行日志, tail > 0 时读取最后 tail 行
+func (ts *TaskService) GetRunLog(id uint, number int, offset int64, limit, tail int, filter utils.LogFilter) (*utils.LogPage, error) {
+	if _, err := ts.runDao.GetByNumber(id, number); err != nil {
+		return nil, fmt.Errorf("task run not found: %w", err)
+	}
+	if tail > 0 {
+		return utils.TailRunLog(id, number, tail, filter)
+	}
+	return utils.ReadRunLog(id, number, offset, limit, filter)
+}
+
+// OpenRunLog 打开执行日志文件, 用于原始日志下载
+func (ts *TaskService) OpenRunLog(id uint, number int) (*os.File, error) {
+	if _, err := ts.runDao.GetByNumber(id, number); err != nil {
+		return nil, fmt.Errorf("task run not found: %w", err)
+	}
+	return os.Open(utils.RunLogPath(id, number))
 }
@@ -0,0 +1,233 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"pubot/internal/dto"
+	"pubot/internal/model"
+	"pubot/internal/utils"
+
+	"gorm.io/gorm"
+)
+
+const inlineSecretYAML = `name: demo
+stages:
+  - name: deploy
+    hosts:
+      - {address: 10.0.0.1, password: hunter2}
+    steps: [./deploy.sh]
+`
+
+func TestCreateRejectsInlineSecrets(t *testing.T) {
+	ts := newTestTaskService(t)
+	_, err := ts.Create(dto.TaskCreateRequest{Name: "demo", YAML: inlineSecretYAML})
+	if err == nil || !strings.Contains(err.Error(), "不能直接写密码") {
+		t.Fatalf("创建返回 %v, 期望拒绝直接写出的密码", err)
+	}
+}
+
+func TestRedactLegacySecrets(t *testing.T) {
+	ts := newTestTaskService(t)
+	// 之前保存的任务和执行记录中直接写出了密码
+	task := &model.PbTask{
+		Name:       "demo",
+		YAML:       inlineSecretYAML,
+		YAMLParsed: []byte(`{"name":"demo","stages":[{"name":"deploy","hosts":{"list":[{"address":"10.0.0.1","password":"hunter2"}]}}]}`),
+	}
+	if err := ts.taskDao.Create(task); err != nil {
+		t.Fatal(err)
+	}
+	run := &model.PbTaskRun{TaskID: task.ID, Trigger: model.TriggerManual, YAML: inlineSecretYAML}
+	if err := ts.runDao.Create(run); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(what, text string) {
+		t.Helper()
+		if strings.Contains(text, "hunter2") {
+			t.Fatalf("%s中包含密码: %s", what, text)
+		}
+	}
+	got, err := ts.GetById(task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("任务 YAML ", got.YAML)
+	check("任务 YAMLParsed ", string(got.YAMLParsed))
+	tasks, err := ts.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("任务列表 YAML ", tasks[0].YAML)
+	check("任务列表 YAMLParsed ", string(tasks[0].YAMLParsed))
+	if !strings.Contains(string(tasks[0].YAMLParsed), `"address":"10.0.0.1"`) {
+		t.Fatalf("YAMLParsed 缺少主机: %s", tasks[0].YAMLParsed)
+	}
+	r, err := ts.GetRun(task.ID, run.Number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("执行记录 YAML ", r.YAML)
+	runs, err := ts.ListRuns(task.ID, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("执行记录列表 YAML ", runs[0].YAML)
+
+	// 数据库中保存的内容不变
+	stored, err := ts.taskDao.GetByID(task.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.YAML != inlineSecretYAML {
+		t.Fatal("隐藏凭据修改了保存的任务")
+	}
+}
+
+func TestGetRunNotFound(t *testing.T) {
+	ts := newTestTaskService(t)
+	task := createTestTask(t, ts, "demo", "")
+	if _, err := ts.GetRun(task.ID, 1); !errors.Is(err, gorm.ErrRecordNotFound) || !strings.Contains(err.Error(), "task run not found") {
+		t.Fatalf("错误为 %v, 期望执行记录不存在", err)
+	}
+	if _, err := ts.GetRunLog(task.ID, 1, 0, 10, 0, utils.LogFilter{}); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("错误为 %v, 期望执行记录不存在", err)
+	}
+}
+
+func TestCancelPermissions(t *testing.T) {
+	ts := newTestTaskService(t)
+	task := createTestTask(t, ts, "cancel", "")
+	alice := &model.PbUser{ID: 1, Name: "alice", Role: "user"}
+	bob := &model.PbUser{ID: 2, Name: "bob", Role: "user"}
+	admin := &model.PbUser{ID: 3, Name: "admin", Role: "admin"}
+
+	if _, err := ts.Cancel(task.ID, alice); !errors.Is(err, ErrRunNotActive) {
+		t.Fatalf("没有执行时取消返回 %v, 期望 ErrRunNotActive", err)
+	}
+	first, err := ts.Execute(task.ID, model.TriggerManual, alice, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := startNext(t, ts)
+	second, err := ts.Execute(task.ID, model.TriggerManual, alice, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 其他普通用户不能取消
+	if _, err := ts.Cancel(task.ID, bob); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("其他用户取消返回 %v, 期望 ErrForbidden", err)
+	}
+	if j.ctx.Err() != nil || runStatus(t, ts, second) != string(utils.TaskQueued) {
+		t.Fatal("没有权限的取消不应影响执行")
+	}
+	// 触发用户可以取消正在进行和排队的执行
+	canceled, err := ts.Cancel(task.ID, alice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(canceled) != 2 || canceled[0] != first.Number || canceled[1] != second.Number {
+		t.Fatalf("取消的执行为 %v", canceled)
+	}
+	if context.Cause(j.ctx) == nil || !strings.Contains(context.Cause(j.ctx).Error(), "用户 alice 取消执行") {
+		t.Fatalf("正在进行的执行取消原因为 %v", context.Cause(j.ctx))
+	}
+	if got := runStatus(t, ts, second); got != string(utils.TaskCanceled) {
+		t.Fatalf("排队的执行状态为 %s, 期望 canceled", got)
+	}
+	ts.queue.done(j)
+
+	// 管理员可以取消其他用户触发的执行
+	if _, err := ts.Execute(task.ID, model.TriggerManual, bob, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Cancel(task.ID, admin); err != nil {
+		t.Fatalf("管理员取消返回 %v", err)
+	}
+}
+
+func TestCancelRunningTask(t *testing.T) {
+	ts := newTestTaskService(t)
+	task := createYAMLTask(t, ts, "sleepy", `name: sleepy
+stages:
+  - name: build
+    steps:
+      - sleep 30
+      - echo never
+`)
+	alice := &model.PbUser{ID: 1, Name: "alice", Role: "user"}
+	run, err := ts.Execute(task.ID, model.TriggerManual, alice, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := startNext(t, ts)
+	// 第一个步骤开始后取消
+	_, lines, unsubscribe := ts.logs.Subscribe(task.ID)
+	defer unsubscribe()
+	go func() {
+		for line := range lines {
+			if line.Stage == "build" && line.Step == 1 {
+				ts.Cancel(task.ID, alice)
+				return
+			}
+		}
+	}()
+	start := time.Now()
+	ts.runJob(j)
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("取消后 %s 才结束", elapsed)
+	}
+	got, err := ts.GetRun(task.ID, run.Number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != string(utils.TaskCanceled) || got.FailedStage != "build" || got.FailedStep != 1 {
+		t.Fatalf("执行结果为 %s, 停止于 %s 步骤 %d", got.Status, got.FailedStage, got.FailedStep)
+	}
+}
+
+func TestCleanWorkspace(t *testing.T) {
+	ts := newTestTaskService(t)
+	task := createTestTask(t, ts, "clean", "")
+	alice := &model.PbUser{ID: 1, Name: "alice", Role: "user"}
+	admin := &model.PbUser{ID: 2, Name: "admin", Role: "admin"}
+	dir, err := utils.PrepareWorkspace(task.ID, 1, dto.WorkspaceReuse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ts.CleanWorkspace(task.ID, alice); !errors.Is(err, ErrForbidden) {
+		t.Fatalf("普通用户清理返回 %v, 期望 ErrForbidden", err)
+	}
+	if err := ts.CleanWorkspace(task.ID+100, admin); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("清理不存在的任务返回 %v", err)
+	}
+	// 排队和执行期间都不能清理
+	if _, err := ts.Execute(task.ID, model.TriggerManual, alice, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.CleanWorkspace(task.ID, admin); !errors.Is(err, ErrTaskBusy) {
+		t.Fatalf("排队期间清理返回 %v, 期望 ErrTaskBusy", err)
+	}
+	j := startNext(t, ts)
+	if err := ts.CleanWorkspace(task.ID, admin); !errors.Is(err, ErrTaskBusy) {
+		t.Fatalf("执行期间清理返回 %v, 期望 ErrTaskBusy", err)
+	}
+	if _, err := os.Stat(dir); err != nil {
+		t.Fatalf("拒绝清理后工作目录不存在: %v", err)
+	}
+	ts.queue.done(j)
+
+	if err := ts.CleanWorkspace(task.ID, admin); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(utils.TaskWorkspace(task.ID)); !os.IsNotExist(err) {
+		t.Fatalf("清理后任务目录仍然存在: %v", err)
+	}
+}
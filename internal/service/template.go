@@ -0,0 +1,191 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"pubot/internal/dao"
+	"pubot/internal/dto"
+	"pubot/internal/executor"
+	"pubot/internal/model"
+	"pubot/internal/utils"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrTemplateInUse   = errors.New("模板正在被使用")
+	ErrInvalidTemplate = errors.New("模板名称不能为空")
+	ErrTemplateExists  = errors.New("模板已经存在")
+)
+
+// templateLookup 从数据库中按名称读取模板
+func templateLookup(templateDao *dao.TemplateDao) utils.TemplateLookup {
+	return func(name string) (string, error) {
+		template, err := templateDao.GetByName(name)
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return "", fmt.Errorf("模板不存在: %s", name)
+		}
+		if err != nil {
+			return "", err
+		}
+		return template.YAML, nil
+	}
+}
+
+// parseOptions 解析任务和模板 YAML 的选项, 执行器的检查由 executor 包提供
+func parseOptions(templates utils.TemplateLookup) utils.ParseOptions {
+	return utils.ParseOptions{
+		Templates:         templates,
+		CheckExecutor:     executor.Check,
+		PlatformSupported: executor.SupportsPlatform,
+	}
+}
+
+type TemplateService struct {
+	templateDao *dao.TemplateDao
+	taskDao     *dao.TaskDao
+	templates   utils.TemplateLookup
+}
+
+func NewTemplateService(templateDao *dao.TemplateDao, taskDao *dao.TaskDao) *TemplateService {
+	return &TemplateService{
+		templateDao: templateDao,
+		taskDao:     taskDao,
+		templates:   templateLookup(templateDao),
+	}
+}
+
+// Create 创建模板, 模板 YAML 按任务 YAML 的规则校验
+func (ts *TemplateService) Create(req dto.TemplateRequest) (*model.PbTemplate, error) {
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		return nil, ErrInvalidTemplate
+	}
+	if _, err := utils.ParseTaskYAML(req.YAML, parseOptions(ts.templates)); err != nil {
+		return nil, err
+	}
+	template := model.PbTemplate{
+		Name:        req.Name,
+		Description: req.Description,
+		YAML:        req.YAML,
+	}
+	if err := ts.templateDao.Create(&template); err != nil {
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, fmt.Errorf("%w: %s", ErrTemplateExists, template.Name)
+		}
+		return nil, err
+	}
+	return &template, nil
+}
+
+// Update 更新模板, 引用它的任务在下一次执行时使用新的内容
+// 被引用的模板不能改名, 也不能改成其他模板的名称
+func (ts *TemplateService) Update(id uint, req dto.TemplateRequest) (*model.PbTemplate, error) {
+	existing, err := ts.templateDao.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if name := strings.TrimSpace(req.Name); name != "" && name != existing.Name {
+		if users, err := ts.usedBy(existing.Name); err != nil {
+			return nil, err
+		} else if len(users) > 0 {
+			return nil, fmt.Errorf("%w: %s", ErrTemplateInUse, strings.Join(users, "、"))
+		}
+		if _, err := ts.templateDao.GetByName(name); err == nil {
+			return nil, fmt.Errorf("%w: %s", ErrTemplateExists, name)
+		} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, err
+		}
+		existing.Name = name
+	}
+	if req.YAML != "" {
+		// 先按新内容替换自己再校验, 可以发现通过其他模板形成的循环引用
+		lookup := func(name string) (string, error) {
+			if name == existing.Name {
+				return req.YAML, nil
+			}
+			return ts.templates(name)
+		}
+		if _, err := utils.ParseTaskYAML(req.YAML, parseOptions(lookup)); err != nil {
+			return nil, err
+		}
+		existing.YAML = req.YAML
+	}
+	existing.Description = req.Description
+	if err := ts.templateDao.Update(existing); err != nil {
+		// 检查之后被其他请求抢先使用了名称
+		if errors.Is(err, gorm.ErrDuplicatedKey) {
+			return nil, fmt.Errorf("%w: %s", ErrTemplateExists, existing.Name)
+		}
+		return nil, fmt.Errorf("failed to update template: %w", err)
+	}
+	return existing, nil
+}
+
+// Delete 删除模板, 被任务或其他模板引用时不能删除
+func (ts *TemplateService) Delete(id uint) error {
+	template, err := ts.templateDao.GetByID(id)
+	if err != nil {
+		return fmt.Errorf("template not found: %w", err)
+	}
+	users, err := ts.usedBy(template.Name)
+	if err != nil {
+		return err
+	}
+	if len(users) > 0 {
+		return fmt.Errorf("%w: %s", ErrTemplateInUse, strings.Join(users, "、"))
+	}
+	return ts.templateDao.Delete(id)
+}
+
+func (ts *TemplateService) GetById(id uint) (*model.PbTemplate, error) {
+	template, err := ts.templateDao.GetByID(id)
+	if err != nil {
+		return nil, err
+	}
+	template.YAML = utils.RedactSecrets(template.YAML)
+	return template, nil
+}
+
+func (ts *TemplateService) List() ([]model.PbTemplate, error) {
+	templates, err := ts.templateDao.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	for i := range templates {
+		templates[i].YAML = utils.RedactSecrets(templates[i].YAML)
+	}
+	return templates, nil
+}
+
+// Validate 校验模板 YAML, 不保存
+func (ts *TemplateService) Validate(yamlText string) *utils.ValidationResult {
+	return utils.ValidateTaskYAML(yamlText, parseOptions(ts.templates))
+}
+
+// usedBy 返回引用了模板的任务和模板
+func (ts *TemplateService) usedBy(name string) ([]string, error) {
+	var users []string
+	tasks, err := ts.taskDao.GetAllTask()
+	if err != nil {
+		return nil, err
+	}
+	for _, task := range tasks {
+		if slices.Contains(utils.TemplateRefs(task.YAML), name) {
+			users = append(users, "任务 "+task.Name)
+		}
+	}
+	templates, err := ts.templateDao.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	for _, template := range templates {
+		if template.Name != name && slices.Contains(utils.TemplateRefs(template.YAML), name) {
+			users = append(users, "模板 "+template.Name)
+		}
+	}
+	return users, nil
+}
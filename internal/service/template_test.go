@@ -0,0 +1,69 @@
+package service
+
+import (
+	"errors"
+	"testing"
+
+	"pubot/internal/dao"
+	"pubot/internal/dto"
+
+	"gorm.io/gorm"
+)
+
+const testTemplateYAML = "name: base\nstages:\n  - name: build\n    steps: [make]\n"
+
+func newTestTemplateService(t *testing.T) *TemplateService {
+	t.Helper()
+	db := newTestDb(t)
+	return NewTemplateService(dao.NewTemplateDao(db), dao.NewTaskDao(db))
+}
+
+func TestTemplateNameUnique(t *testing.T) {
+	ts := newTestTemplateService(t)
+
+	base, err := ts.Create(dto.TemplateRequest{Name: "base", YAML: testTemplateYAML})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Create(dto.TemplateRequest{Name: " base ", YAML: testTemplateYAML}); !errors.Is(err, ErrTemplateExists) {
+		t.Fatalf("重名创建返回 %v, 期望 ErrTemplateExists", err)
+	}
+
+	other, err := ts.Create(dto.TemplateRequest{Name: "other", YAML: testTemplateYAML})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Update(other.ID, dto.TemplateRequest{Name: "base"}); !errors.Is(err, ErrTemplateExists) {
+		t.Fatalf("改成已有模板的名称返回 %v, 期望 ErrTemplateExists", err)
+	}
+	if _, err := ts.Update(other.ID, dto.TemplateRequest{Name: "other", Description: "不改名"}); err != nil {
+		t.Fatalf("不改名的更新失败: %v", err)
+	}
+
+	// 删除的模板不再占用名称
+	if err := ts.Delete(base.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Update(other.ID, dto.TemplateRequest{Name: "base"}); err != nil {
+		t.Fatalf("改成已删除模板的名称失败: %v", err)
+	}
+	if _, err := ts.Create(dto.TemplateRequest{Name: "other", YAML: testTemplateYAML}); err != nil {
+		t.Fatalf("使用改名前的名称创建失败: %v", err)
+	}
+}
+
+func TestTemplateDaoDuplicateKey(t *testing.T) {
+	ts := newTestTemplateService(t)
+	if _, err := ts.Create(dto.TemplateRequest{Name: "base", YAML: testTemplateYAML}); err != nil {
+		t.Fatal(err)
+	}
+	// 绕过检查直接改名, 由唯一索引拒绝
+	other, err := ts.Create(dto.TemplateRequest{Name: "other", YAML: testTemplateYAML})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Name = "base"
+	if err := ts.templateDao.Update(other); !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Fatalf("重名保存返回 %v, 期望 gorm.ErrDuplicatedKey", err)
+	}
+}
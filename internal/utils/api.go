@@ -7,8 +7,6 @@ import (
 	"log/slog"
 	"net/http"
 	"os"
-	"os/exec"
-	"path/filepath"
 	"reflect"
 	"strings"
 )
@@ -68,56 +66,15 @@ func Failure(w http.ResponseWriter, m Map) {
 	json.NewEncoder(w).Encode(m)
 }
 
-func RunCmd(command, workDir string) error {
-	cmd := exec.Command("bash", "-c", command)
-	if workDir != "" {
-		cmd.Dir = workDir
-	}
-
-	slog.Info("执行命令", slog.String("Cmd", command), slog.String("Dir", cmd.Dir))
-
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		slog.Error("执行命令报错", slog.String("Err", err.Error()))
-		return err
-	}
-	slog.Info("执行命令结果", slog.String("Out", string(output)))
-	return nil
-}
-
-// RunCommands 支持 cd 持久化
-func RunCommands(cmds []string) error {
-	// 当前目录（初始为程序启动目录）
-	currentDir, _ := os.Getwd()
-
-	for _, raw := range cmds {
-		c := strings.TrimSpace(raw)
-		if c == "" {
-			continue
-		}
-
-		// 处理 cd
-		if strings.HasPrefix(c, "cd ") {
-			dir := strings.TrimSpace(strings.TrimPrefix(c, "cd "))
-			// 转换成绝对路径
-			if !filepath.IsAbs(dir) {
-				dir = filepath.Join(currentDir, dir)
-			}
-			if _, err := os.Stat(dir); err != nil {
-				return errors.New("目录不存在: " + dir)
-			}
-			currentDir = dir
-			slog.Info("切换目录", slog.String("Dir", currentDir))
-			continue
-		}
+// OutputFunc 接收命令输出的一行, stream 为 stdout/stderr/system
+type OutputFunc func(stream, text string)
 
-		// 普通命令
-		if err := RunCmd(c, currentDir); err != nil {
-			return err
-		}
-	}
-	return nil
-}
+// 输出流类型
+const (
+	StreamStdout = "stdout"
+	StreamStderr = "stderr"
+	StreamSystem = "system" // pubot 自身输出的提示信息
+)
 
 func ChWorkSpace(path string) error {
 	err := os.Chdir(path)
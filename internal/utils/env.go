@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var envNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ValidEnvName 环境变量名只能包含字母、数字和下划线, 且不能以数字开头
+func ValidEnvName(name string) bool {
+	return envNameRe.MatchString(name)
+}
+
+// MergeEnv 在 base(KEY=VALUE 形式)的基础上依次合并 overrides, 后面的同名变量覆盖前面的
+func MergeEnv(base []string, overrides ...map[string]string) []string {
+	merged := make(map[string]string, len(base))
+	for _, kv := range base {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			merged[k] = v
+		}
+	}
+	for _, m := range overrides {
+		for k, v := range m {
+			merged[k] = v
+		}
+	}
+	env := make([]string, 0, len(merged))
+	for k, v := range merged {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// validateEnv 校验 env 中的变量名, 以及变量值中引用的参数是否已声明
+func validateEnv(scope string, env map[string]string, declared map[string]bool) error {
+	for k, v := range env {
+		if !ValidEnvName(k) {
+			return atPath(k, fmt.Errorf("%s env 变量名无效: %q", scope, k))
+		}
+		if strings.HasPrefix(k, "PUBOT_") {
+			return atPath(k, fmt.Errorf("%s env 不能使用 pubot 内置变量名: %q", scope, k))
+		}
+		if err := validatePlaceholders(scope+" env "+k, v, declared); err != nil {
+			return atPath(k, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestMergeEnv(t *testing.T) {
+	tests := []struct {
+		name      string
+		base      []string
+		overrides []map[string]string
+		want      []string
+	}{
+		{"空", nil, nil, []string{}},
+		{"只有 base", []string{"B=2", "A=1"}, nil, []string{"A=1", "B=2"}},
+		{"忽略无效的 base", []string{"A=1", "INVALID"}, nil, []string{"A=1"}},
+		{"值中有等号", []string{"A=x=y"}, nil, []string{"A=x=y"}},
+		{"覆盖 base", []string{"A=1", "B=2"}, []map[string]string{{"A": "task"}}, []string{"A=task", "B=2"}},
+		{
+			"后面的覆盖前面的",
+			nil,
+			[]map[string]string{{"A": "task", "B": "task", "C": "task"}, {"B": "stage", "C": "stage"}, {"C": "step"}},
+			[]string{"A=task", "B=stage", "C=step"},
+		},
+		{"空值也会覆盖", []string{"A=1"}, []map[string]string{nil, {"A": ""}}, []string{"A="}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := MergeEnv(tt.base, tt.overrides...); !slices.Equal(got, tt.want) {
+				t.Fatalf("MergeEnv = %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		message string // 期望的错误信息片段, 为空表示校验通过
+	}{
+		{"各级 env", `name: demo
+env: {APP: web}
+stages:
+  - name: build
+    env: {GOOS: linux}
+    steps:
+      - run: make
+        env: {_DEBUG1: "1"}
+`, ""},
+		{"任务 env 使用内置变量名", `name: demo
+env: {PUBOT_TASK_ID: "1"}
+stages:
+  - name: build
+    steps: [make]
+`, "不能使用 pubot 内置变量名"},
+		{"阶段 env 变量名以数字开头", `name: demo
+stages:
+  - name: build
+    env: {1APP: web}
+    steps: [make]
+`, "env 变量名无效"},
+		{"步骤 env 变量名有横线", `name: demo
+stages:
+  - name: build
+    steps:
+      - run: make
+        env: {APP-NAME: web}
+`, "env 变量名无效"},
+		{"步骤 env 使用内置变量名", `name: demo
+stages:
+  - name: build
+    steps:
+      - run: make
+        env: {PUBOT_WORKSPACE: /tmp}
+`, "不能使用 pubot 内置变量名"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ValidateTaskYAML(tt.yaml, ParseOptions{})
+			if tt.message == "" {
+				if !result.Valid {
+					t.Fatalf("期望校验通过, 错误: %v", result.Errors)
+				}
+				return
+			}
+			if result.Valid || !strings.Contains(result.Errors[0].Message, tt.message) {
+				t.Fatalf("校验错误为 %v, 期望包含 %q", result.Errors, tt.message)
+			}
+		})
+	}
+}
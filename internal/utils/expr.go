@@ -0,0 +1,661 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 条件表达式, 用于步骤和阶段的 if:
+//
+//	字面量:   'main'  "main"  1  1.5  true  false  null
+//	上下文:   trigger  params.<名称>  matrix.<名称>  env.<变量名>  git.branch  git.commit
+//	状态函数: success()  failure()  always()  canceled()
+//	字符串:   contains(a, b)  startsWith(a, b)  endsWith(a, b)
+//	运算符:   ==  !=  <  <=  >  >=  &&  ||  !  ( )
+//
+// 可以写成 ${{ ... }}, 效果相同
+
+// ExprContext 表达式求值时的运行上下文
+type ExprContext struct {
+	Success  bool // 依赖的阶段和之前的步骤都成功
+	Failure  bool // 依赖的阶段或之前的步骤有失败
+	Canceled bool // 执行已被取消
+	Trigger  string
+	Params   map[string]any
+	Matrix   map[string]string // 矩阵阶段中当前组合的变量值
+	Env      map[string]string
+	Git      func(key string) string // 按需读取 git 信息
+}
+
+// Expr 解析后的条件表达式
+type Expr struct {
+	src  string
+	root exprNode
+}
+
+// 表达式中可以使用的函数及参数个数
+var exprFuncs = map[string]int{
+	"success":    0,
+	"failure":    0,
+	"always":     0,
+	"canceled":   0,
+	"contains":   2,
+	"startsWith": 2,
+	"endsWith":   2,
+}
+
+// 表达式中可以使用的 git 信息
+var exprGitKeys = map[string]bool{"branch": true, "commit": true}
+
+// ParseExpr 解析条件表达式, 语法错误、未知函数和未知上下文都会返回错误
+func ParseExpr(src string) (*Expr, error) {
+	text := strings.TrimSpace(src)
+	if strings.HasPrefix(text, "${{") && strings.HasSuffix(text, "}}") {
+		text = strings.TrimSpace(text[3 : len(text)-2])
+	}
+	p := &exprParser{src: text}
+	if err := p.lex(); err != nil {
+		return nil, fmt.Errorf("表达式 %q: %w", src, err)
+	}
+	if len(p.tokens) == 1 {
+		return nil, fmt.Errorf("表达式 %q: 表达式为空", src)
+	}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != tokEOF {
+		err = p.errorf(p.peek(), "多余的 %q", p.peek().text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("表达式 %q: %w", src, err)
+	}
+	return &Expr{src: src, root: root}, nil
+}
+
+func (e *Expr) String() string {
+	return e.src
+}
+
+// Params 表达式中引用的参数名
+func (e *Expr) Params() []string {
+	return e.refs("params")
+}
+
+// Matrix 表达式中引用的矩阵变量名
+func (e *Expr) Matrix() []string {
+	return e.refs("matrix")
+}
+
+func (e *Expr) refs(root string) []string {
+	var names []string
+	walkExpr(e.root, func(n exprNode) {
+		if ref, ok := n.(*refNode); ok && ref.root == root {
+			names = append(names, ref.key)
+		}
+	})
+	return names
+}
+
+// Eval 求值, 结果按真值转换为 bool
+func (e *Expr) Eval(c *ExprContext) (bool, error) {
+	v, err := e.root.eval(c)
+	if err != nil {
+		return false, fmt.Errorf("表达式 %q: %w", e.src, err)
+	}
+	return truthy(v), nil
+}
+
+// UsesStatus 表达式是否调用了状态函数, 没有调用时默认需要 success()
+func (e *Expr) UsesStatus() bool {
+	found := false
+	walkExpr(e.root, func(n exprNode) {
+		if call, ok := n.(*callNode); ok {
+			switch call.name {
+			case "success", "failure", "always", "canceled":
+				found = true
+			}
+		}
+	})
+	return found
+}
+
+// EvalCondition 求值 if 条件, cond 为空时等同于 success()
+// 没有调用状态函数的条件需要同时满足 success()
+func EvalCondition(cond string, c *ExprContext) (bool, error) {
+	return evalCondition(cond, c, c.Success)
+}
+
+// EvalFinallyCondition 求值 finally 步骤的 if 条件, cond 为空或没有调用状态函数时不要求 success()
+func EvalFinallyCondition(cond string, c *ExprContext) (bool, error) {
+	return evalCondition(cond, c, true)
+}
+
+// evalCondition implicit 为没有调用状态函数时默认的状态条件
+func evalCondition(cond string, c *ExprContext, implicit bool) (bool, error) {
+	if strings.TrimSpace(cond) == "" {
+		return implicit, nil
+	}
+	e, err := ParseExpr(cond)
+	if err != nil {
+		return false, err
+	}
+	ok, err := e.Eval(c)
+	if err != nil || !ok {
+		return false, err
+	}
+	return e.UsesStatus() || implicit, nil
+}
+
+// GitInfo 在 dir 中以环境变量 env 读取 git 信息, 不是 git 仓库时返回空字符串
+// env 中的 GIT_DIR 可以指定仓库位置
+func GitInfo(dir string, env []string, key string) string {
+	var args []string
+	switch key {
+	case "branch":
+		args = []string{"rev-parse", "--abbrev-ref", "HEAD"}
+	case "commit":
+		args = []string{"rev-parse", "HEAD"}
+	default:
+		return ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// EnvMap 将 KEY=VALUE 形式的环境变量转换为 map
+func EnvMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, kv := range env {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+type exprNode interface {
+	eval(c *ExprContext) (any, error)
+}
+
+type literalNode struct{ value any }
+
+type refNode struct{ root, key string }
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+type unaryNode struct{ x exprNode }
+
+type binaryNode struct {
+	op   string
+	x, y exprNode
+}
+
+func walkExpr(n exprNode, fn func(exprNode)) {
+	fn(n)
+	switch n := n.(type) {
+	case *callNode:
+		for _, a := range n.args {
+			walkExpr(a, fn)
+		}
+	case *unaryNode:
+		walkExpr(n.x, fn)
+	case *binaryNode:
+		walkExpr(n.x, fn)
+		walkExpr(n.y, fn)
+	}
+}
+
+func (n *literalNode) eval(*ExprContext) (any, error) {
+	return n.value, nil
+}
+
+func (n *refNode) eval(c *ExprContext) (any, error) {
+	switch n.root {
+	case "trigger":
+		return c.Trigger, nil
+	case "params":
+		if v, ok := c.Params[n.key]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "matrix":
+		if v, ok := c.Matrix[n.key]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "env":
+		if v, ok := c.Env[n.key]; ok {
+			return v, nil
+		}
+		return nil, nil
+	case "git":
+		if c.Git == nil {
+			return "", nil
+		}
+		return c.Git(n.key), nil
+	}
+	return nil, fmt.Errorf("未知的上下文 %s", n.root)
+}
+
+func (n *callNode) eval(c *ExprContext) (any, error) {
+	switch n.name {
+	case "success":
+		return c.Success, nil
+	case "failure":
+		return c.Failure, nil
+	case "always":
+		return true, nil
+	case "canceled":
+		return c.Canceled, nil
+	}
+	a, err := n.args[0].eval(c)
+	if err != nil {
+		return nil, err
+	}
+	b, err := n.args[1].eval(c)
+	if err != nil {
+		return nil, err
+	}
+	s, sub := toString(a), toString(b)
+	switch n.name {
+	case "contains":
+		return strings.Contains(s, sub), nil
+	case "startsWith":
+		return strings.HasPrefix(s, sub), nil
+	case "endsWith":
+		return strings.HasSuffix(s, sub), nil
+	}
+	return nil, fmt.Errorf("未知的函数 %s", n.name)
+}
+
+func (n *unaryNode) eval(c *ExprContext) (any, error) {
+	v, err := n.x.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(v), nil
+}
+
+func (n *binaryNode) eval(c *ExprContext) (any, error) {
+	x, err := n.x.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	// && 和 || 短路求值, 避免不必要的 git 调用
+	switch n.op {
+	case "&&":
+		if !truthy(x) {
+			return false, nil
+		}
+		y, err := n.y.eval(c)
+		return truthy(y), err
+	case "||":
+		if truthy(x) {
+			return true, nil
+		}
+		y, err := n.y.eval(c)
+		return truthy(y), err
+	}
+	y, err := n.y.eval(c)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return exprEqual(x, y), nil
+	case "!=":
+		return !exprEqual(x, y), nil
+	}
+	a, okA := toNumber(x)
+	b, okB := toNumber(y)
+	if !okA || !okB {
+		return nil, fmt.Errorf("%s 只能比较数字: %q %s %q", n.op, toString(x), n.op, toString(y))
+	}
+	switch n.op {
+	case "<":
+		return a < b, nil
+	case "<=":
+		return a <= b, nil
+	case ">":
+		return a > b, nil
+	default:
+		return a >= b, nil
+	}
+}
+
+// exprEqual 有一边是数字时按数字比较, 否则按字符串比较
+func exprEqual(x, y any) bool {
+	_, xNum := x.(float64)
+	_, yNum := y.(float64)
+	if xNum || yNum {
+		a, okA := toNumber(x)
+		b, okB := toNumber(y)
+		return okA && okB && a == b
+	}
+	return toString(x) == toString(y)
+}
+
+func truthy(v any) bool {
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+func toString(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(v)
+}
+
+func toNumber(v any) (float64, bool) {
+	switch v := v.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return f, err == nil
+	case bool:
+		if v {
+			return 1, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokIdent
+	tokString
+	tokNumber
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+type exprParser struct {
+	src    string
+	tokens []token
+	i      int
+}
+
+func (p *exprParser) errorf(t token, format string, args ...any) error {
+	return fmt.Errorf("第 %d 个字符: %s", t.pos+1, fmt.Sprintf(format, args...))
+}
+
+func isIdentChar(c byte, first bool) bool {
+	switch {
+	case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		return true
+	case !first && (c == '-' || c >= '0' && c <= '9'):
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) lex() error {
+	s := p.src
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '\'' || c == '"':
+			// 字符串中连续两个引号表示引号本身
+			var b strings.Builder
+			j := i + 1
+			for {
+				if j >= len(s) {
+					return fmt.Errorf("第 %d 个字符: 字符串没有结束", i+1)
+				}
+				if s[j] == c {
+					if j+1 < len(s) && s[j+1] == c {
+						b.WriteByte(c)
+						j += 2
+						continue
+					}
+					break
+				}
+				b.WriteByte(s[j])
+				j++
+			}
+			p.tokens = append(p.tokens, token{tokString, b.String(), i})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(s) && (s[j] >= '0' && s[j] <= '9' || s[j] == '.') {
+				j++
+			}
+			p.tokens = append(p.tokens, token{tokNumber, s[i:j], i})
+			i = j
+		case isIdentChar(c, true):
+			j := i
+			for j < len(s) && isIdentChar(s[j], false) {
+				j++
+			}
+			p.tokens = append(p.tokens, token{tokIdent, s[i:j], i})
+			i = j
+		default:
+			op := ""
+			for _, o := range []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", ",", "."} {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return fmt.Errorf("第 %d 个字符: 无法识别的字符 %q", i+1, c)
+			}
+			p.tokens = append(p.tokens, token{tokOp, op, i})
+			i += len(op)
+		}
+	}
+	p.tokens = append(p.tokens, token{tokEOF, "", len(s)})
+	return nil
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.i]
+}
+
+func (p *exprParser) next() token {
+	t := p.tokens[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *exprParser) isOp(text string) bool {
+	t := p.peek()
+	return t.kind == tokOp && t.text == text
+}
+
+func (p *exprParser) expect(text string) error {
+	if !p.isOp(text) {
+		t := p.peek()
+		if t.kind == tokEOF {
+			return p.errorf(t, "缺少 %q", text)
+		}
+		return p.errorf(t, "需要 %q, 实际是 %q", text, t.text)
+	}
+	p.next()
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryNode{op: "||", x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = &binaryNode{op: "&&", x: x, y: y}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.isOp("!") {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &unaryNode{x: x}, nil
+	}
+	return p.parseCompare()
+}
+
+func (p *exprParser) parseCompare() (exprNode, error) {
+	x, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	for _, op := range []string{"==", "!=", "<=", ">=", "<", ">"} {
+		if p.isOp(op) {
+			p.next()
+			y, err := p.parsePrimary()
+			if err != nil {
+				return nil, err
+			}
+			return &binaryNode{op: op, x: x, y: y}, nil
+		}
+	}
+	return x, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokEOF:
+		return nil, p.errorf(t, "表达式不完整")
+	case tokString:
+		return &literalNode{value: t.text}, nil
+	case tokNumber:
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf(t, "无效的数字 %q", t.text)
+		}
+		return &literalNode{value: f}, nil
+	case tokOp:
+		if t.text == "(" {
+			x, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			return x, p.expect(")")
+		}
+		return nil, p.errorf(t, "不应出现 %q", t.text)
+	}
+
+	switch t.text {
+	case "true":
+		return &literalNode{value: true}, nil
+	case "false":
+		return &literalNode{value: false}, nil
+	case "null":
+		return &literalNode{value: nil}, nil
+	}
+	if p.isOp("(") {
+		return p.parseCall(t)
+	}
+	switch t.text {
+	case "trigger":
+		return &refNode{root: t.text}, nil
+	case "params", "matrix", "env", "git":
+		if err := p.expect("."); err != nil {
+			return nil, err
+		}
+		key := p.next()
+		if key.kind != tokIdent {
+			return nil, p.errorf(key, "%s. 后面需要名称", t.text)
+		}
+		if t.text == "git" && !exprGitKeys[key.text] {
+			return nil, p.errorf(key, "未知的 git 信息 %q, 可用 git.branch、git.commit", key.text)
+		}
+		return &refNode{root: t.text, key: key.text}, nil
+	}
+	return nil, p.errorf(t, "未知的名称 %q, 可用 trigger、params.*、matrix.*、env.*、git.*", t.text)
+}
+
+func (p *exprParser) parseCall(name token) (exprNode, error) {
+	arity, ok := exprFuncs[name.text]
+	if !ok {
+		return nil, p.errorf(name, "未知的函数 %s()", name.text)
+	}
+	p.next()
+	call := &callNode{name: name.text}
+	for !p.isOp(")") {
+		if len(call.args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		call.args = append(call.args, arg)
+	}
+	p.next()
+	if len(call.args) != arity {
+		return nil, p.errorf(name, "%s() 需要 %d 个参数, 实际是 %d 个", name.text, arity, len(call.args))
+	}
+	return call, nil
+}
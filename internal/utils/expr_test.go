@@ -0,0 +1,235 @@
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExprEval(t *testing.T) {
+	c := &ExprContext{
+		Success: true,
+		Trigger: "manual",
+		Params:  map[string]any{"version": "1.2.0", "replicas": float64(3), "dry_run": false},
+		Matrix:  map[string]string{"os": "linux"},
+		Env:     map[string]string{"DEPLOY_ENV": "prod", "EMPTY": ""},
+		Git: func(key string) string {
+			return map[string]string{"branch": "main", "commit": "0123abc"}[key]
+		},
+	}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"true", true},
+		{"false", false},
+		{"null", false},
+		{"'main'", true},
+		{"''", false},
+		{"0", false},
+		{"1.5", true},
+		{"trigger == 'manual'", true},
+		{`trigger != "manual"`, false},
+		{"${{ git.branch == 'main' }}", true},
+		{"git.commit == '0123abc'", true},
+		{"params.version == '1.2.0'", true},
+		{"params.replicas == 3", true},
+		{"params.replicas == '3'", true},
+		{"params.replicas >= 3 && params.replicas < 4", true},
+		{"params.replicas > 3", false},
+		{"'10' > 9", true},
+		{"params.dry_run", false},
+		{"!params.dry_run", true},
+		{"params.missing == null", true},
+		{"matrix.os == 'linux'", true},
+		{"env.DEPLOY_ENV == 'prod'", true},
+		{"env.EMPTY", false},
+		{"env.MISSING == ''", true},
+		{"contains(params.version, '.2.')", true},
+		{"startsWith(git.branch, 'ma')", true},
+		{"endsWith(git.branch, 'in')", true},
+		{"contains(params.version, 'rc')", false},
+		{"true || false && false", true},
+		{"(true || false) && false", false},
+		{"!(trigger == 'manual') || env.DEPLOY_ENV == 'prod'", true},
+		{"success()", true},
+		{"failure()", false},
+		{"always()", true},
+		{"canceled()", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			e, err := ParseExpr(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := e.Eval(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("结果为 %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExprShortCircuit(t *testing.T) {
+	calls := 0
+	c := &ExprContext{Git: func(string) string {
+		calls++
+		return "main"
+	}}
+	for _, expr := range []string{"false && git.branch == 'main'", "true || git.branch == 'main'"} {
+		e, err := ParseExpr(expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.Eval(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if calls != 0 {
+		t.Fatalf("短路求值时读取了 %d 次 git 信息", calls)
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []struct {
+		expr    string
+		message string
+	}{
+		{"", "表达式为空"},
+		{"${{ }}", "表达式为空"},
+		{"trigger ==", "表达式不完整"},
+		{"(trigger == 'manual'", `缺少 ")"`},
+		{"trigger == 'manual')", `多余的 ")"`},
+		{"'main", "字符串没有结束"},
+		{"branch == 'main'", `未知的名称 "branch"`},
+		{"git.tag == 'v1'", `未知的 git 信息 "tag"`},
+		{"params.", "params. 后面需要名称"},
+		{"lower(trigger)", "未知的函数 lower()"},
+		{"contains('a')", "contains() 需要 2 个参数, 实际是 1 个"},
+		{"success(1)", "success() 需要 0 个参数, 实际是 1 个"},
+		{"trigger = 'manual'", "第 9 个字符"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := ParseExpr(tt.expr)
+			if err == nil {
+				t.Fatal("期望解析失败")
+			}
+			if !strings.Contains(err.Error(), tt.message) {
+				t.Fatalf("错误为 %q, 期望包含 %q", err, tt.message)
+			}
+		})
+	}
+}
+
+func TestExprCompareNonNumber(t *testing.T) {
+	e, err := ParseExpr("trigger > 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Eval(&ExprContext{Trigger: "manual"}); err == nil || !strings.Contains(err.Error(), "只能比较数字") {
+		t.Fatalf("错误为 %v, 期望只能比较数字", err)
+	}
+}
+
+func TestExprRefs(t *testing.T) {
+	e, err := ParseExpr("params.a == matrix.os || contains(params.b, env.X) && !matrix.arch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := e.Params(); !slices.Equal(got, []string{"a", "b"}) {
+		t.Fatalf("Params() = %v", got)
+	}
+	if got := e.Matrix(); !slices.Equal(got, []string{"os", "arch"}) {
+		t.Fatalf("Matrix() = %v", got)
+	}
+	if e.UsesStatus() {
+		t.Fatal("没有调用状态函数")
+	}
+	if e, _ := ParseExpr("failure() && params.a"); !e.UsesStatus() {
+		t.Fatal("调用了状态函数")
+	}
+}
+
+func TestEvalCondition(t *testing.T) {
+	tests := []struct {
+		cond    string
+		success bool
+		failure bool
+		want    bool
+		finally bool // EvalFinallyCondition 的结果
+	}{
+		{"", true, false, true, true},
+		{"", false, true, false, true},
+		{"trigger == 'manual'", true, false, true, true},
+		{"trigger == 'manual'", false, true, false, true},
+		{"failure()", false, true, true, true},
+		{"failure()", true, false, false, false},
+		{"always() && trigger == 'manual'", false, true, true, true},
+	}
+	for _, tt := range tests {
+		c := &ExprContext{Success: tt.success, Failure: tt.failure, Trigger: "manual"}
+		got, err := EvalCondition(tt.cond, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("EvalCondition(%q) success=%v 结果为 %v, 期望 %v", tt.cond, tt.success, got, tt.want)
+		}
+		got, err = EvalFinallyCondition(tt.cond, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.finally {
+			t.Errorf("EvalFinallyCondition(%q) success=%v 结果为 %v, 期望 %v", tt.cond, tt.success, got, tt.finally)
+		}
+	}
+}
+
+func TestGitInfo(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("没有 git")
+	}
+	// 代码克隆在工作目录的子目录中, 工作目录本身不是 git 仓库
+	workDir := t.TempDir()
+	repo := filepath.Join(workDir, "app")
+	if err := os.Mkdir(repo, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	env := append(os.Environ(),
+		"GIT_AUTHOR_NAME=pubot", "GIT_AUTHOR_EMAIL=pubot@example.com",
+		"GIT_COMMITTER_NAME=pubot", "GIT_COMMITTER_EMAIL=pubot@example.com",
+		"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1",
+	)
+	for _, args := range [][]string{
+		{"init", "-q", "-b", "release"},
+		{"commit", "-q", "--allow-empty", "-m", "init"},
+	} {
+		cmd := exec.Command("git", args...)
+		cmd.Dir, cmd.Env = repo, env
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+
+	if got := GitInfo(workDir, env, "branch"); got != "" {
+		t.Fatalf("工作目录不是 git 仓库, branch 为 %q", got)
+	}
+	if got := GitInfo(repo, env, "branch"); got != "release" {
+		t.Fatalf("branch 为 %q, 期望 release", got)
+	}
+	if got := GitInfo(repo, env, "commit"); len(got) != 40 {
+		t.Fatalf("commit 为 %q", got)
+	}
+	// GIT_DIR 指定仓库时不依赖所在目录
+	if got := GitInfo(workDir, append(env, "GIT_DIR="+filepath.Join(repo, ".git")), "branch"); got != "release" {
+		t.Fatalf("使用 GIT_DIR 时 branch 为 %q, 期望 release", got)
+	}
+}
@@ -0,0 +1,164 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"pubot/internal/dto"
+)
+
+// validateHostGroups 检查 host_groups 中每个主机组的主机
+func validateHostGroups(groups map[string][]dto.Host) error {
+	for name, hosts := range groups {
+		if name == "" {
+			return errors.New("主机组名称不能为空")
+		}
+		if len(hosts) == 0 {
+			return atPath(name, fmt.Errorf("%s 主机组不能为空", name))
+		}
+		if err := validateHostList(name+" 主机组", hosts); err != nil {
+			return atPath(name, err)
+		}
+	}
+	return nil
+}
+
+// validateHosts 检查阶段的目标主机和 ssh 设置, hosts 写主机组名称时主机组需要在 host_groups 中定义
+func validateHosts(scope string, s *dto.Stage, groups map[string][]dto.Host) error {
+	if s.Hosts == nil {
+		switch {
+		case s.SSH != nil:
+			return atPath("ssh", fmt.Errorf("%s设置了 ssh, 但没有设置 hosts", scope))
+		case s.Strategy != "":
+			return atPath("strategy", fmt.Errorf("%s设置了 strategy, 但没有设置 hosts", scope))
+		}
+		return nil
+	}
+	if err := validateStrategy(scope, s); err != nil {
+		return err
+	}
+	if s.SSH != nil {
+		if s.SSH.Port < 0 || s.SSH.Port > 65535 {
+			return atPath("ssh.port", fmt.Errorf("%s的 ssh.port 无效: %d", scope, s.SSH.Port))
+		}
+		if s.SSH.Timeout < 0 {
+			return atPath("ssh.timeout", fmt.Errorf("%s的 ssh.timeout 不能小于 0", scope))
+		}
+		if err := validateCredentials(scope+" ssh", s.SSH.Password, s.SSH.Key, s.SSH.Passphrase); err != nil {
+			return atPath("ssh", err)
+		}
+	}
+	hosts := s.Hosts.List
+	if s.Hosts.Group != "" {
+		group, ok := groups[s.Hosts.Group]
+		if !ok {
+			return atPath("hosts", fmt.Errorf("%s的主机组不存在: %s", scope, s.Hosts.Group))
+		}
+		hosts = group
+	}
+	if len(hosts) == 0 {
+		return atPath("hosts", fmt.Errorf("%s的 hosts 不能为空", scope))
+	}
+	if err := validateHostList(scope, hosts); err != nil {
+		return atPath("hosts", err)
+	}
+	return nil
+}
+
+// validateStrategy 检查目标主机的执行策略, batch_size、pause 和 max_failures 只能用于滚动部署
+func validateStrategy(scope string, s *dto.Stage) error {
+	switch s.Strategy {
+	case "", dto.StrategyParallel:
+		key := ""
+		switch {
+		case s.BatchSize != "":
+			key = "batch_size"
+		case s.Pause != 0:
+			key = "pause"
+		case s.MaxFailures != 0:
+			key = "max_failures"
+		}
+		if key != "" {
+			return atPath(key, fmt.Errorf("%s的 %s 只能在 strategy 为 %s 时使用", scope, key, dto.StrategyRolling))
+		}
+	case dto.StrategyRolling:
+		if _, err := BatchSize(s.BatchSize, 1); err != nil {
+			return atPath("batch_size", fmt.Errorf("%s的 batch_size 无效: %v", scope, err))
+		}
+		if s.Pause < 0 {
+			return atPath("pause", fmt.Errorf("%s的 pause 不能小于 0", scope))
+		}
+		if s.MaxFailures < 0 {
+			return atPath("max_failures", fmt.Errorf("%s的 max_failures 不能小于 0", scope))
+		}
+	default:
+		return atPath("strategy", fmt.Errorf("%s的 strategy 只能是 %s 或 %s: %q", scope, dto.StrategyParallel, dto.StrategyRolling, s.Strategy))
+	}
+	return nil
+}
+
+// BatchSize 滚动部署每批的主机数, size 为数量或百分比(按主机总数向上取整), 为空时每批 1 台
+func BatchSize(size string, total int) (int, error) {
+	if size == "" {
+		return 1, nil
+	}
+	if pct, ok := strings.CutSuffix(size, "%"); ok {
+		n, err := strconv.Atoi(pct)
+		if err != nil || n <= 0 || n > 100 {
+			return 0, fmt.Errorf("百分比应在 1%% 到 100%% 之间: %q", size)
+		}
+		return max((total*n+99)/100, 1), nil
+	}
+	n, err := strconv.Atoi(size)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("应为正整数或百分比(例如 2、25%%): %q", size)
+	}
+	return n, nil
+}
+
+// HostBatches 按 batch_size 将主机分批, 不是滚动部署时所有主机为一批
+func HostBatches(s dto.Stage) ([][]dto.Host, error) {
+	hosts := s.Hosts.List
+	if s.Strategy != dto.StrategyRolling {
+		return [][]dto.Host{hosts}, nil
+	}
+	size, err := BatchSize(s.BatchSize, len(hosts))
+	if err != nil {
+		return nil, err
+	}
+	return slices.Collect(slices.Chunk(hosts, size)), nil
+}
+
+// validateHostList 检查主机的地址和端口, 主机的名称不能重复
+func validateHostList(scope string, hosts []dto.Host) error {
+	labels := make([]string, 0, len(hosts))
+	for i, h := range hosts {
+		at := fmt.Sprintf("[%d]", i)
+		if h.Address == "" {
+			return atPath(at, fmt.Errorf("%s的第 %d 个主机没有设置 address", scope, i+1))
+		}
+		if h.Port < 0 || h.Port > 65535 {
+			return atPath(at, fmt.Errorf("%s的主机 %s 端口无效: %d", scope, h.Address, h.Port))
+		}
+		if slices.Contains(labels, h.Label()) {
+			return atPath(at, fmt.Errorf("%s的主机重复: %s, 可以通过 name 区分", scope, h.Label()))
+		}
+		if err := validateCredentials(fmt.Sprintf("%s的主机 %s", scope, h.Label()), h.Password, h.Key, ""); err != nil {
+			return atPath(at, err)
+		}
+		labels = append(labels, h.Label())
+	}
+	return nil
+}
+
+// expandHostGroups 将阶段 hosts 中的主机组名称展开为主机列表, 需要已经通过校验
+func expandHostGroups(p *dto.TaskYAML) {
+	for i := range p.Stages {
+		if h := p.Stages[i].Hosts; h != nil && h.Group != "" {
+			p.Stages[i].Hosts = &dto.Hosts{Group: h.Group, List: slices.Clone(p.HostGroups[h.Group])}
+		}
+	}
+}
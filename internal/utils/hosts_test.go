@@ -0,0 +1,96 @@
+package utils
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"pubot/internal/dto"
+)
+
+func TestBatchSize(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    string
+		total   int
+		want    int
+		message string // 期望的错误信息片段, 为空表示没有错误
+	}{
+		{name: "default", size: "", total: 5, want: 1},
+		{name: "count", size: "2", total: 5, want: 2},
+		{name: "count over total", size: "10", total: 3, want: 10},
+		{name: "percent round up", size: "25%", total: 10, want: 3},
+		{name: "percent below one host", size: "1%", total: 10, want: 1},
+		{name: "percent of few hosts", size: "33%", total: 3, want: 1},
+		{name: "percent half", size: "50%", total: 3, want: 2},
+		{name: "percent all", size: "100%", total: 7, want: 7},
+		{name: "zero percent", size: "0%", message: "百分比应在 1% 到 100% 之间"},
+		{name: "over 100 percent", size: "150%", message: "百分比应在 1% 到 100% 之间"},
+		{name: "invalid percent", size: "x%", message: "百分比应在 1% 到 100% 之间"},
+		{name: "zero", size: "0", message: "应为正整数或百分比"},
+		{name: "negative", size: "-1", message: "应为正整数或百分比"},
+		{name: "not number", size: "all", message: "应为正整数或百分比"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BatchSize(tt.size, tt.total)
+			if tt.message != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.message) {
+					t.Fatalf("错误为 %v, 期望包含 %q", err, tt.message)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("每批 %d 台, 错误 %v, 期望 %d 台", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostBatches(t *testing.T) {
+	hosts := func(n int) *dto.Hosts {
+		list := make([]dto.Host, n)
+		for i := range list {
+			list[i] = dto.Host{Address: fmt.Sprintf("10.0.0.%d", i+1)}
+		}
+		return &dto.Hosts{List: list}
+	}
+	tests := []struct {
+		name  string
+		stage dto.Stage
+		want  []int // 每批的主机数
+	}{
+		{name: "parallel", stage: dto.Stage{Hosts: hosts(5), BatchSize: "2"}, want: []int{5}},
+		{name: "rolling default", stage: dto.Stage{Hosts: hosts(3), Strategy: dto.StrategyRolling}, want: []int{1, 1, 1}},
+		{name: "rolling count", stage: dto.Stage{Hosts: hosts(5), Strategy: dto.StrategyRolling, BatchSize: "2"}, want: []int{2, 2, 1}},
+		{name: "rolling percent", stage: dto.Stage{Hosts: hosts(5), Strategy: dto.StrategyRolling, BatchSize: "50%"}, want: []int{3, 2}},
+		{name: "fewer hosts than batch", stage: dto.Stage{Hosts: hosts(2), Strategy: dto.StrategyRolling, BatchSize: "5"}, want: []int{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			batches, err := HostBatches(tt.stage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]int, len(batches))
+			next := 0
+			for i, b := range batches {
+				got[i] = len(b)
+				for _, h := range b {
+					if h != tt.stage.Hosts.List[next] {
+						t.Fatalf("第 %d 批的主机顺序不对: %v", i+1, batches)
+					}
+					next++
+				}
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("每批的主机数为 %v, 期望 %v", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := HostBatches(dto.Stage{Hosts: hosts(2), Strategy: dto.StrategyRolling, BatchSize: "0%"}); err == nil {
+		t.Fatal("无效的 batch_size 应返回错误")
+	}
+}
@@ -0,0 +1,64 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"pubot/internal/dto"
+)
+
+var labelRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// NormalizeLabels 去掉标签两端的空白和空标签, 去重后排序
+// 标签只能包含字母、数字、点、下划线和减号, 且以字母或数字开头
+func NormalizeLabels(labels []string) ([]string, error) {
+	result := make([]string, 0, len(labels))
+	for _, l := range labels {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+		if !labelRe.MatchString(l) {
+			return nil, fmt.Errorf("无效的标签 %q, 只能包含字母、数字、点、下划线和减号", l)
+		}
+		result = append(result, l)
+	}
+	slices.Sort(result)
+	return slices.Compact(result), nil
+}
+
+// MatchLabels have 中是否包含 want 中的所有标签
+func MatchLabels(have, want []string) bool {
+	for _, l := range want {
+		if !slices.Contains(have, l) {
+			return false
+		}
+	}
+	return true
+}
+
+// validateRunsOn 检查 runs-on 中的标签
+func validateRunsOn(scope string, labels []string) error {
+	if _, err := NormalizeLabels(labels); err != nil {
+		return fmt.Errorf("%s的 runs-on: %w", scope, err)
+	}
+	return nil
+}
+
+// inheritRunsOn 没有设置 hosts、platform 和 runs-on 的阶段使用任务的 runs-on
+func inheritRunsOn(p *dto.TaskYAML) {
+	if len(p.RunsOn) == 0 {
+		return
+	}
+	for i := range p.Stages {
+		if inheritsRunsOn(&p.Stages[i]) {
+			p.Stages[i].RunsOn = slices.Clone(p.RunsOn)
+		}
+	}
+}
+
+func inheritsRunsOn(s *dto.Stage) bool {
+	return s.Hosts == nil && s.Platform == "" && len(s.RunsOn) == 0
+}
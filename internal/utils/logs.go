@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	logReplayLimit = 10000 // 每个任务缓存的最大行数, 供后加入的订阅者回放
+	logSubBuffer   = 1024  // 订阅者通道缓冲, 写满视为慢消费者并断开
+)
+
+// LogLine 执行过程中输出的一行日志
+type LogLine struct {
+	Run    int       `json:"run"`
+	Time   time.Time `json:"ts"`
+	Stream string    `json:"stream"`
+	Stage  string    `json:"stage,omitempty"`
+	Step   int       `json:"step,omitempty"`
+	Text   string    `json:"text"`
+}
+
+type logStream struct {
+	lines []LogLine
+	subs  map[chan LogLine]struct{}
+}
+
+// LogHub 按任务向订阅者实时分发当前执行的输出
+type LogHub struct {
+	mu    sync.Mutex
+	tasks map[uint]*logStream
+}
+
+func NewLogHub() *LogHub {
+	return &LogHub{
+		tasks: make(map[uint]*logStream),
+	}
+}
+
+func (h *LogHub) stream(taskID uint) *logStream {
+	s, ok := h.tasks[taskID]
+	if !ok {
+		s = &logStream{subs: make(map[chan LogLine]struct{})}
+		h.tasks[taskID] = s
+	}
+	return s
+}
+
+// Begin 任务开始新的一次执行, 清空上一次执行的缓存
+func (h *LogHub) Begin(taskID uint) {
+	h.mu.Lock()
+	h.stream(taskID).lines = nil
+	h.mu.Unlock()
+}
+
+// Publish 缓存并分发一行输出
+func (h *LogHub) Publish(taskID uint, line LogLine) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.stream(taskID)
+	if len(s.lines) >= logReplayLimit {
+		s.lines = s.lines[1:]
+	}
+	s.lines = append(s.lines, line)
+	for ch := range s.subs {
+		select {
+		case ch <- line:
+		default:
+			// 慢消费者不能阻塞任务执行
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe 订阅任务输出, 返回当前执行已输出的行和后续的实时输出
+func (h *LogHub) Subscribe(taskID uint) ([]LogLine, <-chan LogLine, func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.stream(taskID)
+	history := make([]LogLine, len(s.lines))
+	copy(history, s.lines)
+	ch := make(chan LogLine, logSubBuffer)
+	s.subs[ch] = struct{}{}
+	cancel := func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := s.subs[ch]; ok {
+			delete(s.subs, ch)
+			close(ch)
+		}
+	}
+	return history, ch, cancel
+}
+
+// ServeWS 推送任务 {id} 的实时输出, 连接建立后先回放当前执行已输出的行
+func (h *LogHub) ServeWS(w http.ResponseWriter, r *http.Request) {
+	taskId, err := strconv.ParseUint(mux.Vars(r)["id"], 10, 0)
+	if err != nil {
+		http.Error(w, "Invalid task id", http.StatusBadRequest)
+		return
+	}
+	conn, err := upgradeWS(w, r)
+	if err != nil {
+		slog.Error("ws 升级失败", slog.Any("Err", err.Error()))
+		return
+	}
+	defer conn.Close()
+
+	history, lines, cancel := h.Subscribe(uint(taskId))
+	defer cancel()
+
+	// 读协程只用于感知客户端断开
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for _, line := range history {
+		if err := conn.WriteJSON(line); err != nil {
+			return
+		}
+	}
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"))
+				return
+			}
+			if err := conn.WriteJSON(line); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// receive 从订阅的通道读取一行, 超时失败
+func receive(t *testing.T, ch <-chan LogLine) LogLine {
+	t.Helper()
+	select {
+	case line, ok := <-ch:
+		if !ok {
+			t.Fatal("订阅已关闭")
+		}
+		return line
+	case <-time.After(time.Second):
+		t.Fatal("没有收到输出")
+		return LogLine{}
+	}
+}
+
+func TestLogHubReplay(t *testing.T) {
+	h := NewLogHub()
+	h.Begin(1)
+	h.Publish(1, LogLine{Run: 1, Stream: StreamStdout, Text: "old"})
+	// 新的执行开始后不再回放上一次执行的输出
+	h.Begin(1)
+	h.Publish(1, LogLine{Run: 2, Stream: StreamStdout, Text: "a"})
+	h.Publish(1, LogLine{Run: 2, Stream: StreamStderr, Text: "b"})
+	h.Publish(2, LogLine{Run: 1, Stream: StreamStdout, Text: "other task"})
+
+	history, ch, unsubscribe := h.Subscribe(1)
+	defer unsubscribe()
+	if len(history) != 2 || history[0].Text != "a" || history[1].Text != "b" || history[1].Stream != StreamStderr {
+		t.Fatalf("回放的输出为 %+v", history)
+	}
+
+	// 后加入的订阅者先拿到已输出的行, 再收到实时输出
+	h.Publish(1, LogLine{Run: 2, Stream: StreamStdout, Text: "c"})
+	h.Publish(2, LogLine{Run: 1, Stream: StreamStdout, Text: "other task"})
+	if line := receive(t, ch); line.Text != "c" {
+		t.Fatalf("实时输出为 %+v, 期望 c", line)
+	}
+	select {
+	case line := <-ch:
+		t.Fatalf("收到了其他任务的输出 %+v", line)
+	default:
+	}
+
+	unsubscribe()
+	if _, ok := <-ch; ok {
+		t.Fatal("取消订阅后通道应关闭")
+	}
+	unsubscribe()
+}
+
+func TestLogHubSlowSubscriber(t *testing.T) {
+	h := NewLogHub()
+	_, ch, unsubscribe := h.Subscribe(1)
+	defer unsubscribe()
+	// 订阅者不读取时, 缓冲写满后断开, 不阻塞执行
+	for i := 0; i <= logSubBuffer; i++ {
+		h.Publish(1, LogLine{Text: "line"})
+	}
+	n := 0
+	for range ch {
+		n++
+	}
+	if n != logSubBuffer {
+		t.Fatalf("断开前收到 %d 行, 期望 %d 行", n, logSubBuffer)
+	}
+}
+
+func TestLogHubReplayLimit(t *testing.T) {
+	h := NewLogHub()
+	for i := 0; i < logReplayLimit+10; i++ {
+		h.Publish(1, LogLine{Step: i})
+	}
+	history, _, unsubscribe := h.Subscribe(1)
+	defer unsubscribe()
+	if len(history) != logReplayLimit || history[0].Step != 10 {
+		t.Fatalf("缓存了 %d 行, 第一行为 %d, 期望只保留最后 %d 行", len(history), history[0].Step, logReplayLimit)
+	}
+}
@@ -0,0 +1,191 @@
+package utils
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+
+	"pubot/internal/dto"
+)
+
+var (
+	matrixVarRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	// ${{ matrix.名称 }} 占位符中的矩阵变量
+	matrixRefRe = regexp.MustCompile(`^matrix\.([A-Za-z_][A-Za-z0-9_]*)$`)
+)
+
+// 一个矩阵阶段最多展开的组合数
+const maxMatrixCells = 256
+
+// MatrixCell 矩阵中的一个组合
+type MatrixCell struct {
+	Names  []string // 变量名, 按书写顺序
+	Values map[string]string
+}
+
+// Label 按变量顺序列出取值, 例如 "18, linux-amd64"
+func (c MatrixCell) Label() string {
+	values := make([]string, len(c.Names))
+	for i, name := range c.Names {
+		values[i] = c.Values[name]
+	}
+	return strings.Join(values, ", ")
+}
+
+// Env 组合的环境变量, 变量名为 MATRIX_ 加上大写的矩阵变量名
+func (c MatrixCell) Env() map[string]string {
+	env := make(map[string]string, len(c.Values))
+	for name, v := range c.Values {
+		env["MATRIX_"+strings.ToUpper(name)] = v
+	}
+	return env
+}
+
+// matrixNames 矩阵的变量名, 只用 include 定义组合时为 include 中的键
+func matrixNames(m *dto.Matrix) []string {
+	names := make([]string, 0, len(m.Vars))
+	for _, v := range m.Vars {
+		names = append(names, v.Name)
+	}
+	if len(names) == 0 && len(m.Include) > 0 {
+		names = slices.Sorted(maps.Keys(m.Include[0]))
+	}
+	return names
+}
+
+// ExpandMatrix 按变量的书写顺序展开所有组合, 去掉 exclude 匹配的组合后追加 include 中的组合
+func ExpandMatrix(m *dto.Matrix) []MatrixCell {
+	names := matrixNames(m)
+	var combos []map[string]string
+	if len(m.Vars) > 0 {
+		combos = []map[string]string{{}}
+		for _, v := range m.Vars {
+			next := make([]map[string]string, 0, len(combos)*len(v.Values))
+			for _, combo := range combos {
+				for _, value := range v.Values {
+					c := maps.Clone(combo)
+					c[v.Name] = value
+					next = append(next, c)
+				}
+			}
+			combos = next
+		}
+	}
+	combos = slices.DeleteFunc(combos, func(combo map[string]string) bool {
+		return slices.ContainsFunc(m.Exclude, func(ex map[string]string) bool {
+			for k, v := range ex {
+				if combo[k] != v {
+					return false
+				}
+			}
+			return true
+		})
+	})
+	for _, inc := range m.Include {
+		if !slices.ContainsFunc(combos, func(combo map[string]string) bool { return maps.Equal(combo, inc) }) {
+			combos = append(combos, maps.Clone(inc))
+		}
+	}
+	cells := make([]MatrixCell, len(combos))
+	for i, combo := range combos {
+		cells[i] = MatrixCell{Names: names, Values: combo}
+	}
+	return cells
+}
+
+// ApplyMatrix 返回阶段的副本, 其中步骤命令、上传下载路径和环境变量中的 ${{ matrix.名称 }} 替换为组合的取值
+func ApplyMatrix(s dto.Stage, cell MatrixCell) dto.Stage {
+	replace := func(text string) string {
+		return placeholderRe.ReplaceAllStringFunc(text, func(m string) string {
+			ref := matrixRefRe.FindStringSubmatch(placeholderRe.FindStringSubmatch(m)[1])
+			if ref == nil {
+				return m
+			}
+			return cell.Values[ref[1]]
+		})
+	}
+	replaceEnv := func(env map[string]string) map[string]string {
+		if env == nil {
+			return nil
+		}
+		replaced := make(map[string]string, len(env))
+		for k, v := range env {
+			replaced[k] = replace(v)
+		}
+		return replaced
+	}
+	replaceSteps := func(steps []dto.Step) []dto.Step {
+		replaced := slices.Clone(steps)
+		for i := range replaced {
+			replaced[i].Run = replace(replaced[i].Run)
+			replaced[i].Upload = replaceTransfer(replaced[i].Upload, replace)
+			replaced[i].Download = replaceTransfer(replaced[i].Download, replace)
+			replaced[i].Env = replaceEnv(replaced[i].Env)
+		}
+		return replaced
+	}
+	s.Env = replaceEnv(s.Env)
+	s.Steps = replaceSteps(s.Steps)
+	s.Finally = replaceSteps(s.Finally)
+	return s
+}
+
+// validateMatrix 检查矩阵变量、include/exclude 和组合数, 返回的 declared 加上了 matrix.变量名
+func validateMatrix(scope string, m *dto.Matrix, declared map[string]bool) (map[string]bool, error) {
+	if len(m.Vars) == 0 && len(m.Include) == 0 {
+		return nil, fmt.Errorf("%s的 matrix 至少需要一个变量或 include 组合", scope)
+	}
+	if m.MaxParallel < 0 {
+		return nil, atPath("max_parallel", fmt.Errorf("%s的 matrix.max_parallel 不能小于 0", scope))
+	}
+	names := matrixNames(m)
+	for _, v := range m.Vars {
+		if !matrixVarRe.MatchString(v.Name) {
+			return nil, atPath(v.Name, fmt.Errorf("%s的矩阵变量名无效: %q", scope, v.Name))
+		}
+		if len(v.Values) == 0 {
+			return nil, atPath(v.Name, fmt.Errorf("%s的矩阵变量 %s 至少需要一个取值", scope, v.Name))
+		}
+	}
+	for i, inc := range m.Include {
+		if !slices.Equal(slices.Sorted(maps.Keys(inc)), slices.Sorted(slices.Values(names))) {
+			return nil, atPath(fmt.Sprintf("include[%d]", i), fmt.Errorf("%s的 matrix.include 每一项都需要设置且只能设置这些变量: %s", scope, strings.Join(names, "、")))
+		}
+		for k := range inc {
+			if !matrixVarRe.MatchString(k) {
+				return nil, atPath(fmt.Sprintf("include[%d].%s", i, k), fmt.Errorf("%s的矩阵变量名无效: %q", scope, k))
+			}
+		}
+	}
+	for i, ex := range m.Exclude {
+		if len(ex) == 0 {
+			return nil, atPath(fmt.Sprintf("exclude[%d]", i), fmt.Errorf("%s的 matrix.exclude 项不能为空", scope))
+		}
+		for k := range ex {
+			if !slices.Contains(names, k) {
+				return nil, atPath(fmt.Sprintf("exclude[%d].%s", i, k), fmt.Errorf("%s的 matrix.exclude 中的变量未声明: %s", scope, k))
+			}
+		}
+	}
+	// 先按变量取值数估算, 避免展开过多的组合
+	product := 1
+	for _, v := range m.Vars {
+		if product *= len(v.Values); product > maxMatrixCells*16 {
+			return nil, fmt.Errorf("%s的 matrix 组合数超过上限 %d", scope, maxMatrixCells)
+		}
+	}
+	switch cells := len(ExpandMatrix(m)); {
+	case cells == 0:
+		return nil, fmt.Errorf("%s的 matrix 排除后没有任何组合", scope)
+	case cells > maxMatrixCells:
+		return nil, fmt.Errorf("%s的 matrix 组合数 %d 超过上限 %d", scope, cells, maxMatrixCells)
+	}
+
+	withMatrix := maps.Clone(declared)
+	for _, name := range names {
+		withMatrix["matrix."+name] = true
+	}
+	return withMatrix, nil
+}
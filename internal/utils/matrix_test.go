@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	"pubot/internal/dto"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	tests := []struct {
+		name   string
+		matrix string
+		want   []string // 各组合的 Label
+	}{
+		{"单个变量", `node: [18, 20]`, []string{"18", "20"}},
+		{"变量的组合按书写顺序", `{target: [amd64, arm64], node: [18, 20]}`,
+			[]string{"amd64, 18", "amd64, 20", "arm64, 18", "arm64, 20"}},
+		{"exclude 部分匹配", `{node: [18, 20], target: [amd64, arm64], exclude: [{node: "20"}]}`,
+			[]string{"18, amd64", "18, arm64"}},
+		{"exclude 完全匹配", `{node: [18, 20], target: [amd64, arm64], exclude: [{node: "20", target: arm64}]}`,
+			[]string{"18, amd64", "18, arm64", "20, amd64"}},
+		{"include 添加组合", `{node: [18], target: [amd64], include: [{node: "22", target: riscv64}]}`,
+			[]string{"18, amd64", "22, riscv64"}},
+		{"include 已有的组合不重复", `{node: [18, 20], include: [{node: "20"}]}`,
+			[]string{"18", "20"}},
+		{"include 可以加回被 exclude 的组合", `{node: [18, 20], exclude: [{node: "20"}], include: [{node: "20"}]}`,
+			[]string{"18", "20"}},
+		{"只有 include", `{include: [{os: linux, arch: amd64}, {os: darwin, arch: arm64}]}`,
+			[]string{"amd64, linux", "arm64, darwin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m dto.Matrix
+			if err := yaml.Unmarshal([]byte(tt.matrix), &m); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, c := range ExpandMatrix(&m) {
+				got = append(got, c.Label())
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("组合为 %q, 期望 %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApplyMatrix(t *testing.T) {
+	cell := MatrixCell{Names: []string{"node", "target"}, Values: map[string]string{"node": "20", "target": "linux-arm64"}}
+	s := dto.Stage{
+		Name: "build",
+		Env:  map[string]string{"NODE": "${{ matrix.node }}"},
+		Steps: []dto.Step{
+			{Run: "build ${{ matrix.target }} ${{matrix.node}}", Env: map[string]string{"OUT": "bin/${{ matrix.target }}"}},
+			{Run: "echo ${{ params.version }}"},
+		},
+		Finally: []dto.Step{{Run: "rm -rf ${{ matrix.target }}"}},
+	}
+	got := ApplyMatrix(s, cell)
+	if got.Env["NODE"] != "20" || got.Steps[0].Run != "build linux-arm64 20" || got.Steps[0].Env["OUT"] != "bin/linux-arm64" {
+		t.Fatalf("替换后的阶段为 %+v", got)
+	}
+	if got.Steps[1].Run != "echo ${{ params.version }}" {
+		t.Fatalf("不是矩阵变量的占位符被替换: %q", got.Steps[1].Run)
+	}
+	if got.Finally[0].Run != "rm -rf linux-arm64" {
+		t.Fatalf("finally 步骤替换后为 %q", got.Finally[0].Run)
+	}
+	// 各组合共用原来的阶段定义, 不能修改原阶段
+	if s.Env["NODE"] != "${{ matrix.node }}" || !strings.Contains(s.Steps[0].Run, "${{ matrix.target }}") || s.Steps[0].Env["OUT"] != "bin/${{ matrix.target }}" {
+		t.Fatalf("ApplyMatrix 修改了原来的阶段: %+v", s)
+	}
+	want := map[string]string{"MATRIX_NODE": "20", "MATRIX_TARGET": "linux-arm64"}
+	if env := cell.Env(); !maps.Equal(env, want) {
+		t.Fatalf("组合的环境变量为 %v, 期望 %v", env, want)
+	}
+}
+
+func TestValidateMatrix(t *testing.T) {
+	tests := []struct {
+		name    string
+		matrix  string
+		message string // 期望的错误信息片段, 为空表示校验通过
+	}{
+		{"变量和 include", `{node: [18, 20], include: [{node: "22"}], max_parallel: 2}`, ""},
+		{"空矩阵", `{fail_fast: true}`, "至少需要一个变量或 include 组合"},
+		{"max_parallel 小于 0", `{node: [18], max_parallel: -1}`, "max_parallel 不能小于 0"},
+		{"变量没有取值", `{node: []}`, "至少需要一个取值"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := "name: demo\nstages:\n  - name: build\n    matrix: " + tt.matrix + "\n    steps: [make]\n"
+			result := ValidateTaskYAML(text, ParseOptions{})
+			if tt.message == "" {
+				if !result.Valid {
+					t.Fatalf("期望校验通过, 错误: %v", result.Errors)
+				}
+				return
+			}
+			if result.Valid || !strings.Contains(result.Errors[0].Message, tt.message) {
+				t.Fatalf("校验错误为 %v, 期望包含 %q", result.Errors, tt.message)
+			}
+		})
+	}
+}
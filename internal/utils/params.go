@@ -0,0 +1,240 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"pubot/internal/dto"
+)
+
+var (
+	paramNameRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+	// ${{ ... }} 占位符, 目前只支持 ${{ params.名称 }}
+	placeholderRe = regexp.MustCompile(`\$\{\{\s*(.*?)\s*\}\}`)
+	paramRefRe    = regexp.MustCompile(`^params\.([A-Za-z_][A-Za-z0-9_-]*)$`)
+)
+
+// validateParams 检查参数声明, 并将默认值转换为参数类型
+func validateParams(params []dto.Param) error {
+	seen := make(map[string]bool, len(params))
+	envs := make(map[string]string, len(params)) // 环境变量名 -> 参数名称
+	for i := range params {
+		p := &params[i]
+		if !paramNameRe.MatchString(p.Name) {
+			return atPath(fmt.Sprintf("[%d].name", i), fmt.Errorf("第 %d 个参数的名称无效: %q", i+1, p.Name))
+		}
+		if seen[p.Name] {
+			return atPath(fmt.Sprintf("[%d].name", i), fmt.Errorf("参数名称重复: %s", p.Name))
+		}
+		seen[p.Name] = true
+		if other, ok := envs[ParamEnv(p.Name)]; ok {
+			return atPath(fmt.Sprintf("[%d].name", i), fmt.Errorf("参数 %s 和 %s 的环境变量名都是 %s", other, p.Name, ParamEnv(p.Name)))
+		}
+		envs[ParamEnv(p.Name)] = p.Name
+		if p.Type == "" {
+			p.Type = dto.ParamString
+		}
+		switch p.Type {
+		case dto.ParamString, dto.ParamBool, dto.ParamNumber:
+			if len(p.Options) > 0 {
+				return atPath(fmt.Sprintf("[%d].options", i), fmt.Errorf("参数 %s: 只有 choice 类型可以设置 options", p.Name))
+			}
+		case dto.ParamChoice:
+			if len(p.Options) == 0 {
+				return atPath(fmt.Sprintf("[%d]", i), fmt.Errorf("参数 %s: choice 类型需要设置 options", p.Name))
+			}
+		default:
+			return atPath(fmt.Sprintf("[%d].type", i), fmt.Errorf("参数 %s 的类型只能是 %s、%s、%s 或 %s: %q",
+				p.Name, dto.ParamString, dto.ParamBool, dto.ParamChoice, dto.ParamNumber, p.Type))
+		}
+		if p.Default != nil {
+			v, err := convertParam(*p, p.Default)
+			if err != nil {
+				return atPath(fmt.Sprintf("[%d].default", i), fmt.Errorf("参数 %s 的默认值无效: %w", p.Name, err))
+			}
+			p.Default = v
+		}
+	}
+	return nil
+}
+
+// validatePlaceholders 检查文本中的 ${{ }} 占位符只引用了已声明的参数和矩阵变量
+// declared 中矩阵变量的键为 matrix.名称
+func validatePlaceholders(scope, text string, declared map[string]bool) error {
+	for _, m := range placeholderRe.FindAllStringSubmatch(text, -1) {
+		if ref := matrixRefRe.FindStringSubmatch(m[1]); ref != nil {
+			if !declared["matrix."+ref[1]] {
+				return fmt.Errorf("%s: 矩阵变量未声明: %s", scope, ref[1])
+			}
+			continue
+		}
+		ref := paramRefRe.FindStringSubmatch(m[1])
+		if ref == nil {
+			return fmt.Errorf("%s: 不支持的占位符 %s, 只能使用 ${{ params.名称 }} 或 ${{ matrix.名称 }}", scope, m[0])
+		}
+		if !declared[ref[1]] {
+			return fmt.Errorf("%s: 参数未声明: %s", scope, ref[1])
+		}
+	}
+	return nil
+}
+
+// ResolveParams 按参数声明校验触发时传入的值, 未传入的参数使用默认值
+func ResolveParams(params []dto.Param, values map[string]any) (map[string]any, error) {
+	declared := make(map[string]dto.Param, len(params))
+	for _, p := range params {
+		declared[p.Name] = p
+	}
+	for name := range values {
+		if _, ok := declared[name]; !ok {
+			return nil, fmt.Errorf("未声明的参数: %s", name)
+		}
+	}
+	resolved := make(map[string]any, len(params))
+	for _, p := range params {
+		v, ok := values[p.Name]
+		if !ok || v == nil {
+			switch {
+			case p.Default != nil:
+				v = p.Default
+			case p.Required:
+				return nil, fmt.Errorf("缺少参数: %s", p.Name)
+			default:
+				resolved[p.Name] = zeroParam(p)
+				continue
+			}
+		}
+		converted, err := convertParam(p, v)
+		if err != nil {
+			return nil, fmt.Errorf("参数 %s: %w", p.Name, err)
+		}
+		resolved[p.Name] = converted
+	}
+	return resolved, nil
+}
+
+// ParamEnv 参数对应的环境变量名, 例如 deploy-target 为 PUBOT_PARAM_DEPLOY_TARGET
+func ParamEnv(name string) string {
+	return "PUBOT_PARAM_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// ParamsEnv 触发参数的环境变量, 步骤命令通过它们读取参数值
+func ParamsEnv(values map[string]any) map[string]string {
+	env := make(map[string]string, len(values))
+	for name, v := range values {
+		env[ParamEnv(name)] = toString(v)
+	}
+	return env
+}
+
+// ApplyParams 替换步骤(包括 finally 步骤)中的 ${{ params.名称 }}
+// 参数值来自触发时的输入, 命令中替换为 ${PUBOT_PARAM_名称}, 由 shell 展开, 值中的 ;、$() 等不会作为命令执行
+// 上传下载路径和环境变量不经过 shell 解释, 直接替换为参数值
+func ApplyParams(p *dto.TaskYAML, values map[string]any) {
+	replacePlaceholders(p, func(name string) (string, bool) {
+		return toString(values[name]), true
+	}, func(name string) (string, bool) {
+		return "${" + ParamEnv(name) + "}", true
+	})
+}
+
+// replacePlaceholders 替换命令、上传下载路径和环境变量中的 ${{ params.名称 }}, 返回 false 时保留原样
+// 命令中使用 runValue, 其他位置使用 value
+func replacePlaceholders(p *dto.TaskYAML, value, runValue func(name string) (string, bool)) {
+	replacer := func(value func(name string) (string, bool)) func(text string) string {
+		return func(text string) string {
+			return placeholderRe.ReplaceAllStringFunc(text, func(m string) string {
+				ref := paramRefRe.FindStringSubmatch(placeholderRe.FindStringSubmatch(m)[1])
+				if ref == nil {
+					return m
+				}
+				if v, ok := value(ref[1]); ok {
+					return v
+				}
+				return m
+			})
+		}
+	}
+	replace, replaceRun := replacer(value), replacer(runValue)
+	replaceEnv := func(env map[string]string) {
+		for k, v := range env {
+			env[k] = replace(v)
+		}
+	}
+	replaceSteps := func(steps []dto.Step) {
+		for i := range steps {
+			steps[i].Run = replaceRun(steps[i].Run)
+			steps[i].Upload = replaceTransfer(steps[i].Upload, replace)
+			steps[i].Download = replaceTransfer(steps[i].Download, replace)
+			replaceEnv(steps[i].Env)
+		}
+	}
+	replaceEnv(p.Env)
+	replaceSteps(p.Finally)
+	for i := range p.Stages {
+		s := &p.Stages[i]
+		replaceEnv(s.Env)
+		replaceSteps(s.Steps)
+		replaceSteps(s.Finally)
+	}
+}
+
+// convertParam 将参数值转换为声明的类型: string/choice 为 string, bool 为 bool, number 为 float64
+func convertParam(p dto.Param, v any) (any, error) {
+	switch p.Type {
+	case dto.ParamBool:
+		switch v := v.(type) {
+		case bool:
+			return v, nil
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				return b, nil
+			}
+		}
+		return nil, fmt.Errorf("需要 bool 类型, 实际是 %v", v)
+	case dto.ParamNumber:
+		switch v := v.(type) {
+		case int:
+			return float64(v), nil
+		case float64:
+			return v, nil
+		case string:
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				return f, nil
+			}
+		}
+		return nil, fmt.Errorf("需要 number 类型, 实际是 %v", v)
+	}
+
+	var s string
+	switch v := v.(type) {
+	case string:
+		s = v
+	case int:
+		s = strconv.Itoa(v)
+	case float64, bool:
+		s = toString(v)
+	default:
+		return nil, fmt.Errorf("需要 string 类型, 实际是 %v", v)
+	}
+	if p.Type == dto.ParamChoice && !slices.Contains(p.Options, s) {
+		return nil, fmt.Errorf("只能是 %s 中的一个, 实际是 %q", strings.Join(p.Options, "、"), s)
+	}
+	return s, nil
+}
+
+// zeroParam 没有传入也没有默认值的可选参数的值
+func zeroParam(p dto.Param) any {
+	switch p.Type {
+	case dto.ParamBool:
+		return false
+	case dto.ParamNumber:
+		return float64(0)
+	case dto.ParamChoice:
+		return p.Options[0]
+	}
+	return ""
+}
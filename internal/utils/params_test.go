@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"pubot/internal/dto"
+)
+
+func TestApplyParams(t *testing.T) {
+	p := &dto.TaskYAML{
+		Env: map[string]string{"VERSION": "v${{ params.version }}"},
+		Stages: []dto.Stage{{
+			Name: "deploy",
+			Steps: []dto.Step{
+				{Run: `./deploy.sh "${{ params.version }}" ${{ params.deploy-target }}`},
+				{Upload: &dto.Transfer{Src: "dist", Dest: "releases/${{ params.version }}"}},
+			},
+		}},
+	}
+	ApplyParams(p, map[string]any{"version": "1.2.0", "deploy-target": "prod"})
+	if got, want := p.Stages[0].Steps[0].Run, `./deploy.sh "${PUBOT_PARAM_VERSION}" ${PUBOT_PARAM_DEPLOY_TARGET}`; got != want {
+		t.Fatalf("命令为 %q, 期望 %q", got, want)
+	}
+	if got := p.Stages[0].Steps[1].Upload.Dest; got != "releases/1.2.0" {
+		t.Fatalf("上传路径为 %q", got)
+	}
+	if got := p.Env["VERSION"]; got != "v1.2.0" {
+		t.Fatalf("环境变量为 %q", got)
+	}
+}
+
+func TestParamInjectionInert(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("没有 bash")
+	}
+	dir := t.TempDir()
+	values := map[string]any{"version": "1.0; touch pwned; $(touch pwned2) `touch pwned3`"}
+	for _, run := range []string{
+		`echo ${{ params.version }}`,
+		`echo "v=${{ params.version }}"`,
+	} {
+		p := &dto.TaskYAML{Stages: []dto.Stage{{Name: "deploy", Steps: []dto.Step{{Run: run}}}}}
+		ApplyParams(p, values)
+		cmd := exec.Command("bash", "-c", p.Stages[0].Steps[0].Run)
+		cmd.Dir = dir
+		cmd.Env = MergeEnv(os.Environ(), ParamsEnv(values))
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s 执行失败: %v\n%s", run, err, out)
+		}
+		if !strings.Contains(string(out), "1.0; touch pwned;") {
+			t.Fatalf("%s 的输出为 %q, 期望原样输出参数值", run, out)
+		}
+		entries, _ := os.ReadDir(dir)
+		if len(entries) > 0 {
+			t.Fatalf("%s 执行了参数值中的命令, 创建了 %s", run, entries[0].Name())
+		}
+	}
+}
+
+func TestParamEnvConflict(t *testing.T) {
+	result := ValidateTaskYAML(`name: demo
+params:
+  - name: deploy-target
+  - name: deploy_target
+stages:
+  - name: build
+    steps: [make]
+`, ParseOptions{})
+	if result.Valid || !strings.Contains(result.Errors[0].Message, "环境变量名都是 PUBOT_PARAM_DEPLOY_TARGET") {
+		t.Fatalf("错误为 %v", result.Errors)
+	}
+}
@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"pubot/internal/config"
+)
+
+// 日志文件每行格式: 时间\t流\t阶段\t步骤\t内容
+// 以制表符分隔, 既方便直接下载阅读, 也能按行解析回 LogLine
+
+// RunLogPath 单次执行的日志文件路径
+func RunLogPath(taskID uint, run int) string {
+	return filepath.Join(config.Get().LogDir, strconv.FormatUint(uint64(taskID), 10), strconv.Itoa(run)+".log")
+}
+
+// RunLog 单次执行的日志文件
+type RunLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// CreateRunLog 创建单次执行的日志文件
+func CreateRunLog(taskID uint, run int) (*RunLog, error) {
+	path := RunLogPath(taskID, run)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &RunLog{f: f}, nil
+}
+
+// Write 追加一行日志, 每行直接写入文件, 执行中也能读取到最新内容
+func (l *RunLog) Write(line LogLine) error {
+	stage := line.Stage
+	if stage == "" {
+		stage = "-"
+	}
+	text := strings.ReplaceAll(line.Text, "\n", " ")
+	row := fmt.Sprintf("%s\t%s\t%s\t%d\t%s\n", line.Time.Format(time.RFC3339Nano), line.Stream, stage, line.Step, text)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.f.WriteString(row)
+	return err
+}
+
+func (l *RunLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
+
+// parseLogRow 将日志文件中的一行解析为 LogLine
+func parseLogRow(run int, row string) (LogLine, error) {
+	parts := strings.SplitN(row, "\t", 5)
+	if len(parts) != 5 {
+		return LogLine{}, fmt.Errorf("日志格式错误: %q", row)
+	}
+	ts, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return LogLine{}, err
+	}
+	step, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return LogLine{}, err
+	}
+	stage := parts[2]
+	if stage == "-" {
+		stage = ""
+	}
+	return LogLine{Run: run, Time: ts, Stream: parts[1], Stage: stage, Step: step, Text: parts[4]}, nil
+}
+
+// LogPage 分页读取的日志
+type LogPage struct {
+	Lines  []LogLine `json:"lines"`
+	Offset int64     `json:"offset"` // 本页起始字节偏移
+	Next   int64     `json:"next"`   // 下一页起始字节偏移
+	Size   int64     `json:"size"`   // 读取时文件大小
+	EOF    bool      `json:"eof"`    // 是否已读到文件末尾
+}
+
+// LogFilter 按阶段和步骤筛选日志, 用于单独查看并行步骤的输出, 零值表示不筛选
+// Stage 为矩阵阶段名时包括所有组合的输出, 也可以写组合的名称只看一个组合
+// 设置了 hosts 的阶段同样包括所有主机的输出, 也可以写 "阶段名@主机名" 只看一台主机
+type LogFilter struct {
+	Stage string
+	Step  int
+}
+
+func (f LogFilter) Match(line LogLine) bool {
+	stage := f.Stage == "" || line.Stage == f.Stage ||
+		strings.HasPrefix(line.Stage, f.Stage+" (") || strings.HasPrefix(line.Stage, f.Stage+"@")
+	return stage && (f.Step == 0 || line.Step == f.Step)
+}
+
+// ReadRunLog 从字节偏移 offset 开始读取最多 limit 行符合 filter 的日志
+// 只返回完整的行, 正在写入的半行留给下一次读取
+func ReadRunLog(taskID uint, run int, offset int64, limit int, filter LogFilter) (*LogPage, error) {
+	f, err := os.Open(RunLogPath(taskID, run))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > info.Size() {
+		return nil, fmt.Errorf("offset 超出范围: %d", offset)
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	page := &LogPage{Lines: []LogLine{}, Offset: offset, Next: offset, Size: info.Size()}
+	reader := bufio.NewReader(io.LimitReader(f, info.Size()-offset))
+	for len(page.Lines) < limit {
+		row, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line, err := parseLogRow(run, strings.TrimSuffix(row, "\n"))
+		if err != nil {
+			return nil, err
+		}
+		page.Next += int64(len(row))
+		if filter.Match(line) {
+			page.Lines = append(page.Lines, line)
+		}
+	}
+	page.EOF = page.Next >= page.Size
+	return page, nil
+}
+
+// TailRunLog 读取最后 n 行符合 filter 的日志
+func TailRunLog(taskID uint, run int, n int, filter LogFilter) (*LogPage, error) {
+	f, err := os.Open(RunLogPath(taskID, run))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	// 记录每行的起始偏移, 只保留最后 n 行
+	var starts []int64
+	var pos int64
+	reader := bufio.NewReader(io.LimitReader(f, info.Size()))
+	for {
+		row, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		start := pos
+		pos += int64(len(row))
+		line, err := parseLogRow(run, strings.TrimSuffix(row, "\n"))
+		if err != nil {
+			return nil, err
+		}
+		if !filter.Match(line) {
+			continue
+		}
+		starts = append(starts, start)
+		if len(starts) > n {
+			starts = starts[1:]
+		}
+	}
+	if len(starts) == 0 {
+		return &LogPage{Lines: []LogLine{}, Size: info.Size(), EOF: true}, nil
+	}
+	return ReadRunLog(taskID, run, starts[0], n, filter)
+}
@@ -0,0 +1,151 @@
+package utils
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeRunLog 写入一次执行的日志
+func writeRunLog(t *testing.T, taskID uint, run int, lines []LogLine) {
+	t.Helper()
+	l, err := CreateRunLog(taskID, run)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, line := range lines {
+		if err := l.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// texts 日志行的内容, 以逗号连接
+func texts(lines []LogLine) string {
+	s := make([]string, len(lines))
+	for i, l := range lines {
+		s[i] = l.Text
+	}
+	return strings.Join(s, ",")
+}
+
+var testRunLog = []LogLine{
+	{Stream: StreamSystem, Text: "start"},
+	{Stream: StreamStdout, Stage: "build", Step: 1, Text: "compile"},
+	{Stream: StreamStderr, Stage: "build", Step: 2, Text: "warn\tdeprecated"},
+	{Stream: StreamStdout, Stage: "test (node: 18)", Step: 1, Text: "node 18"},
+	{Stream: StreamStdout, Stage: "deploy@web1", Step: 1, Text: "multi\nline"},
+	{Stream: StreamSystem, Text: "end"},
+}
+
+func TestRunLogRoundTrip(t *testing.T) {
+	now := time.Now()
+	lines := make([]LogLine, len(testRunLog))
+	for i, l := range testRunLog {
+		l.Time = now.Add(time.Duration(i) * time.Millisecond)
+		lines[i] = l
+	}
+	writeRunLog(t, 1, 1, lines)
+
+	page, err := ReadRunLog(1, 1, 0, 100, LogFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Lines) != len(lines) || !page.EOF || page.Next != page.Size {
+		t.Fatalf("读取了 %d 行, EOF %v, next %d, size %d", len(page.Lines), page.EOF, page.Next, page.Size)
+	}
+	for i, got := range page.Lines {
+		want := lines[i]
+		want.Run = 1
+		want.Text = strings.ReplaceAll(want.Text, "\n", " ")
+		if !got.Time.Equal(want.Time) || got.Stream != want.Stream || got.Stage != want.Stage || got.Step != want.Step || got.Text != want.Text || got.Run != 1 {
+			t.Fatalf("第 %d 行为 %+v, 期望 %+v", i+1, got, want)
+		}
+	}
+}
+
+func TestReadRunLogPaging(t *testing.T) {
+	writeRunLog(t, 2, 1, testRunLog)
+
+	// 按 next 翻页, 每页 2 行, 拼起来是完整的日志
+	var all []LogLine
+	var offset int64
+	for pages := 0; ; pages++ {
+		page, err := ReadRunLog(2, 1, offset, 2, LogFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Offset != offset || len(page.Lines) > 2 || pages > len(testRunLog) {
+			t.Fatalf("第 %d 页: %+v", pages+1, page)
+		}
+		all = append(all, page.Lines...)
+		offset = page.Next
+		if page.EOF {
+			break
+		}
+	}
+	if texts(all) != "start,compile,warn\tdeprecated,node 18,multi line,end" {
+		t.Fatalf("翻页读取的日志为 %s", texts(all))
+	}
+	if _, err := ReadRunLog(2, 1, offset+1, 10, LogFilter{}); err == nil {
+		t.Fatal("offset 超出文件大小时应返回错误")
+	}
+	if _, err := ReadRunLog(2, 9, 0, 10, LogFilter{}); !os.IsNotExist(err) {
+		t.Fatalf("日志不存在时返回 %v", err)
+	}
+
+	// 正在写入的半行留给下一次读取
+	f, err := os.OpenFile(RunLogPath(2, 1), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(time.Now().Format(time.RFC3339Nano) + "\tstdout\t-\t0\tpart")
+	f.Close()
+	page, err := ReadRunLog(2, 1, offset, 10, LogFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Lines) != 0 || page.Next != offset || page.EOF {
+		t.Fatalf("读到了不完整的行: %+v", page)
+	}
+}
+
+func TestRunLogFilterAndTail(t *testing.T) {
+	writeRunLog(t, 3, 1, testRunLog)
+	tests := []struct {
+		name   string
+		filter LogFilter
+		tail   int
+		want   string
+	}{
+		{name: "stage", filter: LogFilter{Stage: "build"}, want: "compile,warn\tdeprecated"},
+		{name: "step", filter: LogFilter{Stage: "build", Step: 2}, want: "warn\tdeprecated"},
+		{name: "matrix", filter: LogFilter{Stage: "test"}, want: "node 18"},
+		{name: "matrix cell", filter: LogFilter{Stage: "test (node: 18)"}, want: "node 18"},
+		{name: "host", filter: LogFilter{Stage: "deploy"}, want: "multi line"},
+		{name: "prefix only", filter: LogFilter{Stage: "buil"}, want: ""},
+		{name: "tail", tail: 2, want: "multi line,end"},
+		{name: "tail more than lines", tail: 100, want: "start,compile,warn\tdeprecated,node 18,multi line,end"},
+		{name: "tail filtered", filter: LogFilter{Step: 1}, tail: 2, want: "node 18,multi line"},
+		{name: "tail no match", filter: LogFilter{Stage: "missing"}, tail: 2, want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var page *LogPage
+			var err error
+			if tt.tail > 0 {
+				page, err = TailRunLog(3, 1, tt.tail, tt.filter)
+			} else {
+				page, err = ReadRunLog(3, 1, 0, 100, tt.filter)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := texts(page.Lines); got != tt.want {
+				t.Fatalf("读取的日志为 %q, 期望 %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+package utils
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"pubot/internal/dto"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	taskYAMLType = reflect.TypeOf(dto.TaskYAML{})
+	stepType     = reflect.TypeOf(dto.Step{})
+	stageType    = reflect.TypeOf(dto.Stage{})
+	templateType = reflect.TypeOf(dto.TemplateRef{})
+	matrixType   = reflect.TypeOf(dto.Matrix{})
+	hostsType    = reflect.TypeOf(dto.Hosts{})
+	hostType     = reflect.TypeOf(dto.Host{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+// schemaChecker 按 dto 结构体的 yaml 标签逐个节点检查 YAML
+// 类型不对是错误, 未知的键和带有 deprecated 标签的键是警告
+type schemaChecker struct {
+	errors   []ValidationIssue
+	warnings []ValidationIssue
+}
+
+func (c *schemaChecker) errorf(n *yaml.Node, path, format string, args ...any) {
+	c.errors = append(c.errors, ValidationIssue{Line: n.Line, Column: n.Column, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *schemaChecker) warnf(n *yaml.Node, path, format string, args ...any) {
+	c.warnings = append(c.warnings, ValidationIssue{Line: n.Line, Column: n.Column, Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (c *schemaChecker) check(n *yaml.Node, t reflect.Type, path string) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	// null 解析为零值, 任何类型都可以
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+		return
+	}
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch {
+	case t == stepType && n.Kind == yaml.ScalarNode:
+		// 步骤可以直接写命令字符串
+		return
+	case t == templateType && n.Kind == yaml.ScalarNode:
+		// 模板引用可以直接写模板名称
+		return
+	case t == hostType && n.Kind == yaml.ScalarNode:
+		// 主机可以直接写成 user@address:port
+		if _, err := dto.ParseHost(n.Value); err != nil {
+			c.errorf(n, path, "%v", err)
+		}
+		return
+	case t == hostsType && n.Kind == yaml.ScalarNode:
+		// hosts 可以直接写主机组名称
+		return
+	case t == hostsType:
+		c.check(n, reflect.TypeOf([]dto.Host{}), path)
+		return
+	case t == stageType && n.Kind == yaml.SequenceNode:
+		// 阶段可以直接写步骤列表
+		c.check(n, reflect.TypeOf([]dto.Step{}), path)
+		return
+	case t == durationType:
+		c.checkScalar(n, t, path, "时间长度(例如 30s、10m)")
+		return
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		c.checkStruct(n, t, path)
+	case reflect.Slice:
+		if !c.expectKind(n, yaml.SequenceNode, path) {
+			return
+		}
+		for i, item := range n.Content {
+			c.check(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))
+		}
+	case reflect.Map:
+		if !c.expectKind(n, yaml.MappingNode, path) {
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			c.check(n.Content[i+1], t.Elem(), joinPath(path, n.Content[i].Value))
+		}
+	case reflect.String:
+		c.checkScalar(n, t, path, "字符串")
+	case reflect.Bool:
+		c.checkScalar(n, t, path, "布尔值(true 或 false)")
+	case reflect.Int, reflect.Int64:
+		c.checkScalar(n, t, path, "整数")
+	case reflect.Float64:
+		c.checkScalar(n, t, path, "数字")
+	case reflect.Interface:
+		// any 类型的值在解析后再检查
+	}
+}
+
+// checkStruct 检查映射中的每个键, 未知的键给出最接近的已知键
+func (c *schemaChecker) checkStruct(n *yaml.Node, t reflect.Type, path string) {
+	if !c.expectKind(n, yaml.MappingNode, path) {
+		return
+	}
+	fields := make(map[string]reflect.StructField, t.NumField())
+	names := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = f
+		names = append(names, name)
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		key, value := n.Content[i], n.Content[i+1]
+		keyPath := joinPath(path, key.Value)
+		f, ok := fields[key.Value]
+		if !ok && t == matrixType {
+			// 矩阵中其余的键都是矩阵变量
+			c.check(value, reflect.TypeOf([]string{}), keyPath)
+			continue
+		}
+		if !ok {
+			if suggestion := closest(key.Value, names); suggestion != "" {
+				c.warnf(key, keyPath, "未知的键 %s, 是否应为 %s", key.Value, suggestion)
+			} else {
+				c.warnf(key, keyPath, "未知的键 %s, 将被忽略", key.Value)
+			}
+			continue
+		}
+		if msg := f.Tag.Get("deprecated"); msg != "" {
+			c.warnf(key, keyPath, "%s 已废弃, %s", key.Value, msg)
+		}
+		c.check(value, f.Type, keyPath)
+	}
+}
+
+// expectKind 检查节点的种类, 不一致时记录错误
+func (c *schemaChecker) expectKind(n *yaml.Node, kind yaml.Kind, path string) bool {
+	if n.Kind == kind {
+		return true
+	}
+	c.errorf(n, path, "%s 应为%s, 实际是%s", displayPath(path), kindName(kind), kindName(n.Kind))
+	return false
+}
+
+// checkScalar 检查标量能否解析为 t 类型
+func (c *schemaChecker) checkScalar(n *yaml.Node, t reflect.Type, path, want string) {
+	if !c.expectKind(n, yaml.ScalarNode, path) {
+		return
+	}
+	if err := n.Decode(reflect.New(t).Interface()); err != nil {
+		c.errorf(n, path, "%s 应为%s, 实际是 %q", displayPath(path), want, n.Value)
+	}
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "任务"
+	}
+	return path
+}
+
+func kindName(kind yaml.Kind) string {
+	switch kind {
+	case yaml.SequenceNode:
+		return "列表"
+	case yaml.MappingNode:
+		return "键值对"
+	default:
+		return "单个值"
+	}
+}
+
+// closest 返回编辑距离最小且足够接近的候选项, 没有时返回空字符串
+func closest(s string, candidates []string) string {
+	best, bestDist := "", 0
+	for _, c := range candidates {
+		d := editDistance(strings.ToLower(s), c)
+		if best == "" || d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	if best == "" || bestDist > 2 || bestDist*2 > len(best) {
+		return ""
+	}
+	return best
+}
+
+// editDistance 两个字符串的编辑距离, 相邻字符交换算一次编辑
+func editDistance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	prev2 := make([]int, len(rb)+1)
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && ra[i-1] == rb[j-2] && ra[i-2] == rb[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(rb)]
+}
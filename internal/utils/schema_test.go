@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSchemaIssuePositions(t *testing.T) {
+	text := `name: demo
+timeout: soon
+stages:
+  - name: build
+    parallel: maybe
+    max_parallel: two
+    stpes:
+      - make
+    steps: make
+  - name: deploy
+    run:
+      - ./deploy.sh
+    hosts:
+      - deploy@10.0.0.1:abc
+`
+	result := ValidateTaskYAML(text, ParseOptions{})
+	if result.Valid {
+		t.Fatal("期望校验失败")
+	}
+	wantErrors := []ValidationIssue{
+		{Line: 2, Column: 10, Path: "timeout", Message: "时间长度"},
+		{Line: 5, Column: 15, Path: "stages[0].parallel", Message: "布尔值"},
+		{Line: 6, Column: 19, Path: "stages[0].max_parallel", Message: "整数"},
+		{Line: 9, Column: 12, Path: "stages[0].steps", Message: "应为列表, 实际是单个值"},
+		{Line: 14, Column: 9, Path: "stages[1].hosts[0]", Message: `无效的主机端口 "abc"`},
+	}
+	wantWarnings := []ValidationIssue{
+		{Line: 7, Column: 5, Path: "stages[0].stpes", Message: "未知的键 stpes, 是否应为 steps"},
+		{Line: 11, Column: 5, Path: "stages[1].run", Message: "run 已废弃, 请使用 steps"},
+	}
+	checkIssues(t, "错误", result.Errors, wantErrors)
+	checkIssues(t, "警告", result.Warnings, wantWarnings)
+}
+
+func TestSchemaWarningsKeepValid(t *testing.T) {
+	text := `name: demo
+labels: [a]
+stages:
+  - name: build
+    steps:
+      - run: make
+        tiemout: 1m
+`
+	result := ValidateTaskYAML(text, ParseOptions{})
+	if !result.Valid {
+		t.Fatalf("未知的键不应导致校验失败: %v", result.Errors)
+	}
+	checkIssues(t, "警告", result.Warnings, []ValidationIssue{
+		{Line: 2, Column: 1, Path: "labels", Message: "未知的键 labels, 将被忽略"},
+		{Line: 7, Column: 9, Path: "stages[0].steps[0].tiemout", Message: "是否应为 timeout"},
+	})
+}
+
+func TestValidationPositionsAfterSchema(t *testing.T) {
+	// 结构正确但取值有误时, 按错误路径定位行列
+	text := `name: demo
+stages:
+  - name: build
+    steps: [make]
+  - name: build
+    steps: [make]
+`
+	result := ValidateTaskYAML(text, ParseOptions{})
+	checkIssues(t, "错误", result.Errors, []ValidationIssue{
+		{Line: 5, Column: 11, Path: "stages[1].name", Message: "阶段名称重复: build"},
+	})
+}
+
+func TestYAMLSyntaxErrorLine(t *testing.T) {
+	result := ValidateTaskYAML("name: demo\nstages:\n  - name: build\n    steps:\n\t- make\n", ParseOptions{})
+	if result.Valid || len(result.Errors) != 1 {
+		t.Fatalf("期望一个错误, 实际 %v", result.Errors)
+	}
+	if result.Errors[0].Line != 5 {
+		t.Fatalf("错误位置为第 %d 行, 期望第 5 行: %s", result.Errors[0].Line, result.Errors[0].Message)
+	}
+}
+
+// checkIssues 按顺序比较行列和路径, Message 为期望包含的片段
+func checkIssues(t *testing.T, kind string, got, want []ValidationIssue) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("%s数量为 %d, 期望 %d: %v", kind, len(got), len(want), got)
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Line != w.Line || g.Column != w.Column || g.Path != w.Path || !strings.Contains(g.Message, w.Message) {
+			t.Errorf("第 %d 个%s为 %d:%d %s %q, 期望 %d:%d %s 包含 %q",
+				i+1, kind, g.Line, g.Column, g.Path, g.Message, w.Line, w.Column, w.Path, w.Message)
+		}
+	}
+}
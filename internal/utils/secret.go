@@ -0,0 +1,117 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretRefRe 凭据引用, 写成 $NAME 或 ${NAME}
+var secretRefRe = regexp.MustCompile(`^\$\{?([A-Za-z_][A-Za-z0-9_]*)\}?$`)
+
+// redacted 接口输出中代替凭据的内容
+const redacted = "******"
+
+// SecretRef 返回凭据引用的环境变量名, value 不是 $变量名 时返回 false
+func SecretRef(value string) (string, bool) {
+	m := secretRefRe.FindStringSubmatch(value)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// isPrivateKey 判断 key 是否直接写了私钥内容, 而不是私钥文件路径
+func isPrivateKey(key string) bool {
+	return strings.Contains(key, "PRIVATE KEY") || strings.Contains(key, "\n")
+}
+
+// validateCredentials 凭据不能直接写在 YAML 中, 否则会随任务保存并出现在接口和执行记录里
+// password 和 passphrase 只能写成 $变量名, key 只能写私钥文件路径或 $变量名
+func validateCredentials(scope, password, key, passphrase string) error {
+	if _, ok := SecretRef(password); password != "" && !ok {
+		return atPath("password", fmt.Errorf("%s 的 password 不能直接写密码, 请写成 $变量名 从 pubot 进程的环境变量读取", scope))
+	}
+	if isPrivateKey(key) {
+		return atPath("key", fmt.Errorf("%s 的 key 不能直接写私钥内容, 请写私钥文件路径或 $变量名", scope))
+	}
+	if _, ok := SecretRef(passphrase); passphrase != "" && !ok {
+		return atPath("passphrase", fmt.Errorf("%s 的 passphrase 不能直接写密码, 请写成 $变量名 从 pubot 进程的环境变量读取", scope))
+	}
+	return nil
+}
+
+// RedactSecrets 将 YAML 中直接写出的 password、passphrase 和私钥内容替换为 ******, 用于接口输出
+// 校验已经拒绝这样的写法, 这里处理之前保存的任务、模板和执行记录, 没有需要替换的内容时原样返回
+func RedactSecrets(yamlText string) string {
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(yamlText), &root); err != nil {
+		return redactLines(yamlText)
+	}
+	if !redactNode(&root) {
+		return yamlText
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return redactLines(yamlText)
+	}
+	return buf.String()
+}
+
+// redactNode 替换节点下的凭据, 返回是否有替换
+func redactNode(n *yaml.Node) bool {
+	changed := false
+	if n.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			if value.Kind == yaml.ScalarNode && isSecretValue(key.Value, value.Value) {
+				value.Value, value.Style, value.Tag = redacted, 0, "!!str"
+				changed = true
+			}
+		}
+	}
+	// 主机写成 "user@address:port" 时没有凭据, 不需要处理
+	for _, c := range n.Content {
+		if redactNode(c) {
+			changed = true
+		}
+	}
+	return changed
+}
+
+// isSecretValue 判断键值是否为直接写出的凭据
+func isSecretValue(key, value string) bool {
+	switch key {
+	case "password", "passphrase":
+		_, ok := SecretRef(value)
+		return value != "" && value != redacted && !ok
+	case "key":
+		return isPrivateKey(value)
+	}
+	return false
+}
+
+// redactLines 无法解析的 YAML 按行替换, 私钥内容无法可靠识别时整体隐藏
+func redactLines(yamlText string) string {
+	if strings.Contains(yamlText, "PRIVATE KEY") {
+		return redacted
+	}
+	lines := strings.Split(yamlText, "\n")
+	for i, line := range lines {
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		k = strings.TrimLeft(strings.TrimSpace(k), "- ")
+		v = strings.Trim(strings.TrimSpace(v), `"'`)
+		if isSecretValue(k, v) {
+			lines[i] = line[:strings.Index(line, ":")+1] + " " + redacted
+		}
+	}
+	return strings.Join(lines, "\n")
+}
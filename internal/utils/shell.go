@@ -0,0 +1,297 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ErrShellExited 会话中的 bash 已经退出(例如步骤里执行了 exit), 后续步骤无法继续
+var ErrShellExited = errors.New("shell 会话已退出")
+
+// shellMark 步骤结束时 bash 分别向 stdout 和 stderr 打印的标记行: \x1ePUBOT:<nonce>:<退出码>
+const shellMark = "\x1ePUBOT:"
+
+// ShellSession 一个阶段共用的 bash 会话
+// 步骤依次在同一个 bash 进程中 source 执行, cd、export、source、pushd、函数定义等都会保留到后续步骤
+type ShellSession struct {
+	proc   ShellProcess
+	prefix string // 本会话的结束标记前缀
+	steps  int
+
+	mu  sync.Mutex
+	out OutputFunc // 当前步骤的输出
+
+	marks   chan int      // 步骤结束标记中的退出码, 每个步骤 stdout、stderr 各一个
+	exited  chan struct{} // bash 进程退出
+	exitErr error
+	readers sync.WaitGroup
+}
+
+// ShellProcess 会话使用的已启动的 bash 进程, 可以在本机, 也可以在远程主机上
+type ShellProcess struct {
+	Stdin  io.WriteCloser
+	Stdout io.Reader
+	Stderr io.Reader
+	// Wait 等待进程退出, 退出码不为 0 时返回的错误应实现 ExitCode() int
+	Wait func() error
+	// Kill 立即结束进程以及它启动的子进程
+	Kill func()
+	// Source 返回在会话中执行第 n 个步骤脚本的命令
+	Source func(n int, script string) (string, error)
+	// Release 会话结束后释放资源, 可以为空
+	Release func() error
+}
+
+// NewShellSession 在已启动的 bash 进程上创建会话
+func NewShellSession(proc ShellProcess) (*ShellSession, error) {
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	s := &ShellSession{
+		proc:   proc,
+		prefix: shellMark + hex.EncodeToString(nonce) + ":",
+		marks:  make(chan int, 2),
+		exited: make(chan struct{}),
+	}
+	s.readers.Add(2)
+	go s.read(proc.Stdout, StreamStdout)
+	go s.read(proc.Stderr, StreamStderr)
+	go func() {
+		s.exitErr = proc.Wait()
+		close(s.exited)
+	}()
+	return s, nil
+}
+
+// StartShell 在本机的 workDir 中启动一个 bash 会话, env 为空时继承 pubot 的环境变量
+// 步骤脚本写入临时目录后 source 执行
+func StartShell(workDir string, env []string) (*ShellSession, error) {
+	scripts, err := os.MkdirTemp("", "pubot-shell-")
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command("bash", "--noprofile", "--norc")
+	cmd.Dir = workDir
+	cmd.Env = env
+	// 独立进程组便于整组杀掉, pubot 异常退出时也一并结束
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGKILL}
+	fail := func(err error, files ...*os.File) (*ShellSession, error) {
+		for _, f := range files {
+			f.Close()
+		}
+		os.RemoveAll(scripts)
+		return nil, err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fail(err)
+	}
+	// 直接把管道交给子进程, Wait 不依赖输出是否读完, 后台进程占用输出也不会卡住
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return fail(err)
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		return fail(err, stdoutR, stdoutW)
+	}
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	err = cmd.Start()
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		return fail(err, stdoutR, stderrR)
+	}
+
+	return NewShellSession(ShellProcess{
+		Stdin:  stdin,
+		Stdout: stdoutR,
+		Stderr: stderrR,
+		Wait:   cmd.Wait,
+		Kill: func() {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		},
+		Source: func(n int, script string) (string, error) {
+			file := filepath.Join(scripts, fmt.Sprintf("step-%d.sh", n))
+			if err := os.WriteFile(file, []byte(script+"\n"), 0o600); err != nil {
+				return "", err
+			}
+			return ". " + ShellQuote(file), nil
+		},
+		Release: func() error {
+			stdoutR.Close()
+			stderrR.Close()
+			return os.RemoveAll(scripts)
+		},
+	})
+}
+
+// read 按行读取输出, 识别步骤结束标记
+func (s *ShellSession) read(r io.Reader, stream string) {
+	defer s.readers.Done()
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if i := strings.Index(line, s.prefix); i >= 0 {
+			// 步骤最后一行没有换行时, 标记会接在这一行后面
+			if i > 0 {
+				s.emit(stream, line[:i])
+			}
+			code, _ := strconv.Atoi(line[i+len(s.prefix):])
+			s.marks <- code
+		} else if line != "" || err == nil {
+			s.emit(stream, line)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *ShellSession) emit(stream, text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.out != nil {
+		s.out(stream, text)
+	}
+}
+
+func (s *ShellSession) setOutput(out OutputFunc) {
+	s.mu.Lock()
+	s.out = out
+	s.mu.Unlock()
+}
+
+// RunStep 在会话中执行一个步骤的脚本, 返回退出码
+// env 只对本步骤有效, 步骤结束后恢复原来的值
+// ctx 结束时杀掉整个会话进程组, 会话不能再继续使用
+func (s *ShellSession) RunStep(ctx context.Context, script string, env map[string]string, out OutputFunc) (int, error) {
+	select {
+	case <-s.exited:
+		return -1, ErrShellExited
+	default:
+	}
+	s.steps++
+	source, err := s.proc.Source(s.steps, script)
+	if err != nil {
+		return -1, err
+	}
+	s.setOutput(out)
+	defer s.setOutput(nil)
+
+	// 步骤的标准输入重定向到 /dev/null, 避免读走会话后续的命令
+	save, restore := stepEnv(env)
+	line := fmt.Sprintf("%s%s </dev/null; __pubot_rc=$?; %sprintf '%s%%d\\n' $__pubot_rc; printf '%s%%d\\n' $__pubot_rc >&2\n",
+		save, source, restore, s.prefix, s.prefix)
+	if _, err := io.WriteString(s.proc.Stdin, line); err != nil {
+		<-s.exited
+		s.drain()
+		return -1, ErrShellExited
+	}
+
+	code := 0
+	for got := 0; got < 2; got++ {
+		select {
+		case code = <-s.marks:
+		case <-s.exited:
+			s.drain()
+			var exitErr interface{ ExitCode() int }
+			if errors.As(s.exitErr, &exitErr) && exitErr.ExitCode() > 0 {
+				return exitErr.ExitCode(), s.exitErr
+			}
+			return -1, ErrShellExited
+		case <-ctx.Done():
+			s.kill()
+			<-s.exited
+			s.drain()
+			return -1, context.Cause(ctx)
+		}
+	}
+	if code != 0 {
+		return code, fmt.Errorf("exit status %d", code)
+	}
+	return 0, nil
+}
+
+// Exited 会话是否已经结束, 步骤超时、被取消或执行了 exit 都会结束会话
+func (s *ShellSession) Exited() bool {
+	select {
+	case <-s.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// kill 结束会话的进程, 本机会话杀掉整个进程组
+func (s *ShellSession) kill() {
+	s.proc.Kill()
+}
+
+// drain 等待读协程读完 bash 退出前的输出, 后台进程仍占用输出时最多等 1 秒
+func (s *ShellSession) drain() {
+	done := make(chan struct{})
+	go func() {
+		s.readers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+	}
+}
+
+// Close 结束会话, bash 读到输入结束后正常退出, 后台启动的进程不受影响
+func (s *ShellSession) Close() error {
+	s.proc.Stdin.Close()
+	select {
+	case <-s.exited:
+	case <-time.After(5 * time.Second):
+		s.kill()
+		<-s.exited
+	}
+	s.drain()
+	s.setOutput(nil)
+	if s.proc.Release != nil {
+		return s.proc.Release()
+	}
+	return nil
+}
+
+// stepEnv 生成设置步骤环境变量的命令, 以及步骤结束后恢复原值(原来未设置则 unset)的命令
+func stepEnv(env map[string]string) (string, string) {
+	names := make([]string, 0, len(env))
+	for k := range env {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var save, restore strings.Builder
+	for i, k := range names {
+		saved := fmt.Sprintf("__pubot_env_%d", i)
+		fmt.Fprintf(&save, "%s_set=${%s+1}; %s=${%s-}; export %s=%s; ", saved, k, saved, k, k, ShellQuote(env[k]))
+		fmt.Fprintf(&restore, "if [ -n \"$%s_set\" ]; then %s=$%s; else unset %s; fi; ", saved, k, saved, k)
+	}
+	return save.String(), restore.String()
+}
+
+// ShellQuote 用单引号包裹, 作为 bash 的单个参数
+func ShellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,179 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shellOutput 收集步骤的输出
+type shellOutput struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (o *shellOutput) out(stream, text string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.lines = append(o.lines, stream+": "+text)
+}
+
+func (o *shellOutput) String() string {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return strings.Join(o.lines, "\n")
+}
+
+// startTestShell 在临时目录中启动 bash 会话
+func startTestShell(t *testing.T) *ShellSession {
+	t.Helper()
+	s, err := StartShell(t.TempDir(), nil)
+	if err != nil {
+		t.Skip("无法启动 bash:", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestShellStreamsOutput(t *testing.T) {
+	s := startTestShell(t)
+	first := make(chan time.Time, 1)
+	var out shellOutput
+	start := time.Now()
+	code, err := s.RunStep(context.Background(), "echo first; echo warn >&2; sleep 0.5; echo last", nil, func(stream, text string) {
+		out.out(stream, text)
+		if text == "first" {
+			first <- time.Now()
+		}
+	})
+	if err != nil || code != 0 {
+		t.Fatalf("退出码 %d, 错误 %v", code, err)
+	}
+	// 第一行在步骤结束前就已经输出, 而不是结束后一次性输出
+	select {
+	case at := <-first:
+		if got := at.Sub(start); got >= 500*time.Millisecond {
+			t.Fatalf("第一行在 %s 后才输出", got)
+		}
+	default:
+		t.Fatalf("没有输出第一行:\n%s", out.String())
+	}
+	got := out.String()
+	for _, want := range []string{"stdout: first", "stderr: warn", "stdout: last"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("输出中缺少 %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, shellMark) {
+		t.Fatalf("输出中包含步骤结束标记:\n%s", got)
+	}
+}
+
+// processAlive 进程是否还在运行, 已退出等待回收的僵尸进程不算
+func processAlive(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// 格式为 "pid (comm) state ...", comm 中可能有空格
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestShellCancelKillsChildren(t *testing.T) {
+	s := startTestShell(t)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cause := errors.New("用户取消")
+	pids := make(chan int, 1)
+	start := time.Now()
+	_, err := s.RunStep(ctx, "sleep 30 & echo $!; wait", nil, func(stream, text string) {
+		if pid, err := strconv.Atoi(text); err == nil {
+			pids <- pid
+			cancel(cause)
+		}
+	})
+	if !errors.Is(err, cause) {
+		t.Fatalf("取消后返回 %v, 期望 %v", err, cause)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Fatalf("取消后 %s 才返回", elapsed)
+	}
+	if !s.Exited() {
+		t.Fatal("取消后会话应当结束")
+	}
+	pid := <-pids
+	// 子进程和 bash 在同一个进程组, 取消时一起结束
+	deadline := time.Now().Add(5 * time.Second)
+	for processAlive(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("取消后后台进程 %d 仍在运行", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestShellSessionState(t *testing.T) {
+	s := startTestShell(t)
+	// 同一个会话中依次执行, 后面的步骤依赖前面步骤留下的状态
+	steps := []struct {
+		name   string
+		script string
+		env    map[string]string
+		code   int
+		want   string
+	}{
+		{"切换目录", "mkdir sub && cd sub", nil, 0, ""},
+		{"保留工作目录", "basename $PWD", nil, 0, "sub"},
+		{"导出变量", "export FOO=bar", nil, 0, ""},
+		{"保留变量", "echo $FOO", nil, 0, "bar"},
+		{"定义函数", "greet() { echo hi $1; }", nil, 0, ""},
+		{"保留函数", "greet you", nil, 0, "hi you"},
+		{"失败的退出码", "(exit 3)", nil, 3, ""},
+		{"失败后会话继续", "echo after", nil, 0, "after"},
+		{"步骤环境变量", "echo $FOO $BAR", map[string]string{"FOO": "step", "BAR": "it's"}, 0, "step it's"},
+		{"恢复步骤环境变量", "echo $FOO ${BAR-unset}", nil, 0, "bar unset"},
+		{"标准输入为空", "read line; echo got=$line", nil, 0, "got="},
+	}
+	for _, tt := range steps {
+		var out shellOutput
+		code, err := s.RunStep(context.Background(), tt.script, tt.env, out.out)
+		if code != tt.code || (err != nil) != (tt.code != 0) {
+			t.Fatalf("%s: 退出码 %d, 错误 %v, 期望退出码 %d", tt.name, code, err, tt.code)
+		}
+		if tt.want != "" && out.String() != "stdout: "+tt.want {
+			t.Fatalf("%s: 输出为\n%s\n期望 %q", tt.name, out.String(), tt.want)
+		}
+	}
+}
+
+func TestShellSessionExit(t *testing.T) {
+	s := startTestShell(t)
+	code, err := s.RunStep(context.Background(), "echo bye; exit 4", nil, nil)
+	if code != 4 || err == nil {
+		t.Fatalf("exit 后退出码 %d, 错误 %v", code, err)
+	}
+	if !s.Exited() {
+		t.Fatal("exit 后会话应当结束")
+	}
+	if _, err := s.RunStep(context.Background(), "echo again", nil, nil); !errors.Is(err, ErrShellExited) {
+		t.Fatalf("会话结束后执行返回 %v, 期望 ErrShellExited", err)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	s := startTestShell(t)
+	for _, value := range []string{"", "plain", "a b", "it's", `$HOME "x" \n`, "`id`; echo"} {
+		var out shellOutput
+		if _, err := s.RunStep(context.Background(), "printf '[%s]\\n' "+ShellQuote(value), nil, out.out); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := out.String(), "stdout: ["+value+"]"; got != want {
+			t.Fatalf("ShellQuote(%q) 输出 %q, 期望 %q", value, got, want)
+		}
+	}
+}
@@ -0,0 +1,375 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"pubot/internal/dto"
+)
+
+// StepError 记录失败步骤的序号(从1开始)和命令
+type StepError struct {
+	Index int
+	Cmd   string
+	Err   error
+}
+
+func (e *StepError) Error() string {
+	return fmt.Sprintf("步骤 %d [%s] 执行失败: %v", e.Index, e.Cmd, e.Err)
+}
+
+func (e *StepError) Unwrap() error {
+	return e.Err
+}
+
+// ErrTimeout 超时导致的失败, 可以通过 errors.Is 判断
+var ErrTimeout = errors.New("执行超时")
+
+// WithTimeout 为 ctx 设置超时, 超时后 context.Cause 返回包装了 ErrTimeout 的错误
+// d 为 0 表示不限制
+func WithTimeout(ctx context.Context, d time.Duration, scope string) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, d, fmt.Errorf("%s%w(%s)", scope, ErrTimeout, d))
+}
+
+// StepStatus 根据步骤失败原因区分超时、取消和普通失败
+func StepStatus(ctx context.Context, err error) TaskStatusEnum {
+	switch {
+	case err == nil:
+		return TaskSuccess
+	case errors.Is(err, ErrTimeout):
+		return TaskTimeout
+	case ctx.Err() != nil:
+		return TaskCanceled
+	default:
+		return TaskError
+	}
+}
+
+// StepCond 判断步骤是否执行, failed 表示本阶段之前的步骤已经失败
+type StepCond func(s dto.Step, failed bool) (bool, error)
+
+// StepHooks 执行步骤时的回调, 都可以为空
+type StepHooks struct {
+	// Cond 为空时遇到失败跳过剩余步骤, 否则由 Cond 决定剩余步骤是否执行
+	Cond StepCond
+	// Out 接收每个步骤(序号从1开始)的输出
+	Out func(step int, stream, text string)
+	// Retry 步骤开始第 attempt 次重试前调用
+	Retry func(step, attempt, attempts int)
+}
+
+func (h StepHooks) out(step int, stream, text string) {
+	if h.Out != nil {
+		h.Out(step, stream, text)
+	}
+}
+
+// Session 执行步骤的会话, 由执行器创建, 负责进程的生命周期、环境变量、工作目录、输出和取消
+// 同一个会话中的步骤依次执行, 之前步骤的 cd、export 等对后续步骤有效
+type Session interface {
+	// RunStep 执行一个步骤的脚本并返回退出码, env 只对本步骤有效, out 接收输出
+	// ctx 结束时终止步骤, 之后会话不能再继续使用
+	RunStep(ctx context.Context, script string, env map[string]string, out OutputFunc) (int, error)
+	// Exited 会话是否已经结束
+	Exited() bool
+	Close() error
+}
+
+// Transferer 可以上传和下载文件的会话, 执行 upload 和 download 步骤
+// env 为只对本步骤有效的环境变量, 和会话的环境变量一起用于展开 src 和 dest 中的 $变量名
+type Transferer interface {
+	Upload(ctx context.Context, t dto.Transfer, env map[string]string, out OutputFunc) error
+	Download(ctx context.Context, t dto.Transfer, env map[string]string, out OutputFunc) error
+}
+
+// SessionOpener 打开一个新的会话, 工作目录和环境变量在打开时确定
+// 需要等待执行资源(例如空闲的 agent)时, ctx 结束后放弃等待
+type SessionOpener func(ctx context.Context) (Session, error)
+
+// RunCommands 在 open 打开的会话中依次执行步骤, 步骤之间保留工作目录和环境变量
+// 失败时返回第一个失败步骤的 *StepError, ctx 取消后跳过剩余步骤
+func RunCommands(ctx context.Context, steps []dto.Step, open SessionOpener, hooks StepHooks) ([]dto.StepResult, error) {
+	results := skippedResults(steps)
+	shell := &stepShell{open: open}
+	defer shell.close()
+
+	var firstErr error
+	for i, s := range steps {
+		c := strings.TrimSpace(s.Command())
+		if c == "" {
+			continue
+		}
+		if err := context.Cause(ctx); err != nil {
+			if firstErr == nil {
+				firstErr = &StepError{Index: i + 1, Cmd: c, Err: err}
+			}
+			return results, firstErr
+		}
+		if hooks.Cond == nil && firstErr != nil {
+			break
+		}
+		if hooks.Cond != nil {
+			ok, err := hooks.Cond(s, firstErr != nil)
+			if err != nil {
+				results[i].Status = string(TaskError)
+				if firstErr == nil {
+					firstErr = &StepError{Index: i + 1, Cmd: c, Err: err}
+				}
+				continue
+			}
+			if !ok {
+				skipStep(i+1, s, hooks)
+				continue
+			}
+		}
+		err := runStep(ctx, shell, i+1, s, &results[i], hooks)
+		if err != nil && !allowFailure(ctx, s, &results[i], i+1, hooks) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return results, firstErr
+}
+
+// RunParallel 并行执行步骤, 每个步骤使用独立的会话, 输出按步骤序号区分
+// maxParallel 为 0 表示不限制并行数; failFast 为 true 时一个步骤失败立即取消其余步骤, 否则等待全部结束
+// hooks.Cond 在步骤开始前判断是否执行, 返回第一个失败步骤的 *StepError
+func RunParallel(ctx context.Context, steps []dto.Step, open SessionOpener, maxParallel int, failFast bool, hooks StepHooks) ([]dto.StepResult, error) {
+	results := skippedResults(steps)
+	if maxParallel <= 0 || maxParallel > len(steps) {
+		maxParallel = len(steps)
+	}
+	branchCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var (
+		mu       sync.Mutex
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	sem := make(chan struct{}, maxParallel)
+	for i, s := range steps {
+		if strings.TrimSpace(s.Command()) == "" {
+			continue
+		}
+		if hooks.Cond != nil {
+			ok, err := hooks.Cond(s, false)
+			if err != nil {
+				results[i].Status = string(TaskError)
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = &StepError{Index: i + 1, Cmd: strings.TrimSpace(s.Command()), Err: err}
+				}
+				mu.Unlock()
+				continue
+			}
+			if !ok {
+				skipStep(i+1, s, hooks)
+				continue
+			}
+		}
+		sem <- struct{}{}
+		if branchCtx.Err() != nil {
+			// 已被取消或 fail-fast, 剩余步骤不再开始
+			<-sem
+			break
+		}
+		wg.Add(1)
+		go func(i int, s dto.Step) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			shell := &stepShell{open: open}
+			defer shell.close()
+			err := runStep(branchCtx, shell, i+1, s, &results[i], hooks)
+			if err == nil || allowFailure(branchCtx, s, &results[i], i+1, hooks) {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			// 被 fail-fast 取消的步骤不算作失败原因
+			if firstErr == nil && !errors.Is(err, errFailFast) {
+				firstErr = err
+				if failFast {
+					cancel(errFailFast)
+				}
+			}
+		}(i, s)
+	}
+	wg.Wait()
+	if firstErr == nil {
+		if err := context.Cause(ctx); err != nil {
+			return results, err
+		}
+	}
+	return results, firstErr
+}
+
+// errFailFast 并行步骤中有步骤失败, 其余步骤被取消
+var errFailFast = errors.New("其他并行步骤失败")
+
+// stepShell 步骤使用的会话, 第一次使用时打开
+// 之前的步骤超时或执行了 exit 会结束会话, 此时重新打开一个会话, 工作目录和环境变量回到初始状态
+type stepShell struct {
+	open  SessionOpener
+	shell Session
+}
+
+func (s *stepShell) get(ctx context.Context, step int, hooks StepHooks) (Session, error) {
+	if s.shell != nil && !s.shell.Exited() {
+		return s.shell, nil
+	}
+	shell, err := s.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if s.shell != nil {
+		s.shell.Close()
+		hooks.out(step, StreamSystem, "==> 会话已结束, 重新打开会话")
+	}
+	s.shell = shell
+	return shell, nil
+}
+
+func (s *stepShell) close() {
+	if s.shell != nil {
+		s.shell.Close()
+	}
+}
+
+// runStep 在 shell 会话中执行一个步骤, 失败时按步骤的 retry 重试, 记录最后一次的退出码和耗时
+func runStep(ctx context.Context, shell *stepShell, step int, s dto.Step, result *dto.StepResult, hooks StepHooks) error {
+	c := strings.TrimSpace(s.Command())
+	attempts := s.Retry.MaxAttempts()
+	var err error
+	for attempt := 1; ; attempt++ {
+		if attempt > 1 {
+			delay := s.Retry.DelayBefore(attempt)
+			hooks.out(step, StreamSystem, fmt.Sprintf("==> %s 后第 %d 次重试 (共 %d 次)", delay, attempt-1, attempts-1))
+			if hooks.Retry != nil {
+				hooks.Retry(step, attempt, attempts)
+			}
+			if werr := Sleep(ctx, delay); werr != nil {
+				break
+			}
+		}
+		result.Attempts = attempt
+		err = runAttempt(ctx, shell, step, c, s, result, hooks)
+		if err == nil || attempt >= attempts || ctx.Err() != nil || !s.Retry.RetriesOn(result.ExitCode) {
+			break
+		}
+	}
+	if err != nil {
+		return &StepError{Index: step, Cmd: c, Err: err}
+	}
+	return nil
+}
+
+// runAttempt 执行一次步骤
+func runAttempt(ctx context.Context, shell *stepShell, step int, c string, s dto.Step, result *dto.StepResult, hooks StepHooks) error {
+	stepOut := func(stream, text string) {
+		hooks.out(step, stream, text)
+	}
+	start := time.Now()
+	result.StartedAt = &start
+	sh, err := shell.get(ctx, step, hooks)
+	if err != nil {
+		result.Status = string(TaskError)
+		result.ExitCode = -1
+		stepOut(StreamSystem, "==> 打开会话失败: "+err.Error())
+		return err
+	}
+	for _, line := range strings.Split(c, "\n") {
+		stepOut(StreamSystem, "$ "+line)
+	}
+
+	stepCtx, cancel := WithTimeout(ctx, s.Timeout, "步骤")
+	var code int
+	if s.Upload != nil || s.Download != nil {
+		code, err = transfer(stepCtx, sh, s, stepOut)
+	} else {
+		code, err = sh.RunStep(stepCtx, c, s.Env, stepOut)
+	}
+	status := StepStatus(stepCtx, err)
+	cancel()
+	elapsed := time.Since(start)
+	result.Status = string(status)
+	result.ExitCode = code
+	result.Duration = elapsed.Milliseconds()
+	stepOut(StreamSystem, fmt.Sprintf("<== 退出码 %d, 耗时 %s", code, elapsed.Round(time.Millisecond)))
+	return err
+}
+
+// transfer 在会话中执行上传或下载步骤, 失败时退出码为 -1
+func transfer(ctx context.Context, sh Session, s dto.Step, out OutputFunc) (int, error) {
+	t, ok := sh.(Transferer)
+	if !ok {
+		err := errors.New("执行器不支持上传和下载文件")
+		out(StreamSystem, "==> "+err.Error())
+		return -1, err
+	}
+	var err error
+	if s.Upload != nil {
+		err = t.Upload(ctx, *s.Upload, s.Env, out)
+	} else {
+		err = t.Download(ctx, *s.Download, s.Env, out)
+	}
+	if err == nil {
+		return 0, nil
+	}
+	if cause := context.Cause(ctx); cause != nil {
+		// 取消或超时时连接被关闭, 以取消或超时的原因作为失败原因
+		err = cause
+	}
+	out(StreamSystem, "==> 传输失败: "+err.Error())
+	return -1, err
+}
+
+// allowFailure 设置了 continue_on_error 的步骤失败时记为警告, 不影响后续步骤和执行结果
+// 取消或外层超时导致的失败仍然是失败
+func allowFailure(ctx context.Context, s dto.Step, result *dto.StepResult, step int, hooks StepHooks) bool {
+	if !s.ContinueOnError || ctx.Err() != nil {
+		return false
+	}
+	result.Status = string(TaskWarning)
+	hooks.out(step, StreamSystem, "==> 步骤失败, 已开启 continue_on_error, 记为警告")
+	return true
+}
+
+// skipStep 输出步骤因条件不满足被跳过
+func skipStep(step int, s dto.Step, hooks StepHooks) {
+	if s.If == "" {
+		hooks.out(step, StreamSystem, "==> 跳过步骤")
+		return
+	}
+	hooks.out(step, StreamSystem, "==> 跳过步骤 (if: "+s.If+")")
+}
+
+// skippedResults 初始化步骤结果, 没有执行的步骤保持 skipped
+func skippedResults(steps []dto.Step) []dto.StepResult {
+	results := make([]dto.StepResult, len(steps))
+	for i, s := range steps {
+		results[i] = dto.StepResult{Index: i + 1, Run: s.Command(), Status: string(TaskSkipped)}
+	}
+	return results
+}
+
+// Sleep 等待 d, ctx 先结束时返回 ctx 结束的原因
+func Sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return context.Cause(ctx)
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
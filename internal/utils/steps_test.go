@@ -0,0 +1,172 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pubot/internal/dto"
+)
+
+func TestWithTimeout(t *testing.T) {
+	ctx, cancel := WithTimeout(context.Background(), 0, "步骤")
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Fatal("超时为 0 时不应设置截止时间")
+	}
+
+	ctx, cancel = WithTimeout(context.Background(), 10*time.Millisecond, "阶段")
+	defer cancel()
+	<-ctx.Done()
+	cause := context.Cause(ctx)
+	if !errors.Is(cause, ErrTimeout) || !strings.Contains(cause.Error(), "阶段") || !strings.Contains(cause.Error(), "10ms") {
+		t.Fatalf("超时原因为 %v", cause)
+	}
+}
+
+func TestStepStatus(t *testing.T) {
+	timedOut, cancel := WithTimeout(context.Background(), time.Nanosecond, "步骤")
+	defer cancel()
+	<-timedOut.Done()
+	canceled, cancelCause := context.WithCancelCause(context.Background())
+	cancelCause(errors.New("用户取消"))
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want TaskStatusEnum
+	}{
+		{"成功", context.Background(), nil, TaskSuccess},
+		{"失败", context.Background(), errors.New("exit status 1"), TaskError},
+		{"超时", timedOut, context.Cause(timedOut), TaskTimeout},
+		{"错误来自外层超时", canceled, context.Cause(timedOut), TaskTimeout},
+		{"取消", canceled, context.Cause(canceled), TaskCanceled},
+		{"取消后的普通错误", canceled, errors.New("exit status 1"), TaskCanceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := StepStatus(tt.ctx, tt.err); got != tt.want {
+				t.Fatalf("StepStatus = %s, 期望 %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakeShells 记录同时执行的步骤数的测试会话
+// 步骤脚本为 "ok 文本"(输出文本并等待 50ms)、"fail"(等待 20ms 后退出码 1) 或 "block"(等待取消)
+type fakeShells struct {
+	mu      sync.Mutex
+	opened  int
+	running int
+	peak    int
+}
+
+func (f *fakeShells) open(ctx context.Context) (Session, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.opened++
+	return &fakeSession{shells: f}, nil
+}
+
+type fakeSession struct {
+	shells *fakeShells
+}
+
+func (s *fakeSession) RunStep(ctx context.Context, script string, env map[string]string, out OutputFunc) (int, error) {
+	f := s.shells
+	f.mu.Lock()
+	f.running++
+	f.peak = max(f.peak, f.running)
+	f.mu.Unlock()
+	defer func() {
+		f.mu.Lock()
+		f.running--
+		f.mu.Unlock()
+	}()
+	switch {
+	case strings.HasPrefix(script, "ok "):
+		out(StreamStdout, strings.TrimPrefix(script, "ok "))
+		if err := Sleep(ctx, 50*time.Millisecond); err != nil {
+			return -1, err
+		}
+		return 0, nil
+	case script == "block":
+		<-ctx.Done()
+		return -1, context.Cause(ctx)
+	default:
+		if err := Sleep(ctx, 20*time.Millisecond); err != nil {
+			return -1, err
+		}
+		return 1, errors.New("exit status 1")
+	}
+}
+
+func (s *fakeSession) Exited() bool { return false }
+
+func (s *fakeSession) Close() error { return nil }
+
+func TestRunParallel(t *testing.T) {
+	tests := []struct {
+		name        string
+		steps       []string
+		maxParallel int
+		failFast    bool
+		peak        int
+		failed      int      // 第一个失败步骤的序号, 0 表示全部成功
+		statuses    []string // 各步骤的结果
+	}{
+		{"不限制并行数", []string{"ok a", "ok b", "ok c", "ok d"}, 0, false, 4, 0,
+			[]string{"success", "success", "success", "success"}},
+		{"最大并行数", []string{"ok a", "ok b", "ok c", "ok d", "ok e"}, 2, false, 2, 0,
+			[]string{"success", "success", "success", "success", "success"}},
+		{"等待全部结束", []string{"ok a", "fail", "ok c"}, 0, false, 3, 2,
+			[]string{"success", "error", "success"}},
+		{"失败立即取消", []string{"block", "fail", "block"}, 0, true, 3, 2,
+			[]string{"canceled", "error", "canceled"}},
+		{"失败后不再开始剩余步骤", []string{"fail", "ok b", "ok c"}, 1, true, 1, 1,
+			[]string{"error", "skipped", "skipped"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps := make([]dto.Step, len(tt.steps))
+			for i, s := range tt.steps {
+				steps[i] = dto.Step{Run: s}
+			}
+			var (
+				mu  sync.Mutex
+				out = map[int][]string{}
+			)
+			hooks := StepHooks{Out: func(step int, stream, text string) {
+				if stream == StreamStdout {
+					mu.Lock()
+					out[step] = append(out[step], text)
+					mu.Unlock()
+				}
+			}}
+			shells := &fakeShells{}
+			results, err := RunParallel(context.Background(), steps, shells.open, tt.maxParallel, tt.failFast, hooks)
+
+			var stepErr *StepError
+			if tt.failed == 0 && err != nil || tt.failed != 0 && (!errors.As(err, &stepErr) || stepErr.Index != tt.failed) {
+				t.Fatalf("返回 %v, 期望步骤 %d 失败", err, tt.failed)
+			}
+			if shells.peak != tt.peak {
+				t.Fatalf("最多同时执行 %d 个步骤, 期望 %d", shells.peak, tt.peak)
+			}
+			for i, r := range results {
+				if r.Status != tt.statuses[i] {
+					t.Fatalf("步骤 %d 结果为 %s, 期望 %s", i+1, r.Status, tt.statuses[i])
+				}
+				// 每个步骤使用独立的会话, 输出只属于自己的步骤
+				if text, ok := strings.CutPrefix(tt.steps[i], "ok "); ok && r.Status == "success" && !slices.Equal(out[i+1], []string{text}) {
+					t.Fatalf("步骤 %d 的输出为 %v, 期望 [%s]", i+1, out[i+1], text)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"pubot/internal/dto"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 模板最多嵌套的层数
+const maxTemplateDepth = 5
+
+// TemplateLookup 按名称获取模板的 YAML 文本
+type TemplateLookup func(name string) (string, error)
+
+// usesTemplates 任务是否继承或引入了模板
+func usesTemplates(p *dto.TaskYAML) bool {
+	return p.Extends != nil || len(p.Include) > 0
+}
+
+// TemplateRefs 返回 YAML 中 extends 和 include 引用的模板名称, YAML 无效时返回空
+func TemplateRefs(yamlText string) []string {
+	var p dto.TaskYAML
+	if err := yaml.Unmarshal([]byte(yamlText), &p); err != nil {
+		return nil
+	}
+	var names []string
+	if p.Extends != nil {
+		names = append(names, p.Extends.Template)
+	}
+	for _, ref := range p.Include {
+		names = append(names, ref.Template)
+	}
+	return names
+}
+
+// resolveTemplates 展开任务的 extends 和 include, p 需要已经转换过旧写法
+// 阶段的顺序为: 继承的模板、依次引入的模板、任务自己的阶段, 任务中同名的阶段替换模板中的阶段
+// 环境变量和主机组按同样的顺序合并, 后面的覆盖前面的
+func resolveTemplates(p *dto.TaskYAML, lookup TemplateLookup, stack []string) error {
+	if !usesTemplates(p) {
+		return nil
+	}
+	if lookup == nil {
+		return errors.New("不支持使用模板")
+	}
+	var stages []dto.Stage
+	env := map[string]string{}
+	groups := map[string][]dto.Host{}
+	if p.Extends != nil {
+		base, err := loadTemplate(*p.Extends, lookup, stack)
+		if err != nil {
+			return atPath("extends", err)
+		}
+		stages = base.Stages
+		maps.Copy(env, base.Env)
+		maps.Copy(groups, base.HostGroups)
+		p.Timeout = cmp.Or(p.Timeout, base.Timeout)
+		p.Concurrency = cmp.Or(p.Concurrency, base.Concurrency)
+		p.Workspace = cmp.Or(p.Workspace, base.Workspace)
+		if len(p.RunsOn) == 0 {
+			p.RunsOn = base.RunsOn
+		}
+		if len(p.Finally) == 0 {
+			p.Finally = base.Finally
+		}
+	}
+	for i, ref := range p.Include {
+		inc, err := loadTemplate(ref, lookup, stack)
+		if err != nil {
+			return atPath(fmt.Sprintf("include[%d]", i), err)
+		}
+		// 引入的阶段使用所在模板的 runs-on
+		inheritRunsOn(inc)
+		stages = append(stages, inc.Stages...)
+		maps.Copy(env, inc.Env)
+		maps.Copy(groups, inc.HostGroups)
+	}
+	for _, s := range p.Stages {
+		if i := slices.IndexFunc(stages, func(t dto.Stage) bool { return t.Name == s.Name }); i >= 0 {
+			stages[i] = s
+		} else {
+			stages = append(stages, s)
+		}
+	}
+	maps.Copy(env, p.Env)
+	maps.Copy(groups, p.HostGroups)
+	p.Stages = stages
+	if len(env) > 0 {
+		p.Env = env
+	}
+	if len(groups) > 0 {
+		p.HostGroups = groups
+	}
+	p.Extends, p.Include = nil, nil
+	return nil
+}
+
+// loadTemplate 读取并展开模板, 将 with 中的值替换到模板的 ${{ params.名称 }} 中
+// 写成 ${{ params.名称 }} 的值原样保留, 在执行时替换为任务的参数
+func loadTemplate(ref dto.TemplateRef, lookup TemplateLookup, stack []string) (*dto.TaskYAML, error) {
+	if ref.Template == "" {
+		return nil, errors.New("模板名称不能为空")
+	}
+	if slices.Contains(stack, ref.Template) {
+		return nil, fmt.Errorf("模板循环引用: %s", strings.Join(append(stack, ref.Template), " -> "))
+	}
+	if len(stack) >= maxTemplateDepth {
+		return nil, fmt.Errorf("模板嵌套超过 %d 层", maxTemplateDepth)
+	}
+	text, err := lookup(ref.Template)
+	if err != nil {
+		return nil, err
+	}
+	var tpl dto.TaskYAML
+	if err := yaml.Unmarshal([]byte(text), &tpl); err != nil {
+		return nil, fmt.Errorf("模板 %s 无效: %w", ref.Template, err)
+	}
+	if _, err := normalizeStages(&tpl); err != nil {
+		return nil, fmt.Errorf("模板 %s 无效: %v", ref.Template, err)
+	}
+	if err := resolveTemplates(&tpl, lookup, append(stack, ref.Template)); err != nil {
+		// 模板内部的路径无法在任务中定位, 不再保留
+		return nil, fmt.Errorf("模板 %s: %v", ref.Template, err)
+	}
+	if err := validateParams(tpl.Params); err != nil {
+		return nil, fmt.Errorf("模板 %s 的参数无效: %v", ref.Template, err)
+	}
+
+	values := make(map[string]string, len(tpl.Params))
+	direct := maps.Clone(ref.With)
+	for name, v := range ref.With {
+		if s, ok := v.(string); ok && placeholderRe.MatchString(s) {
+			values[name] = s
+			delete(direct, name)
+		}
+	}
+	params := slices.DeleteFunc(slices.Clone(tpl.Params), func(p dto.Param) bool {
+		_, ok := values[p.Name]
+		return ok
+	})
+	for name := range values {
+		if !slices.ContainsFunc(tpl.Params, func(p dto.Param) bool { return p.Name == name }) {
+			return nil, fmt.Errorf("模板 %s: 未声明的参数: %s", ref.Template, name)
+		}
+	}
+	resolved, err := ResolveParams(params, direct)
+	if err != nil {
+		return nil, fmt.Errorf("模板 %s: %w", ref.Template, err)
+	}
+	for name, v := range resolved {
+		values[name] = toString(v)
+	}
+	// with 的值由任务作者编写, 命令中也直接替换
+	with := func(name string) (string, bool) {
+		v, ok := values[name]
+		return v, ok
+	}
+	replacePlaceholders(&tpl, with, with)
+	tpl.Params = nil
+	return &tpl, nil
+}
@@ -0,0 +1,76 @@
+package utils
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+
+	"pubot/internal/dto"
+)
+
+// 文件所有者 user 或 user:group, 上传时作为远程 chown 的参数
+var ownerRe = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*(:[A-Za-z0-9_][A-Za-z0-9_.-]*)?$`)
+
+// validateTransfer 检查上传和下载步骤, 它们通过目标主机的 SSH 连接传输, 只能用在设置了 hosts 的阶段中
+func validateTransfer(scope string, step dto.Step, remote bool, declared map[string]bool) error {
+	key, t := "upload", step.Upload
+	switch {
+	case step.Upload != nil && step.Download != nil:
+		return atPath("download", fmt.Errorf("%s 的 upload 和 download 不能同时设置", scope))
+	case step.Download != nil:
+		key, t = "download", step.Download
+	case step.Upload == nil:
+		return nil
+	}
+	switch {
+	case step.Run != "":
+		return atPath("run", fmt.Errorf("%s 的 run 和 %s 不能同时设置", scope, key))
+	case !remote:
+		return atPath(key, fmt.Errorf("%s 的 %s 只能用在设置了 hosts 的阶段中", scope, key))
+	case t.Src == "":
+		return atPath(key, fmt.Errorf("%s 的 %s 需要设置 src", scope, key))
+	case t.Dest == "":
+		return atPath(key, fmt.Errorf("%s 的 %s 需要设置 dest", scope, key))
+	}
+	for _, field := range []struct{ key, text string }{{"src", t.Src}, {"dest", t.Dest}} {
+		if err := validatePlaceholders(scope, field.text, declared); err != nil {
+			return atPath(key+"."+field.key, err)
+		}
+	}
+	if _, err := t.Perm(); err != nil {
+		return atPath(key+".mode", fmt.Errorf("%s 的 %s: %w", scope, key, err))
+	}
+	if t.Owner != "" && !ownerRe.MatchString(t.Owner) {
+		return atPath(key+".owner", fmt.Errorf("%s 的 %s.owner 无效, 应为 user 或 user:group: %q", scope, key, t.Owner))
+	}
+	for i, pattern := range t.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return atPath(fmt.Sprintf("%s.exclude[%d]", key, i), fmt.Errorf("%s 的 %s.exclude 无效: %q", scope, key, pattern))
+		}
+	}
+	return nil
+}
+
+// replaceTransfer 返回替换了 src 和 dest 中占位符的副本, t 为空时返回空
+func replaceTransfer(t *dto.Transfer, replace func(string) string) *dto.Transfer {
+	if t == nil {
+		return nil
+	}
+	replaced := *t
+	replaced.Src, replaced.Dest = replace(t.Src), replace(t.Dest)
+	return &replaced
+}
+
+// FormatBytes 以 B、KiB、MiB、GiB 显示字节数
+func FormatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit && exp < 2; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMG"[exp])
+}
@@ -0,0 +1,44 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"pubot/internal/config"
+	"pubot/internal/dto"
+)
+
+// TaskWorkspace 任务的工作目录根路径
+func TaskWorkspace(taskID uint) string {
+	return filepath.Join(config.Get().WorkSpace, "tasks", strconv.FormatUint(uint64(taskID), 10))
+}
+
+// PrepareWorkspace 按策略准备本次执行的工作目录
+func PrepareWorkspace(taskID uint, run int, policy string) (string, error) {
+	root := TaskWorkspace(taskID)
+	var dir string
+	switch policy {
+	case dto.WorkspaceFresh:
+		dir = filepath.Join(root, "runs", strconv.Itoa(run))
+		if err := os.RemoveAll(dir); err != nil {
+			return "", err
+		}
+	case dto.WorkspaceClean:
+		dir = filepath.Join(root, "workspace")
+		if err := os.RemoveAll(dir); err != nil {
+			return "", err
+		}
+	default:
+		dir = filepath.Join(root, "workspace")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	return dir, nil
+}
+
+// RemoveWorkspace 删除任务的全部工作目录
+func RemoveWorkspace(taskID uint) error {
+	return os.RemoveAll(TaskWorkspace(taskID))
+}
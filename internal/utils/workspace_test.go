@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pubot/internal/dto"
+)
+
+func TestPrepareWorkspace(t *testing.T) {
+	tests := []struct {
+		policy   string
+		sameDir  bool // 两次执行使用同一个目录
+		keepFile bool // 第二次执行时还能看到第一次留下的文件
+	}{
+		{"", true, true},
+		{dto.WorkspaceReuse, true, true},
+		{dto.WorkspaceClean, true, false},
+		{dto.WorkspaceFresh, false, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			taskID := uint(100 + i)
+			defer RemoveWorkspace(taskID)
+			first, err := PrepareWorkspace(taskID, 1, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rel, err := filepath.Rel(TaskWorkspace(taskID), first); err != nil || !filepath.IsLocal(rel) {
+				t.Fatalf("工作目录 %s 不在任务目录 %s 下", first, TaskWorkspace(taskID))
+			}
+			if err := os.WriteFile(filepath.Join(first, "marker"), nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			second, err := PrepareWorkspace(taskID, 2, tt.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (first == second) != tt.sameDir {
+				t.Fatalf("两次执行的工作目录为 %s、%s", first, second)
+			}
+			if _, err := os.Stat(filepath.Join(second, "marker")); (err == nil) != tt.keepFile {
+				t.Fatalf("第二次执行时上次留下的文件: %v", err)
+			}
+		})
+	}
+}
+
+func TestRemoveWorkspace(t *testing.T) {
+	kept, err := PrepareWorkspace(1, 1, dto.WorkspaceReuse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveWorkspace(1)
+	removed, err := PrepareWorkspace(2, 1, dto.WorkspaceReuse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept == removed {
+		t.Fatalf("不同任务使用了同一个工作目录 %s", kept)
+	}
+	if err := RemoveWorkspace(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(TaskWorkspace(2)); !os.IsNotExist(err) {
+		t.Fatalf("删除后任务目录仍然存在: %v", err)
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Fatalf("删除其他任务的目录影响了任务 1: %v", err)
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"errors"
 	"log/slog"
 	"net/http"
 	"sync"
@@ -11,16 +12,62 @@ import (
 type TaskStatusEnum string
 
 const (
-	TaskRunning TaskStatusEnum = "running"
-	TaskSuccess TaskStatusEnum = "success"
-	TaskError   TaskStatusEnum = "error"
-	TaskStopped TaskStatusEnum = "stopped" // 可选，和 success 区分
+	TaskQueued      TaskStatusEnum = "queued" // 排队等待执行
+	TaskRunning     TaskStatusEnum = "running"
+	TaskSuccess     TaskStatusEnum = "success"
+	TaskError       TaskStatusEnum = "error"
+	TaskStopped     TaskStatusEnum = "stopped"     // 可选，和 success 区分
+	TaskCanceled    TaskStatusEnum = "canceled"    // 被用户取消
+	TaskTimeout     TaskStatusEnum = "timeout"     // 任务、阶段或步骤超时
+	TaskInterrupted TaskStatusEnum = "interrupted" // pubot 关闭或重启导致中断
+	TaskSkipped     TaskStatusEnum = "skipped"     // 阶段或步骤没有执行
+	TaskWarning     TaskStatusEnum = "warning"     // 设置了 continue_on_error 的步骤失败, 不影响执行结果
 )
 
 type TaskStatus struct {
-	ID     uint           `json:"id"`
+	ID      uint           `json:"id"`
+	Status  TaskStatusEnum `json:"status"`
+	Count   int            `json:"count"`
+	Run     int            `json:"run,omitempty"` // 执行序号
+	Retry   *RetryStatus   `json:"retry,omitempty"`
+	Cell    *CellStatus    `json:"cell,omitempty"`
+	Rollout *RolloutStatus `json:"rollout,omitempty"`
+	Queue   *QueueStatus   `json:"queue,omitempty"`
+}
+
+// RetryStatus 重试进度, Step 为 0 表示重新执行整个阶段
+type RetryStatus struct {
+	Stage    string `json:"stage"`
+	Step     int    `json:"step,omitempty"`
+	Attempt  int    `json:"attempt"` // 即将开始第几次执行
+	Attempts int    `json:"attempts"`
+}
+
+// CellStatus 矩阵阶段中一个组合的状态, 组合开始和结束时各广播一次
+type CellStatus struct {
+	Stage  string            `json:"stage"`
+	Name   string            `json:"name"` // 组合的名称, 例如 "build (18, linux-amd64)"
+	Matrix map[string]string `json:"matrix"`
+	Status TaskStatusEnum    `json:"status"`
+}
+
+// RolloutStatus 设置了 hosts 的阶段的执行进度, 每批开始、每台主机结束和阶段结束时各广播一次
+// 不是滚动部署时所有主机为一批
+type RolloutStatus struct {
+	Stage   string         `json:"stage"`
+	Batch   int            `json:"batch"` // 当前批次, 从 1 开始
+	Batches int            `json:"batches"`
+	Total   int            `json:"total"`  // 主机总数
+	Done    int            `json:"done"`   // 已结束的主机数, 包括失败的主机
+	Failed  int            `json:"failed"` // 失败的主机数
+	Status  TaskStatusEnum `json:"status"` // 阶段结束前为 running
+}
+
+// QueueStatus 阶段等待空闲执行机器的状态, 开始等待时为 queued, 分配到执行机器后为 running
+type QueueStatus struct {
+	Stage  string         `json:"stage"`
+	RunsOn []string       `json:"runsOn,omitempty"`
 	Status TaskStatusEnum `json:"status"`
-	Count  int            `json:"count"`
 }
 
 type Hub struct {
@@ -60,18 +107,23 @@ func (h *Hub) Broadcast(status TaskStatus) {
 
 }
 
-func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request) {
+// upgradeWS 升级为 WebSocket 连接, 并回应客户端放在 subprotocol 中的 token
+func upgradeWS(w http.ResponseWriter, r *http.Request) (*websocket.Conn, error) {
 	// 取出客户端请求的 subprotocols（里面就是 token）
 	protocols := websocket.Subprotocols(r)
 	if len(protocols) == 0 {
 		http.Error(w, "Missing token", http.StatusUnauthorized)
-		return
+		return nil, errors.New("missing token")
 	}
 	upgrader := websocket.Upgrader{
 		CheckOrigin:  func(r *http.Request) bool { return true },
 		Subprotocols: []string{protocols[0]}, // 只确认这个 token
 	}
-	conn, err := upgrader.Upgrade(w, r, nil)
+	return upgrader.Upgrade(w, r, nil)
+}
+
+func (h *Hub) ServeWS(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWS(w, r)
 	if err != nil {
 		slog.Error("ws 升级失败", slog.Any("Err", err.Error()))
 		return
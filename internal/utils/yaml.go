@@ -1,16 +1,598 @@
 package utils
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
 	"pubot/internal/dto"
 
 	"gopkg.in/yaml.v3"
 )
 
-func ParseTaskYAML(yamlText string) (*dto.TaskYAML, error) {
+var (
+	stageNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+	// yaml 语法错误中的行号, 例如 "yaml: line 3: did not find expected key"
+	yamlLineRe = regexp.MustCompile(`line (\d+)`)
+)
+
+// ValidationIssue 校验发现的问题, Line/Column 从1开始, 无法定位时为 0
+type ValidationIssue struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Path    string `json:"path,omitempty"` // 问题所在的位置, 例如 stages[1].steps[0].run
+	Message string `json:"message"`
+}
+
+func (i ValidationIssue) String() string {
+	if i.Line == 0 {
+		return i.Message
+	}
+	if i.Column == 0 {
+		return fmt.Sprintf("第 %d 行: %s", i.Line, i.Message)
+	}
+	return fmt.Sprintf("第 %d 行第 %d 列: %s", i.Line, i.Column, i.Message)
+}
+
+// ValidationResult 任务 YAML 的校验结果, 有错误时 Parsed 为空
+type ValidationResult struct {
+	Valid    bool              `json:"valid"`
+	Errors   []ValidationIssue `json:"errors"`
+	Warnings []ValidationIssue `json:"warnings"` // 未知或已废弃的键, 不影响保存和执行
+	Parsed   *dto.TaskYAML     `json:"parsed,omitempty"`
+	Resolved string            `json:"resolved,omitempty"` // 展开模板后的 YAML, 没有使用模板时为原文
+}
+
+// YAMLError 任务 YAML 校验失败
+type YAMLError struct {
+	Issues []ValidationIssue
+}
+
+func (e *YAMLError) Error() string {
+	msgs := make([]string, len(e.Issues))
+	for i, issue := range e.Issues {
+		msgs[i] = issue.String()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ParseOptions 解析和校验任务 YAML 时使用的外部信息, 字段为空时跳过对应的展开或检查
+type ParseOptions struct {
+	// Templates 按名称获取 extends 和 include 引用的模板
+	Templates TemplateLookup
+	// CheckExecutor 检查阶段的 executor、platform 和 runs-on 能否选到执行器
+	CheckExecutor func(s dto.Stage) error
+	// PlatformSupported 是否有执行器支持该平台
+	// 没有执行器支持的 platform 不是错误, 阶段在本机执行, 校验时给出警告
+	PlatformSupported func(platform string) bool
+}
+
+// ParseTaskYAML 解析任务 YAML, 将旧的 build/deploy 写法转换为 stages, 展开模板并校验
+// 校验失败时返回 *YAMLError, 警告不影响解析结果
+func ParseTaskYAML(yamlText string, opts ParseOptions) (*dto.TaskYAML, error) {
+	result := ValidateTaskYAML(yamlText, opts)
+	if !result.Valid {
+		return nil, &YAMLError{Issues: result.Errors}
+	}
+	return result.Parsed, nil
+}
+
+// ValidateTaskYAML 按任务结构逐个节点校验 YAML, 错误和警告都带有行列位置
+// 结构正确后再转换旧写法、展开模板, 并检查各字段的取值、阶段依赖和表达式
+// 使用了模板时, 展开后才发现的错误没有行列位置, 路径对应 Resolved 中的位置
+func ValidateTaskYAML(yamlText string, opts ParseOptions) *ValidationResult {
+	result := &ValidationResult{Errors: []ValidationIssue{}, Warnings: []ValidationIssue{}}
+	fail := func(issue ValidationIssue) *ValidationResult {
+		result.Errors = append(result.Errors, issue)
+		return result
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal([]byte(yamlText), &root); err != nil {
+		return fail(yamlErrorIssue(err))
+	}
+	schema := &schemaChecker{}
+	if len(root.Content) > 0 {
+		schema.check(root.Content[0], taskYAMLType, "")
+	}
+	result.Errors = append(result.Errors, schema.errors...)
+	result.Warnings = append(result.Warnings, schema.warnings...)
+	if len(result.Errors) > 0 {
+		return result
+	}
+
 	var parsed dto.TaskYAML
-	err := yaml.Unmarshal([]byte(yamlText), &parsed)
+	if err := root.Decode(&parsed); err != nil {
+		return fail(yamlErrorIssue(err))
+	}
+	templated := usesTemplates(&parsed)
+	sources, err := normalizeStages(&parsed)
+	if err == nil && templated {
+		if err = resolveTemplates(&parsed, opts.Templates, nil); err == nil {
+			sources = stageSources(&parsed)
+		}
+	}
+	if err != nil {
+		return fail(locateIssue(&root, err))
+	}
+	if err := validateTask(&parsed, sources, opts.CheckExecutor); err != nil {
+		if templated {
+			issue := locateIssue(nil, err)
+			issue.Message = "展开模板后: " + issue.Message
+			return fail(issue)
+		}
+		return fail(locateIssue(&root, err))
+	}
+	for _, err := range platformWarnings(&parsed, sources, opts.PlatformSupported) {
+		if templated {
+			issue := locateIssue(nil, err)
+			issue.Message = "展开模板后: " + issue.Message
+			result.Warnings = append(result.Warnings, issue)
+		} else {
+			result.Warnings = append(result.Warnings, locateIssue(&root, err))
+		}
+	}
+	expandHostGroups(&parsed)
+	inheritRunsOn(&parsed)
+	result.Valid, result.Parsed, result.Resolved = true, &parsed, yamlText
+	if templated {
+		var buf bytes.Buffer
+		enc := yaml.NewEncoder(&buf)
+		enc.SetIndent(2)
+		if err := enc.Encode(&parsed); err != nil {
+			return fail(ValidationIssue{Message: err.Error()})
+		}
+		result.Resolved = buf.String()
+	}
+	return result
+}
+
+// locateIssue 将校验错误转换为问题, root 不为空时按错误的路径定位行列
+func locateIssue(root *yaml.Node, err error) ValidationIssue {
+	issue := ValidationIssue{Message: err.Error()}
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		issue.Path = fe.path
+		if root != nil {
+			if n := locate(root, fe.path); n != nil {
+				issue.Line, issue.Column = n.Line, n.Column
+			}
+		}
+	}
+	return issue
+}
+
+// yamlErrorIssue 从 yaml 库的错误信息中取出行号
+func yamlErrorIssue(err error) ValidationIssue {
+	issue := ValidationIssue{Message: err.Error()}
+	if m := yamlLineRe.FindStringSubmatch(err.Error()); m != nil {
+		issue.Line, _ = strconv.Atoi(m[1])
+	}
+	return issue
+}
+
+// fieldError 带有 YAML 路径的校验错误, 路径用于定位行列
+type fieldError struct {
+	path string
+	err  error
+}
+
+func (e *fieldError) Error() string {
+	return e.err.Error()
+}
+
+func (e *fieldError) Unwrap() error {
+	return e.err
+}
+
+// atPath 为 err 加上路径, err 已带有路径时作为相对路径拼接在 path 之后
+func atPath(path string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var fe *fieldError
+	if errors.As(err, &fe) {
+		return &fieldError{path: joinPath(path, fe.path), err: fe.err}
+	}
+	return &fieldError{path: path, err: err}
+}
+
+func joinPath(parent, child string) string {
+	switch {
+	case parent == "":
+		return child
+	case child == "":
+		return parent
+	case strings.HasPrefix(child, "["):
+		return parent + child
+	}
+	return parent + "." + child
+}
+
+// locate 按路径找到对应的节点, 找不到时返回已找到的最深的节点
+func locate(root *yaml.Node, path string) *yaml.Node {
+	n := root
+	if n.Kind == yaml.DocumentNode {
+		if len(n.Content) == 0 {
+			return nil
+		}
+		n = n.Content[0]
+	}
+	for _, part := range strings.Split(path, ".") {
+		key, rest, _ := strings.Cut(part, "[")
+		segments := []string{key}
+		if rest != "" {
+			segments = append(segments, strings.Split(strings.TrimSuffix(rest, "]"), "][")...)
+		}
+		for j, seg := range segments {
+			if n.Kind == yaml.AliasNode {
+				n = n.Alias
+			}
+			if seg == "" {
+				continue
+			}
+			if j > 0 {
+				idx, _ := strconv.Atoi(seg)
+				if n.Kind != yaml.SequenceNode || idx >= len(n.Content) {
+					return n
+				}
+				n = n.Content[idx]
+				continue
+			}
+			switch n.Kind {
+			case yaml.MappingNode:
+				next := mappingValue(n, seg)
+				if next == nil {
+					return n
+				}
+				n = next
+			case yaml.SequenceNode:
+				// 阶段直接写成步骤列表时, steps 就是阶段本身
+			default:
+				return n
+			}
+		}
+	}
+	return n
+}
+
+func mappingValue(n *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// yamlSources 转换旧写法后各阶段在原 YAML 中的位置, 用于定位校验错误
+type yamlSources struct {
+	stages  []stageSource
+	finally string // 任务的 finally 步骤所在的键, finally 或 post
+}
+
+type stageSource struct {
+	path    string // 阶段的路径, 例如 stages[1] 或 build
+	steps   string // 步骤所在的键, steps 或 run
+	finally string // finally 步骤所在的键, finally 或 post
+}
+
+// stageSources 展开模板后各阶段的位置
+func stageSources(p *dto.TaskYAML) *yamlSources {
+	sources := &yamlSources{finally: "finally"}
+	for i := range p.Stages {
+		sources.stages = append(sources.stages, stageSource{path: fmt.Sprintf("stages[%d]", i), steps: "steps", finally: "finally"})
+	}
+	return sources
+}
+
+// normalizeStages build 转换为名为 build 的阶段, deploy 转换为依赖 build 的 deploy 阶段
+// run 转换为 steps, post 转换为 finally, 返回转换前各阶段的位置
+func normalizeStages(p *dto.TaskYAML) (*yamlSources, error) {
+	sources := &yamlSources{finally: "finally"}
+	if p.Build != nil || p.Deploy != nil {
+		if len(p.Stages) > 0 {
+			key := "build"
+			if p.Build == nil {
+				key = "deploy"
+			}
+			return nil, atPath(key, errors.New("stages 不能和 build/deploy 同时使用"))
+		}
+		if p.Build != nil {
+			build := *p.Build
+			build.Name = "build"
+			p.Stages = append(p.Stages, build)
+			sources.stages = append(sources.stages, stageSource{path: "build"})
+		}
+		if p.Deploy != nil {
+			deploy := *p.Deploy
+			deploy.Name = "deploy"
+			if p.Build != nil {
+				deploy.Needs = []string{"build"}
+			}
+			p.Stages = append(p.Stages, deploy)
+			sources.stages = append(sources.stages, stageSource{path: "deploy"})
+		}
+		p.Build, p.Deploy = nil, nil
+	} else {
+		for i := range p.Stages {
+			sources.stages = append(sources.stages, stageSource{path: fmt.Sprintf("stages[%d]", i)})
+		}
+	}
+	if len(p.Post) > 0 {
+		if len(p.Finally) > 0 {
+			return nil, atPath("post", errors.New("finally 和 post 不能同时使用"))
+		}
+		p.Finally, p.Post = p.Post, nil
+		sources.finally = "post"
+	}
+	for i := range p.Stages {
+		s, src := &p.Stages[i], &sources.stages[i]
+		src.steps, src.finally = "steps", "finally"
+		if len(s.Run) > 0 {
+			if len(s.Steps) > 0 {
+				return nil, atPath(src.path+".run", fmt.Errorf("阶段 %s 的 steps 和 run 不能同时使用", s.Name))
+			}
+			s.Steps, s.Run = s.Run, nil
+			src.steps = "run"
+		}
+		if len(s.Post) > 0 {
+			if len(s.Finally) > 0 {
+				return nil, atPath(src.path+".post", fmt.Errorf("阶段 %s 的 finally 和 post 不能同时使用", s.Name))
+			}
+			s.Finally, s.Post = s.Post, nil
+			src.finally = "post"
+		}
+	}
+	return sources, nil
+}
+
+// validateTask 检查各字段的取值、阶段依赖、表达式和参数引用, 错误带有在原 YAML 中的路径
+// checkExecutor 为空时不检查阶段能否选到执行器
+func validateTask(p *dto.TaskYAML, sources *yamlSources, checkExecutor func(s dto.Stage) error) error {
+	switch p.Concurrency {
+	case "", dto.ConcurrencyQueue, dto.ConcurrencyReject, dto.ConcurrencyCancel:
+	default:
+		return atPath("concurrency", fmt.Errorf("concurrency 只能是 %s、%s 或 %s: %q",
+			dto.ConcurrencyQueue, dto.ConcurrencyReject, dto.ConcurrencyCancel, p.Concurrency))
+	}
+	switch p.Workspace {
+	case "", dto.WorkspaceReuse, dto.WorkspaceClean, dto.WorkspaceFresh:
+	default:
+		return atPath("workspace", fmt.Errorf("workspace 只能是 %s、%s 或 %s: %q",
+			dto.WorkspaceReuse, dto.WorkspaceClean, dto.WorkspaceFresh, p.Workspace))
+	}
+	if err := validateParams(p.Params); err != nil {
+		return atPath("params", err)
+	}
+	declared := make(map[string]bool, len(p.Params))
+	for _, param := range p.Params {
+		declared[param.Name] = true
+	}
+	if err := validateEnv("任务", p.Env, declared); err != nil {
+		return atPath("env", err)
+	}
+	if err := validateHostGroups(p.HostGroups); err != nil {
+		return atPath("host_groups", err)
+	}
+	if err := validateRunsOn("任务", p.RunsOn); err != nil {
+		return atPath("runs-on", err)
+	}
+
+	stages := make(map[string]*dto.Stage, len(p.Stages))
+	for i := range p.Stages {
+		s, src := &p.Stages[i], sources.stages[i]
+		at := func(key string, err error) error {
+			return atPath(joinPath(src.path, key), err)
+		}
+		if !stageNameRe.MatchString(s.Name) {
+			return at("name", fmt.Errorf("第 %d 个阶段的名称无效: %q", i+1, s.Name))
+		}
+		if _, ok := stages[s.Name]; ok {
+			return at("name", fmt.Errorf("阶段名称重复: %s", s.Name))
+		}
+		if s.Name == dto.FinallyStage {
+			return at("name", fmt.Errorf("阶段名称不能是 %s", dto.FinallyStage))
+		}
+		stages[s.Name] = s
+		if s.MaxParallel < 0 {
+			return at("max_parallel", fmt.Errorf("阶段 %s 的 max_parallel 不能小于 0", s.Name))
+		}
+		if !s.Parallel && (s.MaxParallel > 0 || s.FailFast) {
+			return at("parallel", fmt.Errorf("阶段 %s 没有开启 parallel, 不能设置 max_parallel 或 fail_fast", s.Name))
+		}
+		// 矩阵阶段的 env 和步骤中可以引用矩阵变量, 阶段的 if 在展开组合之前求值, 不能引用
+		stageDeclared := declared
+		if s.Matrix != nil {
+			var err error
+			if stageDeclared, err = validateMatrix(s.Name+" 阶段", s.Matrix, declared); err != nil {
+				return at("matrix", err)
+			}
+		}
+		if err := validateEnv(s.Name+" 阶段", s.Env, stageDeclared); err != nil {
+			return at("env", err)
+		}
+		if err := validateCondition(s.Name+" 阶段", s.If, declared); err != nil {
+			return at("if", err)
+		}
+		if err := validateRetry(s.Name+" 阶段", s.Retry); err != nil {
+			return at("retry", err)
+		}
+		if err := validateHosts(s.Name+" 阶段", s, p.HostGroups); err != nil {
+			return at("", err)
+		}
+		if err := validateRunsOn(s.Name+" 阶段", s.RunsOn); err != nil {
+			return at("runs-on", err)
+		}
+		if len(s.RunsOn) > 0 && s.Hosts != nil {
+			return at("runs-on", fmt.Errorf("阶段 %s 设置了 hosts, 不能设置 runs-on", s.Name))
+		}
+		if len(s.RunsOn) > 0 && s.Platform != "" {
+			return at("runs-on", fmt.Errorf("阶段 %s 的 platform 和 runs-on 不能同时使用", s.Name))
+		}
+		if s.WorkingDir != "" && !filepath.IsLocal(s.WorkingDir) {
+			return at("working_directory", fmt.Errorf("阶段 %s 的 working_directory 必须是任务工作目录下的相对路径: %q", s.Name, s.WorkingDir))
+		}
+		if checkExecutor != nil {
+			stage := *s
+			if inheritsRunsOn(s) {
+				stage.RunsOn = p.RunsOn
+			}
+			if err := checkExecutor(stage); err != nil {
+				key := "platform"
+				switch {
+				case s.Executor != "":
+					key = "executor"
+				case len(s.RunsOn) > 0:
+					key = "runs-on"
+				case len(stage.RunsOn) > 0:
+					// 使用的是任务的 runs-on
+					return atPath("runs-on", fmt.Errorf("阶段 %s: %w", s.Name, err))
+				}
+				return at(key, fmt.Errorf("阶段 %s: %w", s.Name, err))
+			}
+		}
+		if err := validateSteps(s.Name+" 阶段步骤", s.Steps, s.Hosts != nil, stageDeclared); err != nil {
+			return at(src.steps, err)
+		}
+		if err := validateSteps(s.Name+" 阶段 finally 步骤", s.Finally, s.Hosts != nil, stageDeclared); err != nil {
+			return at(src.finally, err)
+		}
+	}
+	if err := validateSteps("finally 步骤", p.Finally, false, declared); err != nil {
+		return atPath(sources.finally, err)
+	}
+	for i, s := range p.Stages {
+		for j, need := range s.Needs {
+			if _, ok := stages[need]; !ok {
+				path := fmt.Sprintf("%s.needs[%d]", sources.stages[i].path, j)
+				return atPath(path, fmt.Errorf("阶段 %s 依赖的阶段不存在: %s", s.Name, need))
+			}
+		}
+	}
+	return checkStageCycle(p.Stages, stages, sources)
+}
+
+// platformWarnings 没有执行器支持的 platform, 这些阶段在本机执行
+func platformWarnings(p *dto.TaskYAML, sources *yamlSources, supported func(platform string) bool) []error {
+	if supported == nil {
+		return nil
+	}
+	var warnings []error
+	for i, s := range p.Stages {
+		if s.Executor == "" && s.Hosts == nil && s.Platform != "" && !supported(s.Platform) {
+			warnings = append(warnings, atPath(sources.stages[i].path+".platform",
+				fmt.Errorf("阶段 %s: 没有支持平台 %s 的执行器, 将在本机执行", s.Name, s.Platform)))
+		}
+	}
+	return warnings
+}
+
+// validateSteps 检查步骤的环境变量、命令中的参数引用、上传和下载、if 条件和重试策略
+// remote 表示步骤在目标主机上执行, 只有这时可以使用 upload 和 download
+func validateSteps(scope string, steps []dto.Step, remote bool, declared map[string]bool) error {
+	for i, step := range steps {
+		at := func(key string, err error) error {
+			return atPath(joinPath(fmt.Sprintf("[%d]", i), key), err)
+		}
+		scope := fmt.Sprintf("%s %d", scope, i+1)
+		if err := validateEnv(scope, step.Env, declared); err != nil {
+			return at("env", err)
+		}
+		if err := validatePlaceholders(scope, step.Run, declared); err != nil {
+			return at("run", err)
+		}
+		if err := validateTransfer(scope, step, remote, declared); err != nil {
+			return at("", err)
+		}
+		if err := validateCondition(scope, step.If, declared); err != nil {
+			return at("if", err)
+		}
+		if err := validateRetry(scope, step.Retry); err != nil {
+			return at("retry", err)
+		}
+	}
+	return nil
+}
+
+// validateCondition 检查 if 条件的语法, 函数和上下文名称, 以及引用的参数是否已声明
+func validateCondition(scope, cond string, declared map[string]bool) error {
+	if cond == "" {
+		return nil
+	}
+	e, err := ParseExpr(cond)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("%s 的 if 无效: %w", scope, err)
+	}
+	for _, name := range e.Params() {
+		if !declared[name] {
+			return fmt.Errorf("%s 的 if 无效: 参数未声明: %s", scope, name)
+		}
+	}
+	for _, name := range e.Matrix() {
+		if !declared["matrix."+name] {
+			return fmt.Errorf("%s 的 if 无效: 矩阵变量未声明: %s", scope, name)
+		}
+	}
+	return nil
+}
+
+// validateRetry 检查重试策略
+func validateRetry(scope string, r *dto.Retry) error {
+	switch {
+	case r == nil:
+		return nil
+	case r.Attempts < 1:
+		return atPath("attempts", fmt.Errorf("%s 的 retry.attempts 不能小于 1", scope))
+	case r.Delay < 0:
+		return atPath("delay", fmt.Errorf("%s 的 retry.delay 不能小于 0", scope))
+	case r.Backoff != 0 && r.Backoff < 1:
+		return atPath("backoff", fmt.Errorf("%s 的 retry.backoff 不能小于 1", scope))
+	}
+	for i, code := range r.OnExitCodes {
+		if code == 0 {
+			return atPath(fmt.Sprintf("on_exit_codes[%d]", i), fmt.Errorf("%s 的 retry.on_exit_codes 不能包含 0", scope))
+		}
+	}
+	return nil
+}
+
+// checkStageCycle 检查阶段之间的依赖是否有环
+func checkStageCycle(list []dto.Stage, stages map[string]*dto.Stage, sources *yamlSources) error {
+	index := make(map[string]int, len(list))
+	for i, s := range list {
+		index[s.Name] = i
+	}
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(list))
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case visiting:
+			return atPath(sources.stages[index[name]].path+".needs", fmt.Errorf("阶段依赖存在循环: %v", append(path, name)))
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, need := range stages[name].Needs {
+			if err := visit(need, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for _, s := range list {
+		if err := visit(s.Name, nil); err != nil {
+			return err
+		}
 	}
-	return &parsed, nil
+	return nil
 }
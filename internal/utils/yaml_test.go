@@ -0,0 +1,186 @@
+package utils
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"pubot/internal/dto"
+)
+
+func TestValidateStageNeeds(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		message string // 期望的错误信息片段, 为空表示校验通过
+		line    int
+	}{
+		{
+			name: "dag",
+			yaml: `name: demo
+stages:
+  - name: build
+    steps: [make]
+  - name: test
+    needs: [build]
+    steps: [make test]
+  - name: lint
+    needs: [build]
+    steps: [make lint]
+  - name: deploy
+    needs: [test, lint]
+    steps: [make deploy]
+`,
+		},
+		{
+			name: "self",
+			yaml: `name: demo
+stages:
+  - name: build
+    needs: [build]
+    steps: [make]
+`,
+			message: "阶段依赖存在循环: [build build]",
+			line:    4,
+		},
+		{
+			name: "cycle",
+			yaml: `name: demo
+stages:
+  - name: a
+    needs: [c]
+    steps: [echo a]
+  - name: b
+    needs: [a]
+    steps: [echo b]
+  - name: c
+    needs: [b]
+    steps: [echo c]
+`,
+			message: "阶段依赖存在循环: [a c b a]",
+			line:    4,
+		},
+		{
+			name: "cycle after independent stages",
+			yaml: `name: demo
+stages:
+  - name: build
+    steps: [make]
+  - name: x
+    needs: [build, y]
+    steps: [echo x]
+  - name: y
+    needs: [x]
+    steps: [echo y]
+`,
+			message: "阶段依赖存在循环: [x y x]",
+			line:    6,
+		},
+		{
+			name: "missing",
+			yaml: `name: demo
+stages:
+  - name: build
+    steps: [make]
+  - name: deploy
+    needs: [build, test]
+    steps: [make deploy]
+`,
+			message: "阶段 deploy 依赖的阶段不存在: test",
+			line:    6,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := ValidateTaskYAML(tt.yaml, ParseOptions{})
+			if tt.message == "" {
+				if !result.Valid {
+					t.Fatalf("期望校验通过, 错误: %v", result.Errors)
+				}
+				return
+			}
+			if result.Valid || len(result.Errors) == 0 {
+				t.Fatal("期望校验失败")
+			}
+			issue := result.Errors[0]
+			if !strings.Contains(issue.Message, tt.message) {
+				t.Fatalf("错误信息为 %q, 期望包含 %q", issue.Message, tt.message)
+			}
+			if issue.Line != tt.line {
+				t.Fatalf("错误位置为第 %d 行, 期望第 %d 行", issue.Line, tt.line)
+			}
+		})
+	}
+}
+
+func TestValidateWorkingDirectory(t *testing.T) {
+	for dir, valid := range map[string]bool{
+		"app":          true,
+		"services/api": true,
+		"./app":        true,
+		"/opt/app":     false,
+		"../other":     false,
+		"app/../..":    false,
+	} {
+		text := "name: demo\nstages:\n  - name: build\n    working_directory: " + dir + "\n    steps: [make]\n"
+		result := ValidateTaskYAML(text, ParseOptions{})
+		if result.Valid != valid {
+			t.Errorf("working_directory %q 校验结果为 %v, 期望 %v: %v", dir, result.Valid, valid, result.Errors)
+			continue
+		}
+		if !valid && result.Errors[0].Line != 4 {
+			t.Errorf("working_directory %q 的错误位置为第 %d 行, 期望第 4 行", dir, result.Errors[0].Line)
+		}
+	}
+}
+
+func TestUnknownPlatformWarning(t *testing.T) {
+	text := `name: demo
+stages:
+  - name: build
+    platform: linux
+    steps: [make]
+  - name: package
+    platform: windows
+    steps: [make package]
+`
+	result := ValidateTaskYAML(text, ParseOptions{PlatformSupported: func(p string) bool { return p == "linux" }})
+	if !result.Valid {
+		t.Fatalf("没有执行器支持的 platform 不应导致校验失败: %v", result.Errors)
+	}
+	if len(result.Warnings) != 1 {
+		t.Fatalf("警告为 %v, 期望一个", result.Warnings)
+	}
+	w := result.Warnings[0]
+	if w.Line != 7 || w.Path != "stages[1].platform" || !strings.Contains(w.Message, "将在本机执行") {
+		t.Fatalf("警告为 %d:%d %s %q", w.Line, w.Column, w.Path, w.Message)
+	}
+}
+
+func TestCheckExecutorOption(t *testing.T) {
+	text := `name: demo
+stages:
+  - name: build
+    steps: [make]
+  - name: deploy
+    executor: docker
+    steps: [make deploy]
+`
+	if result := ValidateTaskYAML(text, ParseOptions{}); !result.Valid {
+		t.Fatalf("没有设置 CheckExecutor 时不应检查执行器: %v", result.Errors)
+	}
+	check := func(s dto.Stage) error {
+		if s.Executor != "" && s.Executor != "local" {
+			return errors.New("未知的执行器: " + s.Executor)
+		}
+		return nil
+	}
+	result := ValidateTaskYAML(text, ParseOptions{CheckExecutor: check})
+	if result.Valid {
+		t.Fatal("期望校验失败")
+	}
+	issue := result.Errors[0]
+	if issue.Line != 6 || issue.Path != "stages[1].executor" || !strings.Contains(issue.Message, "阶段 deploy: 未知的执行器: docker") {
+		t.Fatalf("错误为 %d %s %q", issue.Line, issue.Path, issue.Message)
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"flag"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
+	"pubot/internal/agent"
 	"pubot/internal/api"
 	"pubot/internal/config"
 	"pubot/internal/dao"
@@ -18,6 +22,10 @@ import (
 )
 
 func main() {
+	// pubot agent: 作为 agent 连接服务端执行步骤, 不需要配置文件和数据库
+	if len(os.Args) > 1 && os.Args[1] == "agent" {
+		os.Exit(agentMain(os.Args[2:]))
+	}
 	// 切换工作目录
 	if err := utils.ChWorkSpace(config.Get().WorkSpace); err != nil {
 		os.Exit(-1)
@@ -27,9 +35,20 @@ func main() {
 	userService := service.NewUserService(userDao)
 	userApi := api.NewUserApi(userService)
 	hub := utils.NewHub()
+	logHub := utils.NewLogHub()
 	taskDao := dao.NewTaskDao(dao.GetDb())
-	taskService := service.NewTaskService(taskDao, hub)
+	taskRunDao := dao.NewTaskRunDao(dao.GetDb())
+	templateDao := dao.NewTemplateDao(dao.GetDb())
+	// agent 服务先于任务服务创建, 恢复的执行可以直接使用 agent
+	agentService := service.NewAgentService(dao.NewAgentDao(dao.GetDb()))
+	taskService := service.NewTaskService(taskDao, taskRunDao, templateDao, agentService, hub, logHub)
+	// 处理上次退出时遗留的执行
+	if err := taskService.Recover(); err != nil {
+		slog.Error("恢复遗留执行失败", slog.String("Err", err.Error()))
+	}
 	taskApi := api.NewTaskApi(taskService)
+	templateApi := api.NewTemplateApi(service.NewTemplateService(templateDao, taskDao))
+	agentApi := api.NewAgentApi(agentService)
 
 	router := mux.NewRouter()
 	apiRouter := router.PathPrefix("/api").Subrouter()
@@ -43,9 +62,14 @@ func main() {
 	taskRouter := router.PathPrefix("/api").Subrouter()
 	taskRouter.Use(utils.AuthMw, utils.CorsMw)
 	taskApi.Register(taskRouter)
+	templateApi.Register(taskRouter)
+	agentApi.Register(taskRouter)
+	// agent 连接使用 agentToken 认证, 不经过用户认证中间件
+	router.HandleFunc("/ws/agent", agentApi.Connect)
 	wsTaskRouter := router.PathPrefix("/ws").Subrouter()
 	wsTaskRouter.Use(utils.AuthWsMw) // 先 Use，再注册路由
 	wsTaskRouter.HandleFunc("/task", hub.ServeWS)
+	wsTaskRouter.HandleFunc("/task/{id:[0-9]+}/log", logHub.ServeWS)
 	// 前端静态资源（放在最后，避免覆盖API路由）
 	router.PathPrefix("/").Handler(api.WebHandler())
 	server := http.Server{
@@ -68,6 +92,52 @@ func main() {
 		slog.Error("pubot 启动失败", slog.String("Err", err.Error()))
 	case ext := <-quit:
 		slog.Info("pubot 程序关闭...", slog.Any("Shutdown", ext))
-		dao.CloseDb()
+		// 先停止接收请求, 再等待正在进行的执行结束, 超过宽限时间则强制结束
+		// http 服务和执行各自有完整的宽限时间, 避免关闭 http 服务耗尽执行的等待时间
+		serverCtx, cancelServer := context.WithTimeout(context.Background(), config.Get().ShutdownGrace)
+		defer cancelServer()
+		if err := server.Shutdown(serverCtx); err != nil {
+			slog.Error("关闭 http 服务失败", slog.String("Err", err.Error()))
+		}
+		taskCtx, cancelTask := context.WithTimeout(context.Background(), config.Get().ShutdownGrace)
+		defer cancelTask()
+		err := taskService.Shutdown(taskCtx)
+		// 断开 agent 连接, 仍在执行的步骤随之失败
+		agentService.Close()
+		if err != nil {
+			// 仍有执行未结束时不关闭数据库连接, 避免其写入执行记录失败, 进程退出时连接随之释放
+			slog.Error("等待执行结束失败", slog.String("Err", err.Error()))
+			return
+		}
+	}
+	dao.CloseDb()
+}
+
+// agentMain 解析 pubot agent 的参数并运行 agent, 返回退出码
+func agentMain(args []string) int {
+	fs := flag.NewFlagSet("pubot agent", flag.ExitOnError)
+	var (
+		opts   agent.Options
+		labels string
+	)
+	fs.StringVar(&opts.Server, "server", "", "服务端地址, 例如 http://10.0.0.1:7777")
+	fs.StringVar(&opts.Token, "token", os.Getenv("PUBOT_AGENT_TOKEN"), "服务端配置的 agentToken, 默认读取 $PUBOT_AGENT_TOKEN")
+	fs.StringVar(&opts.Name, "name", "", "agent 名称, 默认为主机名")
+	fs.StringVar(&labels, "labels", "", "逗号分隔的标签, 例如 linux,arm64")
+	fs.IntVar(&opts.Capacity, "capacity", 1, "同时执行的会话数")
+	fs.StringVar(&opts.WorkDir, "workdir", "pubot-agent", "工作目录")
+	fs.Parse(args)
+	if labels != "" {
+		opts.Labels = strings.Split(labels, ",")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	defer stop()
+	slog.Info("pubot agent 启动...", slog.String("Server", opts.Server))
+	if err := agent.Run(ctx, opts); err != nil {
+		slog.Error("pubot agent 退出", slog.String("Err", err.Error()))
+		return 1
 	}
+	slog.Info("pubot agent 关闭...")
+	return 0
 }